@@ -5,8 +5,11 @@ go 1.23.0
 toolchain go1.23.3
 
 require (
+	github.com/fxamacker/cbor/v2 v2.9.4
+	github.com/klauspost/compress v1.18.0
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	go.bug.st/serial v1.6.3
+	golang.org/x/sys v0.31.0
 )
 
 require (
@@ -14,6 +17,6 @@ require (
 	github.com/go-ole/go-ole v1.3.0 // indirect
 	github.com/tklauser/go-sysconf v0.3.15 // indirect
 	github.com/tklauser/numcpus v0.10.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
-	golang.org/x/sys v0.31.0 // indirect
 )
@@ -0,0 +1,242 @@
+package ec2macossystemmonitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// flushCheckInterval is how often Run checks whether the window has elapsed.
+const flushCheckInterval = time.Second
+
+// Clock provides the current time, allowing tests to control time based behavior.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock backed by time.Now.
+type systemClock struct{}
+
+// Now returns the current local time.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// LogAggregator rate limits logging by suppressing repeated messages and accumulating counters over a window. The
+// first occurrence of a message in each window is logged immediately, repeats are counted and a summary is logged
+// when the window is flushed. Windows are flushed by the next Record or Count after they elapse, and on schedule
+// while Run is running. Entries are logged after the aggregator is unlocked, so a slow logger doesn't hold up other
+// callers. It is safe for concurrent use.
+type LogAggregator struct {
+	logger *Logger
+	window time.Duration
+	clock  Clock
+	// checkInterval is how often Run checks whether the window has elapsed.
+	checkInterval time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	events      map[string]*aggregateEvent
+	// totals are kept across windows, so a counter is logged every window once it has been counted, even if zero.
+	totals map[string]*aggregateTotal
+	// summaries are logged at every flush, unlike events and totals they are kept across windows.
+	summaries map[string]SummaryFunc
+}
+
+// SummaryFunc returns a summary line and its key-value pairs, or an empty message to skip the summary.
+type SummaryFunc func() (msg string, keysAndValues []any)
+
+// aggregateEvent tracks a repeated message within the current window.
+type aggregateEvent struct {
+	level Level
+	// msg is the most recent message recorded for the key.
+	msg   string
+	count int64
+}
+
+// aggregateTotal tracks a counter within the current window.
+type aggregateTotal struct {
+	msg   string
+	total int64
+	count int64
+}
+
+// NewLogAggregator creates a LogAggregator that writes to logger and summarizes every window.
+func NewLogAggregator(logger *Logger, window time.Duration) *LogAggregator {
+	a := &LogAggregator{
+		logger:        logger,
+		window:        window,
+		clock:         systemClock{},
+		checkInterval: flushCheckInterval,
+		totals:        make(map[string]*aggregateTotal),
+	}
+	a.reset()
+	return a
+}
+
+// logEntry is an entry to log once the aggregator is unlocked.
+type logEntry struct {
+	level         Level
+	msg           string
+	keysAndValues []any
+}
+
+// pendingLog holds the entries and summaries of a flush, and any message recorded, to log after unlocking.
+type pendingLog struct {
+	entries   []logEntry
+	summaries []SummaryFunc
+}
+
+// log writes the pending entries, then the summaries, to logger.
+func (p *pendingLog) log(logger *Logger) {
+	for _, entry := range p.entries {
+		logger.Log(entry.level, entry.msg, entry.keysAndValues...)
+	}
+	for _, fn := range p.summaries {
+		if msg, keysAndValues := fn(); msg != "" {
+			logger.Infow(msg, keysAndValues...)
+		}
+	}
+}
+
+// Record logs msg under key at level. Only the first occurrence of key in a window is logged, later occurrences are
+// counted and summarized as "msg (happened N times in window)" when the window is flushed.
+func (a *LogAggregator) Record(level Level, key string, msg string) {
+	a.mu.Lock()
+	pending := a.flushIfDue()
+	event, ok := a.events[key]
+	if !ok {
+		a.events[key] = &aggregateEvent{level: level, msg: msg, count: 1}
+		pending.entries = append(pending.entries, logEntry{level: level, msg: msg})
+	} else {
+		event.level = level
+		event.msg = msg
+		event.count++
+	}
+	a.mu.Unlock()
+
+	pending.log(a.logger)
+}
+
+// Recordf is Record with a formatted message.
+func (a *LogAggregator) Recordf(level Level, key string, format string, v ...interface{}) {
+	a.Record(level, key, fmt.Sprintf(format, v...))
+}
+
+// Count adds n to the counter for key, the total is logged with msg when the window is flushed. This is used for
+// values like bytes written where logging every change would be too noisy.
+func (a *LogAggregator) Count(key string, msg string, n int64) {
+	a.mu.Lock()
+	pending := a.flushIfDue()
+	total, ok := a.totals[key]
+	if !ok {
+		total = &aggregateTotal{}
+		a.totals[key] = total
+	}
+	total.msg = msg
+	total.total += n
+	total.count++
+	a.mu.Unlock()
+
+	pending.log(a.logger)
+}
+
+// Summarize logs the line returned by fn under key whenever a window is flushed. This is used for values that are
+// sampled rather than counted, like link utilization. fn is called after the aggregator is unlocked, and may be called
+// concurrently by overlapping flushes.
+func (a *LogAggregator) Summarize(key string, fn SummaryFunc) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.summaries == nil {
+		a.summaries = make(map[string]SummaryFunc)
+	}
+	a.summaries[key] = fn
+}
+
+// Flush logs summaries for the current window and starts a new window.
+func (a *LogAggregator) Flush() {
+	a.mu.Lock()
+	pending := a.flush()
+	a.mu.Unlock()
+
+	pending.log(a.logger)
+}
+
+// Run flushes each window once it has elapsed, even without further activity, until ctx is done.
+func (a *LogAggregator) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			pending := a.flushIfDue()
+			a.mu.Unlock()
+			pending.log(a.logger)
+		}
+	}
+}
+
+// flushIfDue flushes when the window has elapsed, the caller must hold mu and log the result once it has unlocked.
+func (a *LogAggregator) flushIfDue() *pendingLog {
+	if a.clock.Now().Sub(a.windowStart) >= a.window {
+		return a.flush()
+	}
+	return &pendingLog{}
+}
+
+// flush collects the summaries in key order and resets the window, the caller must hold mu and log the result once
+// it has unlocked.
+func (a *LogAggregator) flush() *pendingLog {
+	elapsed := a.clock.Now().Sub(a.windowStart).Round(time.Second)
+
+	pending := &pendingLog{}
+	for _, key := range sortedKeys(a.events) {
+		event := a.events[key]
+		// The first occurrence was already logged.
+		if event.count > 1 {
+			pending.entries = append(pending.entries, logEntry{
+				level:         event.level,
+				msg:           fmt.Sprintf("%s (happened %d times in %s)", event.msg, event.count, elapsed),
+				keysAndValues: []any{"key", key, "count", event.count},
+			})
+		}
+	}
+	for _, key := range sortedKeys(a.totals) {
+		total := a.totals[key]
+		pending.entries = append(pending.entries, logEntry{
+			level:         LevelInfo,
+			msg:           total.msg,
+			keysAndValues: []any{"total", total.total, "count", total.count, "window", elapsed.String()},
+		})
+	}
+	for _, key := range sortedKeys(a.summaries) {
+		pending.summaries = append(pending.summaries, a.summaries[key])
+	}
+	a.reset()
+	return pending
+}
+
+// reset starts a new window, forgetting events and zeroing totals.
+func (a *LogAggregator) reset() {
+	a.windowStart = a.clock.Now()
+	a.events = make(map[string]*aggregateEvent)
+	for _, total := range a.totals {
+		total.total = 0
+		total.count = 0
+	}
+}
+
+// sortedKeys returns the keys of m in order, giving summaries a stable order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
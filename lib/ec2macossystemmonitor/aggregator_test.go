@@ -0,0 +1,258 @@
+package ec2macossystemmonitor
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// newFakeClock returns a fakeClock set to a fixed time.
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)}
+}
+
+// Now returns the fake time.
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the fake time forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// testAggregator returns a LogAggregator using a fake clock and logging to a captured buffer.
+func testAggregator(t *testing.T, window time.Duration) (*LogAggregator, *fakeClock, func() []string) {
+	t.Helper()
+	logger, err := NewLogger("", false, true)
+	if err != nil {
+		t.Fatalf("NewLogger() error = %v", err)
+	}
+	buf := captureStdout(t)
+	clock := newFakeClock()
+	a := NewLogAggregator(logger, window)
+	a.clock = clock
+	a.reset()
+	lines := func() []string {
+		defer buf.Reset()
+		out := strings.TrimSpace(buf.String())
+		if out == "" {
+			return nil
+		}
+		return strings.Split(out, "\n")
+	}
+	return a, clock, lines
+}
+
+// TestLogAggregatorRecord checks the first message is logged immediately and repeats are summarized
+func TestLogAggregatorRecord(t *testing.T) {
+	a, clock, lines := testAggregator(t, 10*time.Minute)
+
+	for i := 0; i < 5; i++ {
+		a.Record(LevelError, "send", "Failed to send data")
+		clock.Advance(time.Minute)
+	}
+	if got := lines(); len(got) != 1 || got[0] != "Failed to send data" {
+		t.Fatalf("logged %q, want only the first occurrence", got)
+	}
+
+	a.Flush()
+	want := "Failed to send data (happened 5 times in 5m0s) key=send count=5"
+	if got := lines(); len(got) != 1 || got[0] != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+
+	// A new window logs the first occurrence again.
+	a.Record(LevelError, "send", "Failed to send data")
+	if got := lines(); len(got) != 1 {
+		t.Errorf("logged %q after flush, want the first occurrence", got)
+	}
+}
+
+// TestLogAggregatorSingle ensures a message seen once is not summarized again
+func TestLogAggregatorSingle(t *testing.T) {
+	a, _, lines := testAggregator(t, 10*time.Minute)
+
+	a.Record(LevelWarn, "once", "only once")
+	a.Flush()
+
+	if got := lines(); len(got) != 1 {
+		t.Errorf("logged %q, want a single line", got)
+	}
+}
+
+// TestLogAggregatorWindow checks that activity after the window has elapsed flushes the previous window
+func TestLogAggregatorWindow(t *testing.T) {
+	a, clock, lines := testAggregator(t, 10*time.Minute)
+
+	for i := 0; i < 10; i++ {
+		a.Count("written", "Sent bytes", 100)
+		clock.Advance(time.Minute)
+	}
+	if got := lines(); got != nil {
+		t.Fatalf("logged %q before the window elapsed", got)
+	}
+
+	a.Count("written", "Sent bytes", 7)
+	want := "Sent bytes total=1000 count=10 window=10m0s"
+	if got := lines(); len(got) != 1 || got[0] != want {
+		t.Fatalf("summary = %q, want %q", got, want)
+	}
+
+	clock.Advance(10 * time.Minute)
+	a.Flush()
+	want = "Sent bytes total=7 count=1 window=10m0s"
+	if got := lines(); len(got) != 1 || got[0] != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+}
+
+// TestLogAggregatorRun checks a window is flushed on schedule without further activity
+func TestLogAggregatorRun(t *testing.T) {
+	a, clock, lines := testAggregator(t, 10*time.Minute)
+	a.checkInterval = time.Millisecond
+	flushed := make(chan struct{}, 1)
+	a.Summarize("flushed", func() (string, []any) {
+		select {
+		case flushed <- struct{}{}:
+		default:
+		}
+		return "", nil
+	})
+
+	for i := 0; i < 3; i++ {
+		a.Record(LevelError, "send", "Failed to send data")
+	}
+	if got := lines(); len(got) != 1 {
+		t.Fatalf("logged %q, want only the first occurrence", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(stopped)
+	}()
+	select {
+	case <-flushed:
+		t.Fatal("flushed before the window elapsed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(10 * time.Minute)
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not flushed after the window elapsed")
+	}
+	cancel()
+	<-stopped
+
+	want := "Failed to send data (happened 3 times in 10m0s) key=send count=3"
+	if got := lines(); len(got) != 1 || got[0] != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+}
+
+// TestLogAggregatorSummarize checks summaries are logged at every flush after the counters, and skipped when empty
+func TestLogAggregatorSummarize(t *testing.T) {
+	a, _, lines := testAggregator(t, 10*time.Minute)
+
+	utilization := 12
+	a.Summarize("link", func() (string, []any) {
+		return "Serial link", []any{"utilization", utilization}
+	})
+	a.Summarize("idle", func() (string, []any) { return "", nil })
+	a.Count("written", "Sent bytes", 100)
+	a.Flush()
+	want := []string{"Sent bytes total=100 count=1 window=0s", "Serial link utilization=12"}
+	if got := lines(); !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+
+	// Counters are logged every window, even without activity
+	utilization = 20
+	a.Flush()
+	want = []string{"Sent bytes total=0 count=0 window=0s", "Serial link utilization=20"}
+	if got := lines(); !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q after another flush, want %q", got, want)
+	}
+}
+
+// TestLogAggregatorUnlocked checks entries are logged after the aggregator is unlocked, so logging doesn't block it
+func TestLogAggregatorUnlocked(t *testing.T) {
+	a, _, lines := testAggregator(t, 10*time.Minute)
+
+	a.Summarize("reentrant", func() (string, []any) {
+		a.Count("summaries", "Summaries", 1)
+		return "Summarized", nil
+	})
+	done := make(chan struct{})
+	go func() {
+		a.Flush()
+		a.Flush()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush() blocked with the aggregator locked")
+	}
+	want := []string{"Summarized", "Summaries total=1 count=1 window=0s", "Summarized"}
+	if got := lines(); !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+// TestLogAggregatorLevel ensures suppressed messages and summaries respect the logger level
+func TestLogAggregatorLevel(t *testing.T) {
+	a, _, lines := testAggregator(t, time.Minute)
+	a.logger.SetLevel(LevelWarn)
+
+	a.Record(LevelInfo, "chatty", "info")
+	a.Record(LevelInfo, "chatty", "info")
+	a.Record(LevelWarn, "warn", "warning")
+	a.Record(LevelWarn, "warn", "warning")
+	a.Flush()
+
+	want := []string{"warning", "warning (happened 2 times in 0s) key=warn count=2"}
+	got := lines()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+// TestLogAggregatorConcurrent records from multiple goroutines to verify counts are not lost
+func TestLogAggregatorConcurrent(t *testing.T) {
+	a, _, lines := testAggregator(t, time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				a.Count("written", "Sent bytes", 1)
+			}
+		}()
+	}
+	wg.Wait()
+	a.Flush()
+
+	want := "Sent bytes total=1000 count=1000 window=0s"
+	if got := lines(); len(got) != 1 || got[0] != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,279 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BatchTag is the tag of batch payloads. The data of a batch is a JSON array of SerialPayload objects, each keeping
+// its own tag, compression and version 2 fields, so several samples share one envelope and checksum. Batches require
+// protocol version 2.
+const BatchTag = "batch"
+
+// BatchEntry is a tagged sample to send in a batch.
+type BatchEntry struct {
+	Tag      string
+	Data     string
+	Compress bool
+}
+
+// BuildBatch builds a single frame holding entries. Options apply to the batch as a whole, for example
+// WithAutoCompression compresses the batch data rather than each entry.
+func BuildBatch(entries []BatchEntry, opts ...MessageOption) ([]byte, error) {
+	var options messageOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	payloads := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		payload, _, err := buildPayload(entry.Tag, entry.Data, entry.Compress, &messageOptions{})
+		if err != nil {
+			return nil, err
+		}
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payloadBytes)
+	}
+	return buildBatch(payloads, &options)
+}
+
+// SendBatch builds a batch of entries with BuildBatch and passes it to relayd.
+func SendBatch(entries []BatchEntry, opts ...MessageOption) (n int, err error) {
+	frame, err := BuildBatch(entries, opts...)
+	if err != nil {
+		return 0, err
+	}
+	return PassToRelayd(frame)
+}
+
+// buildBatch builds a batch frame from encoded payloads.
+func buildBatch(payloads [][]byte, options *messageOptions) ([]byte, error) {
+	switch options.version {
+	case 0:
+		options.version = ProtocolVersion2
+	case ProtocolVersion1:
+		return nil, fmt.Errorf("ec2macossystemmonitor: batches require protocol version %d", ProtocolVersion2)
+	}
+	data := "[" + string(bytes.Join(payloads, []byte(","))) + "]"
+	payload, version, err := buildPayload(BatchTag, data, false, options)
+	if err != nil {
+		return nil, err
+	}
+	return buildFrame(payload, version, options)
+}
+
+// UnpackBatch returns the entries of a decoded batch message as messages with the batch's version, decompressing the
+// data of compressed entries. Errors are a *PayloadError or a *DataError.
+func UnpackBatch(msg *Message) ([]*Message, error) {
+	var payloads []SerialPayload
+	if err := json.Unmarshal([]byte(msg.Data), &payloads); err != nil {
+		return nil, &PayloadError{Err: err}
+	}
+	entries := make([]*Message, 0, len(payloads))
+	for _, payload := range payloads {
+		entry := &Message{Version: msg.Version, SerialPayload: payload}
+		if entry.Compress {
+			data, err := decompressData(entry.SerialPayload)
+			if err != nil {
+				return nil, &DataError{Err: err}
+			}
+			entry.Data = data
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// batchTags returns the tags of the entries of a batch frame, decompressing the batch but not its entries. The
+// entries of a fragment can't be read, so a fragment of a batch is an error.
+func batchTags(frame []byte) ([]string, error) {
+	msg, err := DecodeMessage(frame)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Fragment() {
+		return nil, errors.New("ec2macossystemmonitor: the entries of a fragmented batch can't be read")
+	}
+	var payloads []struct {
+		Tag string `json:"tag"`
+	}
+	if err := json.Unmarshal([]byte(msg.Data), &payloads); err != nil {
+		return nil, &PayloadError{Err: err}
+	}
+	tags := make([]string, 0, len(payloads))
+	for _, payload := range payloads {
+		tags = append(tags, payload.Tag)
+	}
+	return tags, nil
+}
+
+// CoalescingSink is a Sink that packs frames arriving within a short window into batches before writing them to
+// another sink, saving the envelope overhead of each frame.
+//
+// Batches are written once the window has elapsed since their first frame, or earlier when the next frame would make
+// them larger than the maximum frame size. A frame on its own is written unchanged. Frames that can't be batched are
+// written unchanged after any pending batch so the order is kept: frames that don't decode, batches and signed frames,
+// since the relay can't sign the batch.
+//
+// Batches are built with the strongest checksum of their frames, so a frame sent with CRC-32C isn't downgraded to
+// Adler-32 by being batched. Batches written in the background report their bytes and errors from the next call to
+// WriteFrame or Close.
+type CoalescingSink struct {
+	sink         Sink
+	window       time.Duration
+	maxFrameSize int
+
+	// mu guards the pending batch. writeMu orders writes to the sink, it is taken before mu is released so batches
+	// and frames are written in the order they were taken, while frames can still be added to the next batch during
+	// a slow write.
+	mu        sync.Mutex
+	writeMu   sync.Mutex
+	payloads  [][]byte
+	frames    [][]byte
+	algorithm ChecksumAlgorithm
+	timer     *time.Timer
+
+	// resultMu guards the bytes written and the error since they were last reported.
+	resultMu sync.Mutex
+	written  int
+	err      error
+}
+
+// NewCoalescingSink creates a CoalescingSink writing batches no larger than maxFrameSize to sink.
+func NewCoalescingSink(sink Sink, window time.Duration, maxFrameSize int) *CoalescingSink {
+	return &CoalescingSink{sink: sink, window: window, maxFrameSize: maxFrameSize}
+}
+
+// Name returns the name of the underlying sink.
+func (c *CoalescingSink) Name() string {
+	return c.sink.Name()
+}
+
+// WriteFrame adds the frame to the pending batch, or writes it unchanged if it can't be batched.
+func (c *CoalescingSink) WriteFrame(frame Frame) (n int, err error) {
+	c.mu.Lock()
+	payload, algorithm, ok := batchablePayload(frame.Bytes)
+	if !ok {
+		c.flushUnlock(frame.Bytes)
+		return c.result()
+	}
+	if len(c.payloads) > 0 {
+		payloads := append(c.payloads[:len(c.payloads):len(c.payloads)], payload)
+		if size, err := c.batchSize(payloads, strongerChecksum(c.algorithm, algorithm)); err != nil || size > c.maxFrameSize {
+			c.flushUnlock()
+			c.mu.Lock()
+		}
+	}
+	c.payloads = append(c.payloads, payload)
+	c.frames = append(c.frames, append([]byte{}, frame.Bytes...))
+	c.algorithm = strongerChecksum(c.algorithm, algorithm)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.window, func() {
+			c.mu.Lock()
+			c.flushUnlock()
+		})
+	}
+	c.mu.Unlock()
+	return c.result()
+}
+
+// Close writes the pending batch and closes the underlying sink.
+func (c *CoalescingSink) Close() error {
+	c.mu.Lock()
+	c.flushUnlock()
+	_, err := c.result()
+	return errors.Join(err, c.sink.Close())
+}
+
+// batchSize returns the size of the uncompressed batch frame for payloads.
+func (c *CoalescingSink) batchSize(payloads [][]byte, algorithm ChecksumAlgorithm) (int, error) {
+	frame, err := buildBatch(payloads, &messageOptions{checksum: algorithm})
+	return len(frame), err
+}
+
+// flushUnlock takes the pending batch and unlocks c.mu, which must be held, then writes the batch followed by frames.
+// A single frame is written unchanged.
+func (c *CoalescingSink) flushUnlock(frames ...[]byte) {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	payloads, pending, algorithm := c.payloads, c.frames, c.algorithm
+	c.payloads, c.frames, c.algorithm = nil, nil, ""
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.mu.Unlock()
+
+	switch len(payloads) {
+	case 0:
+	case 1:
+		c.write(pending[0])
+	default:
+		options := messageOptions{checksum: algorithm, auto: true, autoThreshold: DefaultAutoCompressionThreshold}
+		batch, err := buildBatch(payloads, &options)
+		if err != nil {
+			// Fall back to the original frames rather than losing them
+			for _, frame := range pending {
+				c.write(frame)
+			}
+			break
+		}
+		c.write(batch)
+	}
+	for _, frame := range frames {
+		c.write(frame)
+	}
+}
+
+// write writes b to the underlying sink, keeping the first error until it is reported.
+func (c *CoalescingSink) write(b []byte) {
+	n, err := c.sink.WriteFrame(Frame{Tag: frameTag(b), Bytes: b})
+	c.resultMu.Lock()
+	defer c.resultMu.Unlock()
+	c.written += n
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+// result returns and resets the bytes written and the error since the last call.
+func (c *CoalescingSink) result() (int, error) {
+	c.resultMu.Lock()
+	defer c.resultMu.Unlock()
+	n, err := c.written, c.err
+	c.written, c.err = 0, nil
+	return n, err
+}
+
+// strongerChecksum returns the algorithm detecting more errors, CRC-32C over Adler-32.
+func strongerChecksum(a, b ChecksumAlgorithm) ChecksumAlgorithm {
+	if a == ChecksumCRC32C || b == ChecksumCRC32C {
+		return ChecksumCRC32C
+	}
+	return ChecksumAdler32
+}
+
+// batchablePayload returns the payload of frame and its checksum algorithm if it can be added to a batch.
+func batchablePayload(frame []byte) ([]byte, ChecksumAlgorithm, bool) {
+	var envelope SerialMessage
+	if err := json.Unmarshal(frame, &envelope); err != nil {
+		return nil, "", false
+	}
+	if envelope.Version > MaxProtocolVersion || envelope.MAC != "" {
+		return nil, "", false
+	}
+	if sum, err := checksum(envelope.Algorithm, []byte(envelope.Payload)); err != nil || sum != envelope.Checksum {
+		return nil, "", false
+	}
+	var payload SerialPayload
+	if err := json.Unmarshal([]byte(envelope.Payload), &payload); err != nil || payload.Tag == BatchTag {
+		return nil, "", false
+	}
+	return []byte(envelope.Payload), envelope.Algorithm, true
+}
@@ -0,0 +1,265 @@
+package ec2macossystemmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricEntries returns n small metric samples, typical of what collectors send.
+func metricEntries(n int) []BatchEntry {
+	entries := make([]BatchEntry, n)
+	for i := range entries {
+		entries[i] = BatchEntry{Tag: fmt.Sprintf("metric%d", i%5), Data: fmt.Sprintf("%.1f", float64(i*37%1000)/10)}
+	}
+	return entries
+}
+
+// decodeBatch decodes a batch frame and unpacks its entries or fails the test.
+func decodeBatch(t *testing.T, frame []byte) []*Message {
+	t.Helper()
+	msg, err := DecodeMessage(frame)
+	if err != nil {
+		t.Fatalf("DecodeMessage() error = %v", err)
+	}
+	if msg.Tag != BatchTag {
+		t.Fatalf("DecodeMessage() tag = %q, want %q", msg.Tag, BatchTag)
+	}
+	entries, err := UnpackBatch(msg)
+	if err != nil {
+		t.Fatalf("UnpackBatch() error = %v", err)
+	}
+	return entries
+}
+
+// TestBatchRoundTrip checks every entry of a batch is unpacked with its tag, data and compression
+func TestBatchRoundTrip(t *testing.T) {
+	entries := append(metricEntries(3), BatchEntry{Tag: "logs", Data: strings.Repeat("\"line\"\n", 50), Compress: true})
+	for _, opts := range [][]MessageOption{nil, {WithAutoCompression(DefaultAutoCompressionThreshold)}, {WithCodec(CodecZstd)}} {
+		frame, err := BuildBatch(entries, opts...)
+		if err != nil {
+			t.Fatalf("BuildBatch() error = %v", err)
+		}
+		var got []BatchEntry
+		for _, msg := range decodeBatch(t, frame) {
+			got = append(got, BatchEntry{Tag: msg.Tag, Data: msg.Data, Compress: msg.Compress})
+		}
+		if !reflect.DeepEqual(got, entries) {
+			t.Errorf("unpacked entries = %+v, want %+v", got, entries)
+		}
+	}
+	if _, err := BuildBatch(entries, WithVersion(ProtocolVersion1)); err == nil {
+		t.Error("BuildBatch() with version 1 succeeded")
+	}
+}
+
+// TestBatchSavings compares the bytes on the wire for a batch with individual frames. Without compression a batch
+// only saves the envelopes, the shared compression of the entries is where most of the savings come from.
+func TestBatchSavings(t *testing.T) {
+	entries := metricEntries(10)
+	individual := 0
+	for _, entry := range entries {
+		individual += len(mustBuildMessage(t, entry.Tag, entry.Data))
+	}
+	batch, err := BuildBatch(entries)
+	if err != nil {
+		t.Fatalf("BuildBatch() error = %v", err)
+	}
+	compressed, err := BuildBatch(entries, WithAutoCompression(DefaultAutoCompressionThreshold))
+	if err != nil {
+		t.Fatalf("BuildBatch() error = %v", err)
+	}
+	t.Logf("10 metrics: %d bytes as individual frames, %d bytes as a batch, %d bytes compressed", individual, len(batch), len(compressed))
+	if len(batch) >= individual {
+		t.Errorf("batch is %d bytes, want less than %d bytes of individual frames", len(batch), individual)
+	}
+	if len(compressed) > individual/2 {
+		t.Errorf("compressed batch is %d bytes, want at most half of %d bytes of individual frames", len(compressed), individual)
+	}
+}
+
+// TestCoalescingSink checks frames are batched within the size limit, unbatchable frames keep their order and batches
+// are written once the window elapses
+func TestCoalescingSink(t *testing.T) {
+	out := &memorySink{name: "serial"}
+	sink := NewCoalescingSink(out, time.Hour, 400)
+	var frames [][]byte
+	for _, entry := range metricEntries(12) {
+		frames = append(frames, mustBuildMessage(t, entry.Tag, entry.Data))
+	}
+	signed, err := BuildMessage("signed", "x", false, SignWith(mustKeyring(t, testKey("k1"))))
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	written := 0
+	for _, frame := range append(frames, signed, []byte("not json\n"), frames[0]) {
+		n, err := sink.WriteFrame(Frame{Bytes: frame})
+		if err != nil {
+			t.Fatalf("WriteFrame() error = %v", err)
+		}
+		written += n
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// The metrics are split into batches by size, followed by the unbatchable frames and the last metric on its own.
+	var tags []string
+	var unpacked int
+	total := 0
+	for _, frame := range out.frames {
+		total += len(frame.Bytes)
+		if len(frame.Bytes) > 400 {
+			t.Errorf("written frame is %d bytes, limit is 400", len(frame.Bytes))
+		}
+		tags = append(tags, frame.Tag)
+		if frame.Tag == BatchTag {
+			unpacked += len(decodeBatch(t, frame.Bytes))
+		}
+	}
+	if unpacked != len(frames) {
+		t.Errorf("batches hold %d frames, want %d", unpacked, len(frames))
+	}
+	if n := len(tags); n < 5 || tags[0] != BatchTag || tags[1] != BatchTag || !reflect.DeepEqual(tags[n-3:], []string{"signed", "", "metric0"}) {
+		t.Errorf("written tags = %q, want batches followed by the signed, invalid and last frames", tags)
+	}
+	// Bytes written by Close aren't reported by WriteFrame.
+	if written > total || written == 0 {
+		t.Errorf("WriteFrame() reported %d bytes, %d were written", written, total)
+	}
+
+	out = &memorySink{name: "serial"}
+	sink = NewCoalescingSink(out, 10*time.Millisecond, DefaultMaxFrameSize)
+	for _, frame := range frames[:3] {
+		if _, err := sink.WriteFrame(Frame{Bytes: frame}); err != nil {
+			t.Fatalf("WriteFrame() error = %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(out.tags()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := out.tags(); !reflect.DeepEqual(got, []string{BatchTag}) {
+		t.Errorf("after the window written tags = %q, want one batch", got)
+	}
+}
+
+// enteringSink is a blockingSink that signals entered when a write starts.
+type enteringSink struct {
+	blockingSink
+	entered chan struct{}
+}
+
+func (s *enteringSink) WriteFrame(frame Frame) (int, error) {
+	s.entered <- struct{}{}
+	return s.blockingSink.WriteFrame(frame)
+}
+
+// TestCoalescingSinkSlowWrite checks frames can be added to the next batch while a batch is written to a blocked sink
+func TestCoalescingSinkSlowWrite(t *testing.T) {
+	out := &enteringSink{
+		blockingSink: blockingSink{memorySink: memorySink{name: "serial"}, unblock: make(chan struct{})},
+		entered:      make(chan struct{}, 10),
+	}
+	sink := NewCoalescingSink(out, 10*time.Millisecond, DefaultMaxFrameSize)
+	frames := [][]byte{mustBuildMessage(t, "first", "1"), mustBuildMessage(t, "first", "2")}
+	for _, frame := range frames {
+		if _, err := sink.WriteFrame(Frame{Bytes: frame}); err != nil {
+			t.Fatalf("WriteFrame() error = %v", err)
+		}
+	}
+	<-out.entered
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sink.WriteFrame(Frame{Bytes: mustBuildMessage(t, "second", "3")})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WriteFrame() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("WriteFrame() blocked while a batch was written")
+	}
+	close(out.unblock)
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := out.tags(); !reflect.DeepEqual(got, []string{BatchTag, "second"}) {
+		t.Errorf("written tags = %q, want the batch followed by the second frame", got)
+	}
+}
+
+// TestCoalescingSinkChecksum checks a batch uses CRC-32C when any of its frames did
+func TestCoalescingSinkChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		algs []ChecksumAlgorithm
+		want ChecksumAlgorithm
+	}{
+		{"adler32", []ChecksumAlgorithm{ChecksumAdler32, ChecksumAdler32}, ""},
+		{"crc32c", []ChecksumAlgorithm{ChecksumCRC32C, ChecksumCRC32C}, ChecksumCRC32C},
+		{"mixed", []ChecksumAlgorithm{ChecksumAdler32, ChecksumCRC32C}, ChecksumCRC32C},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &memorySink{name: "serial"}
+			sink := NewCoalescingSink(out, time.Hour, DefaultMaxFrameSize)
+			for _, alg := range tt.algs {
+				frame, err := BuildMessage("cpuutil", "2.0", false, WithChecksum(alg))
+				if err != nil {
+					t.Fatalf("BuildMessage() error = %v", err)
+				}
+				if _, err := sink.WriteFrame(Frame{Bytes: frame}); err != nil {
+					t.Fatalf("WriteFrame() error = %v", err)
+				}
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if len(out.frames) != 1 {
+				t.Fatalf("wrote %d frames, want one batch", len(out.frames))
+			}
+			var envelope SerialMessage
+			if err := json.Unmarshal(out.frames[0].Bytes, &envelope); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if envelope.Algorithm != tt.want {
+				t.Errorf("batch checksum = %q, want %q", envelope.Algorithm, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkBatchWire reports the bytes on the wire for metrics sent as individual frames and as a batch.
+func BenchmarkBatchWire(b *testing.B) {
+	for _, n := range []int{1, 10, 50} {
+		entries := metricEntries(n)
+		b.Run(fmt.Sprintf("individual/%d", n), func(b *testing.B) {
+			size := 0
+			for i := 0; i < b.N; i++ {
+				size = 0
+				for _, entry := range entries {
+					size += len(mustBuildMessage(b, entry.Tag, entry.Data))
+				}
+			}
+			b.ReportMetric(float64(size), "wire-bytes")
+		})
+		b.Run(fmt.Sprintf("batch/%d", n), func(b *testing.B) {
+			size := 0
+			for i := 0; i < b.N; i++ {
+				frame, err := BuildBatch(entries, WithAutoCompression(DefaultAutoCompressionThreshold))
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(frame)
+			}
+			b.ReportMetric(float64(size), "wire-bytes")
+		})
+	}
+}
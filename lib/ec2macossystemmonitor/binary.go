@@ -0,0 +1,217 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Encoding selects how frames are written.
+//
+// EncodingJSON is the original format: a JSON envelope holding the payload as an escaped JSON string, terminated by a
+// newline. EncodingCBOR writes binary frames, base64 encoded so only safe characters and the terminating newline are
+// written to the serial device:
+//
+//	{"b":" | base64 of the CRC-32C of the body (uint32, big endian) followed by the body | "} | newline
+//
+// The body is a CBOR map with integer keys holding the version, the CBOR encoded payload and the key id and MAC of
+// signed messages. The payload also uses integer keys, and compressed data is carried as raw bytes rather than base64
+// inside the body, so binary frames avoid the escaping and most of the field names of JSON frames. Binary frames always
+// use CRC-32C and require protocol version 2. {"b": can't appear inside a JSON frame, so readers can tell the encodings
+// apart and a stream may mix both.
+type Encoding string
+
+const (
+	EncodingJSON Encoding = "json"
+	EncodingCBOR Encoding = "cbor"
+)
+
+// binaryMagic starts every binary frame and binaryEnd ends it before the newline.
+var (
+	binaryMagic = []byte(`{"b":"`)
+	binaryEnd   = []byte(`"}`)
+)
+
+// binaryChecksumSize is the size of the checksum before the body of a binary frame.
+const binaryChecksumSize = 4
+
+// binaryEncMode encodes deterministically so identical messages produce identical frames.
+var binaryEncMode, _ = cbor.CoreDetEncOptions().EncMode()
+
+// binaryEnvelope is the body of a binary frame.
+type binaryEnvelope struct {
+	Version int    `cbor:"1,keyasint,omitempty"`
+	Payload []byte `cbor:"2,keyasint"`
+	KeyID   string `cbor:"3,keyasint,omitempty"`
+	MAC     []byte `cbor:"4,keyasint,omitempty"`
+}
+
+// binaryPayload is SerialPayload with integer keys. Compressed data that isn't a fragment is carried in Raw without
+// base64, fragments keep the base64 text since they can split it anywhere.
+type binaryPayload struct {
+	Tag       string            `cbor:"1,keyasint"`
+	Compress  bool              `cbor:"2,keyasint,omitempty"`
+	Data      string            `cbor:"3,keyasint,omitempty"`
+	Raw       []byte            `cbor:"4,keyasint,omitempty"`
+	Codec     Codec             `cbor:"5,keyasint,omitempty"`
+	Meta      map[string]string `cbor:"6,keyasint,omitempty"`
+	Time      int64             `cbor:"7,keyasint,omitempty"`
+	Producer  string            `cbor:"8,keyasint,omitempty"`
+	Source    string            `cbor:"9,keyasint,omitempty"`
+	Seq       uint64            `cbor:"10,keyasint,omitempty"`
+	MessageID string            `cbor:"11,keyasint,omitempty"`
+	Part      int               `cbor:"12,keyasint,omitempty"`
+	Parts     int               `cbor:"13,keyasint,omitempty"`
+}
+
+// ParseEncoding parses an encoding name.
+func ParseEncoding(name string) (Encoding, error) {
+	switch enc := Encoding(name); enc {
+	case EncodingJSON, EncodingCBOR:
+		return enc, nil
+	}
+	return "", fmt.Errorf("ec2macossystemmonitor: unknown encoding %q", name)
+}
+
+// WithEncoding selects the frame encoding, EncodingCBOR requires version 2.
+func WithEncoding(enc Encoding) MessageOption {
+	return func(o *messageOptions) {
+		o.encoding = enc
+	}
+}
+
+// buildBinaryFrame builds a binary frame for an encoded payload.
+func buildBinaryFrame(payload SerialPayload, version int, options *messageOptions) ([]byte, error) {
+	bp := binaryPayload{
+		Tag:       payload.Tag,
+		Compress:  payload.Compress,
+		Data:      payload.Data,
+		Codec:     payload.Codec,
+		Meta:      payload.Meta,
+		Time:      payload.Time,
+		Producer:  payload.Producer,
+		Source:    payload.Source,
+		Seq:       payload.Seq,
+		MessageID: payload.MessageID,
+		Part:      payload.Part,
+		Parts:     payload.Parts,
+	}
+	if payload.Compress && !payload.Fragment() {
+		raw, err := base64.StdEncoding.DecodeString(payload.Data)
+		if err != nil {
+			return nil, fmt.Errorf("ec2macossystemmonitor: %w", err)
+		}
+		bp.Data, bp.Raw = "", raw
+	}
+	payloadBytes, err := binaryEncMode.Marshal(bp)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: marshal: %w", err)
+	}
+
+	envelope := binaryEnvelope{Version: version, Payload: payloadBytes}
+	if options.keys != nil {
+		key := options.keys.Current()
+		envelope.KeyID = key.ID
+		envelope.MAC = key.mac(payloadBytes)
+	}
+	body, err := binaryEncMode.Marshal(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: marshal: %w", err)
+	}
+
+	raw := make([]byte, binaryChecksumSize, binaryChecksumSize+len(body))
+	binary.BigEndian.PutUint32(raw, crc32.Checksum(body, castagnoli))
+	raw = append(raw, body...)
+	frame := make([]byte, 0, len(binaryMagic)+base64.StdEncoding.EncodedLen(len(raw))+len(binaryEnd)+1)
+	frame = append(frame, binaryMagic...)
+	frame = base64.StdEncoding.AppendEncode(frame, raw)
+	frame = append(frame, binaryEnd...)
+	return append(frame, '\n'), nil
+}
+
+// binaryFrameBody returns the checksum and body of a binary frame, a trailing newline is ignored.
+func binaryFrameBody(frame []byte) (uint32, []byte, error) {
+	frame = bytes.TrimSuffix(frame, []byte("\n"))
+	if !bytes.HasPrefix(frame, binaryMagic) || !bytes.HasSuffix(frame, binaryEnd) || len(frame) < len(binaryMagic)+len(binaryEnd) {
+		return 0, nil, errors.New("binary frame isn't enclosed in " + string(binaryMagic) + string(binaryEnd))
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(frame[len(binaryMagic) : len(frame)-len(binaryEnd)]))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(raw) < binaryChecksumSize {
+		return 0, nil, errors.New("binary frame is too short for its checksum")
+	}
+	return binary.BigEndian.Uint32(raw), raw[binaryChecksumSize:], nil
+}
+
+// decodeBinaryFrame decodes a binary frame, returning the same error types as DecodeMessage.
+func decodeBinaryFrame(frame []byte, options *decodeOptions) (*Message, error) {
+	want, body, err := binaryFrameBody(frame)
+	if err != nil {
+		return nil, &EnvelopeError{Err: err}
+	}
+	if sum := crc32.Checksum(body, castagnoli); sum != want {
+		return nil, &ChecksumError{Got: sum, Want: want}
+	}
+
+	var envelope binaryEnvelope
+	if err := cbor.Unmarshal(body, &envelope); err != nil {
+		return nil, &EnvelopeError{Err: err}
+	}
+	if envelope.Version > MaxProtocolVersion || envelope.Version < ProtocolVersion2 {
+		return nil, &VersionError{Version: envelope.Version}
+	}
+	if options.keys != nil {
+		if err := options.keys.verify(envelope.KeyID, envelope.Payload, envelope.MAC); err != nil {
+			return nil, err
+		}
+	}
+
+	var bp binaryPayload
+	if err := cbor.Unmarshal(envelope.Payload, &bp); err != nil {
+		return nil, &PayloadError{Err: err}
+	}
+	msg := &Message{
+		Version: envelope.Version,
+		SerialPayload: SerialPayload{
+			Tag:       bp.Tag,
+			Compress:  bp.Compress,
+			Data:      bp.Data,
+			Codec:     bp.Codec,
+			Meta:      bp.Meta,
+			Time:      bp.Time,
+			Producer:  bp.Producer,
+			Source:    bp.Source,
+			Seq:       bp.Seq,
+			MessageID: bp.MessageID,
+			Part:      bp.Part,
+			Parts:     bp.Parts,
+		},
+	}
+	if bp.Raw != nil {
+		msg.Data = base64.StdEncoding.EncodeToString(bp.Raw)
+	}
+	return msg, nil
+}
+
+// binaryFrameTag returns the tag of a binary frame, or an empty string if it can't be parsed.
+func binaryFrameTag(frame []byte) string {
+	_, body, err := binaryFrameBody(frame)
+	var envelope binaryEnvelope
+	if err != nil || cbor.Unmarshal(body, &envelope) != nil {
+		return ""
+	}
+	var payload struct {
+		Tag string `cbor:"1,keyasint"`
+	}
+	if cbor.Unmarshal(envelope.Payload, &payload) != nil {
+		return ""
+	}
+	return payload.Tag
+}
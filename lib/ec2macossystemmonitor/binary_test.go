@@ -0,0 +1,219 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// binaryCases are messages covering the payload fields, built with each encoding by the tests below.
+var binaryCases = []struct {
+	name     string
+	tag      string
+	data     string
+	compress bool
+	opts     []MessageOption
+}{
+	{"cpuutil", "cpuutil", "2.0", false, nil},
+	{"stamped", "cpuutil", "2.0", false, []MessageOption{WithProducer("i-0123456789abcdef0"), WithTimestamp(time.UnixMilli(1792324800123)), WithSequence("cpuutil", 42)}},
+	{"metadata", "cpuutil", "2.0", false, []MessageOption{WithMetadata("instance", "i-0123456789abcdef0"), WithMetadata("agent", "cpuutilization")}},
+	{"escaped", "logs", strings.Repeat("{\"level\":\"info\",\"msg\":\"line\"}\n", 20), false, nil},
+	{"compressed", "ps", processList(200), true, nil},
+	{"zstd", "ps", processList(200), true, []MessageOption{WithCodec(CodecZstd)}},
+	{"signed", "cpuutil", "2.0", false, []MessageOption{SignWith(goldenKeyring)}},
+}
+
+// TestBinaryRoundTrip checks binary frames decode to the same message as JSON frames
+func TestBinaryRoundTrip(t *testing.T) {
+	for _, tt := range binaryCases {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonFrame, err := BuildMessage(tt.tag, tt.data, tt.compress, append(tt.opts, WithVersion(ProtocolVersion2))...)
+			if err != nil {
+				t.Fatalf("BuildMessage() error = %v", err)
+			}
+			binaryFrame, err := BuildMessage(tt.tag, tt.data, tt.compress, append(tt.opts, WithEncoding(EncodingCBOR))...)
+			if err != nil {
+				t.Fatalf("BuildMessage() with CBOR error = %v", err)
+			}
+			want, err := DecodeMessage(jsonFrame)
+			if err != nil {
+				t.Fatalf("DecodeMessage() of JSON frame error = %v", err)
+			}
+			got, err := DecodeMessage(binaryFrame)
+			if err != nil {
+				t.Fatalf("DecodeMessage() of binary frame error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("binary frame decoded to %+v, want %+v", got, want)
+			}
+			if tt.name == "signed" {
+				if _, err := DecodeMessage(binaryFrame, VerifyWith(goldenKeyring)); err != nil {
+					t.Errorf("DecodeMessage() verifying binary frame error = %v", err)
+				}
+				if _, err := DecodeMessage(binaryFrame, VerifyWith(mustKeyring(t, testKey("other")))); !errors.Is(err, ErrAuthentication) {
+					t.Errorf("DecodeMessage() verifying with another key error = %v, want %v", err, ErrAuthentication)
+				}
+			}
+		})
+	}
+	if _, err := BuildMessage("test", "", false, WithEncoding(EncodingCBOR), WithVersion(ProtocolVersion1)); err == nil {
+		t.Error("BuildMessage() with CBOR and version 1 succeeded")
+	}
+}
+
+// TestBinarySize compares the size of binary frames with the current BuildMessage output, binary frames must always
+// be smaller
+func TestBinarySize(t *testing.T) {
+	for _, tt := range binaryCases {
+		jsonFrame, err := BuildMessage(tt.tag, tt.data, tt.compress, tt.opts...)
+		if err != nil {
+			t.Fatalf("BuildMessage() error = %v", err)
+		}
+		binaryFrame, err := BuildMessage(tt.tag, tt.data, tt.compress, append(tt.opts, WithEncoding(EncodingCBOR))...)
+		if err != nil {
+			t.Fatalf("BuildMessage() with CBOR error = %v", err)
+		}
+		saved := 100 - 100*len(binaryFrame)/len(jsonFrame)
+		t.Logf("%-10s JSON %5d bytes, CBOR %5d bytes, %d%% smaller", tt.name, len(jsonFrame), len(binaryFrame), saved)
+		if len(binaryFrame) >= len(jsonFrame) {
+			t.Errorf("%s: binary frame is %d bytes, JSON frame is %d bytes", tt.name, len(binaryFrame), len(jsonFrame))
+		}
+	}
+}
+
+// TestBinaryFragments checks oversized messages are split into binary frames within the limit
+func TestBinaryFragments(t *testing.T) {
+	data := processList(300)
+	frames, err := BuildMessages("ps", data, true, WithEncoding(EncodingCBOR), WithMaxFrameSize(300))
+	if err != nil {
+		t.Fatalf("BuildMessages() error = %v", err)
+	}
+	for _, frame := range frames {
+		if len(frame) > 300 {
+			t.Errorf("fragment is %d bytes, limit is 300", len(frame))
+		}
+	}
+	complete := reassemble(t, NewReassembler(time.Minute), frames)
+	if len(complete) != 1 || complete[0].Data != data {
+		t.Errorf("reassembled %d messages, want the original data", len(complete))
+	}
+}
+
+// TestReaderMixedEncodings reads a stream mixing JSON and binary frames with corrupted and truncated binary frames
+func TestReaderMixedEncodings(t *testing.T) {
+	build := func(tag, data string) []byte {
+		frame, err := BuildMessage(tag, data, false, WithEncoding(EncodingCBOR))
+		if err != nil {
+			t.Fatalf("BuildMessage() error = %v", err)
+		}
+		return frame
+	}
+	corrupted := corruptBinaryFrame(build("corrupted", "data"))
+	// A lost newline merges the frame with the next, it is decoded on its own
+	merged := build("merged", "data")
+	merged = merged[:len(merged)-1]
+
+	var stream bytes.Buffer
+	for _, frame := range [][]byte{
+		mustBuildMessage(t, "json", "1"),
+		build("binary", "line\n{\"csum\":1}\n"),
+		corrupted,
+		build("after", "2"),
+		merged,
+		mustBuildMessage(t, "json", "3"),
+		build("truncated", "data")[:12],
+	} {
+		stream.Write(frame)
+	}
+
+	var got []string
+	r := NewReader(&stream)
+	for {
+		msg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		var frameErr *FrameError
+		if errors.As(err, &frameErr) {
+			got = append(got, "error")
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, msg.Tag)
+	}
+	want := []string{"json", "binary", "error", "after", "merged", "json", "error"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Next() returned %q, want %q", got, want)
+	}
+	if stats := r.Stats(); stats.Frames != 5 || stats.ChecksumFailures != 1 || stats.DecodeFailures != 1 {
+		t.Errorf("Stats() = %+v, want 5 frames, 1 checksum failure and 1 decode failure", stats)
+	}
+}
+
+// corruptBinaryFrame changes the first base64 character of a binary frame, which stays valid base64 but no longer
+// matches its checksum.
+func corruptBinaryFrame(frame []byte) []byte {
+	if i := len(binaryMagic); frame[i] == 'A' {
+		frame[i] = 'B'
+	} else {
+		frame[i] = 'A'
+	}
+	return frame
+}
+
+// TestBinaryFrameSafe checks binary frames only hold printable characters and their terminating newline, even when
+// the body holds newlines and other control bytes
+func TestBinaryFrameSafe(t *testing.T) {
+	safe := func(name string, frame []byte) {
+		t.Helper()
+		if i := bytes.IndexFunc(frame[:len(frame)-1], func(r rune) bool { return r < 0x20 || r >= 0x7F }); i >= 0 || frame[len(frame)-1] != '\n' {
+			t.Errorf("%s: frame %q has an unsafe byte at %d or no trailing newline", name, frame, i)
+		}
+	}
+	for _, tt := range binaryCases {
+		frame, err := BuildMessage(tt.tag, tt.data, tt.compress, append(tt.opts, WithEncoding(EncodingCBOR))...)
+		if err != nil {
+			t.Fatalf("%s: BuildMessage() error = %v", tt.name, err)
+		}
+		safe(tt.name, frame)
+	}
+
+	frame, err := BuildMessage("logs", "a\nb\n\x00\x1b", false, WithEncoding(EncodingCBOR))
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	if _, body, err := binaryFrameBody(frame); err != nil || !bytes.Contains(body, []byte{0x0A}) {
+		t.Fatalf("binaryFrameBody() = %q, %v, want a body holding 0x0A", body, err)
+	}
+	safe("newlines", frame)
+	if msg, err := DecodeMessage(frame); err != nil || msg.Data != "a\nb\n\x00\x1b" {
+		t.Errorf("DecodeMessage() = %+v, %v, want the original data", msg, err)
+	}
+}
+
+// TestRelayBinaryFrames checks the relay splits binary frames whose body holds newlines at their terminating newline
+func TestRelayBinaryFrames(t *testing.T) {
+	out := &memorySink{name: "out"}
+	relay := &SerialRelay{}
+	relay.AddSink(out)
+
+	first, err := BuildMessage("first", "a\nb\n", false, WithEncoding(EncodingCBOR))
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	second := mustBuildMessage(t, "second", "c")
+	relayFrames(t, relay, append(append([]byte{}, first...), second...))
+
+	if got, want := out.tags(), []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("relayed tags = %q, want %q", got, want)
+	}
+	if !bytes.Equal(out.frames[0].Bytes, first) {
+		t.Error("binary frame was not relayed unchanged")
+	}
+}
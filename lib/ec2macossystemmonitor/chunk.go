@@ -0,0 +1,317 @@
+package ec2macossystemmonitor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultMaxFrameSize is a frame size to split messages at with WithMaxFrameSize, it leaves plenty of room below the
+// DefaultMaxFrameLength accepted by Reader.
+const DefaultMaxFrameSize = 16 * 1024
+
+// DefaultReassemblyTimeout is how long a Reassembler waits for the missing fragments of a message.
+const DefaultReassemblyTimeout = time.Minute
+
+// maxFragments bounds the number of fragments a Reassembler accepts for one message so a corrupt or hostile frame
+// can't reserve unbounded memory.
+const maxFragments = 4096
+
+// maxMessageSize bounds the data of a message a Reassembler combines from fragments, before decompressing it, and
+// maxPendingSize the data of all incomplete messages it holds.
+const (
+	maxMessageSize = 16 * 1024 * 1024
+	maxPendingSize = 64 * 1024 * 1024
+)
+
+// ErrFrameTooLarge is returned when a message doesn't fit in the frame size given with WithMaxFrameSize.
+var ErrFrameTooLarge = errors.New("ec2macossystemmonitor: frame too large")
+
+// BuildMessages builds the frames to send tag and data, like BuildMessage. When the message is larger than the size
+// given with WithMaxFrameSize it is split into numbered fragments sharing a random message id, which a Reassembler
+// combines again. The data is compressed before splitting so each fragment holds part of the compressed data.
+// Fragments require protocol version 2, so an error is returned if version 1 was requested for a message that must be
+// split.
+func BuildMessages(tag string, data string, compress bool, opts ...MessageOption) ([][]byte, error) {
+	var options messageOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	payload, version, err := buildPayload(tag, data, compress, &options)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := buildFrame(payload, version, &options)
+	if err != nil {
+		return nil, err
+	}
+	if options.maxFrameSize <= 0 || len(frame) <= options.maxFrameSize {
+		return [][]byte{frame}, nil
+	}
+	if options.version == ProtocolVersion1 {
+		return nil, fmt.Errorf("%w: %d bytes, limit is %d, splitting requires protocol version %d", ErrFrameTooLarge, len(frame), options.maxFrameSize, ProtocolVersion2)
+	}
+
+	payload.MessageID, err = newMessageID()
+	if err != nil {
+		return nil, err
+	}
+
+	fragments, err := splitData(payload, &options)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([][]byte, len(fragments))
+	for i, fragment := range fragments {
+		payload.Data = fragment
+		payload.Part = i + 1
+		payload.Parts = len(fragments)
+		if frames[i], err = buildFrame(payload, ProtocolVersion2, &options); err != nil {
+			return nil, err
+		}
+	}
+	return frames, nil
+}
+
+// splitData splits the data of payload into the fewest fragments that fit in frames of maxSize.
+//
+// Sizes are measured with the part numbers set to the largest value with the same number of digits as the fragment
+// count, so the final frames can only be smaller. If the count turns out to need more digits the data is split again.
+func splitData(payload SerialPayload, options *messageOptions) ([]string, error) {
+	data, maxSize := payload.Data, options.maxFrameSize
+	for digits := 1; ; digits++ {
+		placeholder, _ := strconv.Atoi(strings.Repeat("9", digits))
+		payload.Part, payload.Parts = placeholder, placeholder
+
+		var fragments []string
+		for rest := data; rest != ""; {
+			n := fragmentLength(payload, rest, options)
+			if n == 0 {
+				return nil, fmt.Errorf("%w: limit of %d bytes leaves no room for data", ErrFrameTooLarge, maxSize)
+			}
+			fragments = append(fragments, rest[:n])
+			rest = rest[n:]
+		}
+		if len(fragments) <= placeholder {
+			return fragments, nil
+		}
+	}
+}
+
+// fragmentLength returns the length of the longest prefix of data, ending on a character boundary, that fits in a
+// frame of the maximum size with payload.
+func fragmentLength(payload SerialPayload, data string, options *messageOptions) int {
+	maxSize := options.maxFrameSize
+	// Escaping only makes data longer so a fragment never holds more than maxSize bytes of it.
+	lo, hi := 0, min(len(data), maxSize)
+	for lo < hi {
+		mid := runeBoundary(data, (lo+hi+1)/2)
+		if mid <= lo {
+			// No character boundary between lo and the midpoint, try the next character.
+			_, size := utf8.DecodeRuneInString(data[lo:])
+			mid = lo + size
+			if mid > hi {
+				break
+			}
+		}
+		payload.Data = data[:mid]
+		if frameSize(payload, options) <= maxSize {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+// runeBoundary moves i back to the start of the character it falls in.
+func runeBoundary(s string, i int) int {
+	for i > 0 && i < len(s) && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
+
+// frameSize returns an upper bound on the length of the version 2 frame for payload, assuming the widest checksum of
+// JSON frames.
+func frameSize(payload SerialPayload, options *messageOptions) int {
+	// Binary frames have a fixed size checksum.
+	if options.encoding == EncodingCBOR {
+		frame, err := buildBinaryFrame(payload, ProtocolVersion2, options)
+		if err != nil {
+			return math.MaxInt
+		}
+		return len(frame)
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return math.MaxInt
+	}
+	message, err := options.seal(payloadBytes, ProtocolVersion2)
+	if err != nil {
+		return math.MaxInt
+	}
+	message.Checksum = math.MaxUint32
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		return math.MaxInt
+	}
+	return len(messageBytes) + len("\n")
+}
+
+// newMessageID returns a random identifier for the fragments of a message.
+func newMessageID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("ec2macossystemmonitor: couldn't generate message id: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// FragmentError is returned by Reassembler for a fragment with invalid part numbers.
+type FragmentError struct {
+	MessageID string
+	Part      int
+	Parts     int
+}
+
+func (e *FragmentError) Error() string {
+	return fmt.Sprintf("ec2macossystemmonitor: invalid fragment %d of %d for message %q", e.Part, e.Parts, e.MessageID)
+}
+
+// Reassembler combines the fragments of messages split by BuildMessages. Fragments may arrive in any order and
+// interleaved with other messages. Incomplete messages are dropped once the timeout has elapsed since their first
+// fragment arrived.
+type Reassembler struct {
+	timeout time.Duration
+	clock   Clock
+	pending map[fragmentKey]*fragmentSet
+	// size is the data held for all pending messages.
+	size    int
+	expired int64
+}
+
+// fragmentKey identifies the fragments of one message.
+type fragmentKey struct {
+	producer string
+	id       string
+}
+
+// fragmentSet holds the fragments received for a message.
+type fragmentSet struct {
+	first    *Message
+	parts    []string
+	have     []bool
+	received int
+	size     int
+	started  time.Time
+}
+
+// NewReassembler creates a Reassembler that drops incomplete messages after timeout.
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		timeout: timeout,
+		clock:   systemClock{},
+		pending: make(map[fragmentKey]*fragmentSet),
+	}
+}
+
+// Add adds a decoded message. Messages that aren't fragments are returned as is. For fragments nil is returned until
+// every fragment of the message has been added, then the complete message is returned with its data decompressed.
+// Errors are a *FragmentError or a *DataError, the fragments of the message are dropped in either case. A message
+// larger than 16 MiB, or a fragment that would take the incomplete messages over 64 MiB, is a *DataError wrapping
+// ErrDataTooLarge.
+func (r *Reassembler) Add(msg *Message) (*Message, error) {
+	r.Expire()
+	if !msg.Fragment() {
+		return msg, nil
+	}
+	key := fragmentKey{producer: msg.Producer, id: msg.MessageID}
+	set, ok := r.pending[key]
+	if msg.MessageID == "" || msg.Parts > maxFragments || msg.Part < 1 || msg.Part > msg.Parts || (ok && len(set.parts) != msg.Parts) {
+		r.drop(key)
+		return nil, &FragmentError{MessageID: msg.MessageID, Part: msg.Part, Parts: msg.Parts}
+	}
+	grow, size := len(msg.Data), len(msg.Data)
+	if ok {
+		grow -= len(set.parts[msg.Part-1])
+		size = set.size + grow
+	}
+	switch {
+	case size > maxMessageSize:
+		r.drop(key)
+		return nil, &DataError{Err: fmt.Errorf("%w: message %q exceeds %d bytes", ErrDataTooLarge, msg.MessageID, maxMessageSize)}
+	case r.size+grow > maxPendingSize:
+		r.drop(key)
+		return nil, &DataError{Err: fmt.Errorf("%w: incomplete messages exceed %d bytes", ErrDataTooLarge, maxPendingSize)}
+	}
+	if !ok {
+		set = &fragmentSet{parts: make([]string, msg.Parts), have: make([]bool, msg.Parts), started: r.clock.Now()}
+		r.pending[key] = set
+	}
+	if msg.Part == 1 {
+		set.first = msg
+	}
+	if !set.have[msg.Part-1] {
+		set.have[msg.Part-1] = true
+		set.received++
+	}
+	set.parts[msg.Part-1] = msg.Data
+	set.size += grow
+	r.size += grow
+	if set.received < len(set.parts) {
+		return nil, nil
+	}
+
+	r.drop(key)
+	complete := *set.first
+	complete.Data = strings.Join(set.parts, "")
+	complete.Part, complete.Parts = 0, 0
+	if complete.Compress {
+		data, err := decompressData(complete.SerialPayload)
+		if err != nil {
+			return nil, &DataError{Err: err}
+		}
+		complete.Data = data
+	}
+	return &complete, nil
+}
+
+// Expire drops messages whose fragments didn't all arrive within the timeout and returns how many were dropped.
+func (r *Reassembler) Expire() int {
+	now := r.clock.Now()
+	dropped := 0
+	for key, set := range r.pending {
+		if now.Sub(set.started) >= r.timeout {
+			r.drop(key)
+			dropped++
+		}
+	}
+	r.expired += int64(dropped)
+	return dropped
+}
+
+// drop forgets the fragments of the message with key.
+func (r *Reassembler) drop(key fragmentKey) {
+	if set, ok := r.pending[key]; ok {
+		r.size -= set.size
+		delete(r.pending, key)
+	}
+}
+
+// Pending returns the number of incomplete messages.
+func (r *Reassembler) Pending() int {
+	return len(r.pending)
+}
+
+// Expired returns the total number of incomplete messages dropped.
+func (r *Reassembler) Expired() int64 {
+	return r.expired
+}
@@ -0,0 +1,210 @@
+package ec2macossystemmonitor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reassemble decodes frames and adds them to a Reassembler in order, returning the completed messages.
+func reassemble(t *testing.T, r *Reassembler, frames [][]byte) []*Message {
+	t.Helper()
+	var complete []*Message
+	for _, frame := range frames {
+		msg, err := DecodeMessage(frame)
+		if err != nil {
+			t.Fatalf("DecodeMessage() error = %v", err)
+		}
+		msg, err = r.Add(msg)
+		if err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		if msg != nil {
+			complete = append(complete, msg)
+		}
+	}
+	return complete
+}
+
+// processList returns a process listing with n lines, a typical payload too large for one frame.
+func processList(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "%5d %5d %4.1f /usr/libexec/process%d --flag=%x\n", 100+i*7, i%13, float64(i%97)/10, i, i*2654435761)
+	}
+	return b.String()
+}
+
+// TestBuildMessagesBoundaries checks messages are only split once they exceed the limit, every fragment fits and the
+// fragments reassemble to the original data
+func TestBuildMessagesBoundaries(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		compress bool
+	}{
+		{"Plain", strings.Repeat("0123456789", 300), false},
+		{"Escaped", strings.Repeat("\"quoted\"\n\t<tag>&", 200), false},
+		{"Unicode", strings.Repeat("héllo wörld ✓ 日本語 ", 150), false},
+		{"Compressed", processList(2000), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			single, err := BuildMessage("test", tt.data, tt.compress)
+			if err != nil {
+				t.Fatalf("BuildMessage() error = %v", err)
+			}
+			frames, err := BuildMessages("test", tt.data, tt.compress, WithMaxFrameSize(len(single)))
+			if err != nil {
+				t.Fatalf("BuildMessages() at the frame size error = %v", err)
+			}
+			if len(frames) != 1 || string(frames[0]) != string(single) {
+				t.Errorf("BuildMessages() at the frame size = %d frames, want the single frame", len(frames))
+			}
+
+			for _, size := range []int{len(single) - 1, len(single) / 2, 400, 250} {
+				frames, err := BuildMessages("test", tt.data, tt.compress, WithMaxFrameSize(size))
+				if err != nil {
+					t.Fatalf("BuildMessages() with limit %d error = %v", size, err)
+				}
+				if len(frames) < 2 {
+					t.Fatalf("BuildMessages() with limit %d = %d frames, want fragments", size, len(frames))
+				}
+				for i, frame := range frames {
+					if len(frame) > size {
+						t.Errorf("limit %d: fragment %d is %d bytes", size, i+1, len(frame))
+					}
+				}
+				complete := reassemble(t, NewReassembler(time.Minute), frames)
+				if len(complete) != 1 || complete[0].Data != tt.data || complete[0].Tag != "test" {
+					t.Errorf("limit %d: reassembled %d messages, want the original data", size, len(complete))
+				}
+			}
+		})
+	}
+}
+
+// TestBuildMessagesErrors checks limits that can't be honored are rejected
+func TestBuildMessagesErrors(t *testing.T) {
+	data := strings.Repeat("x", 1000)
+	if _, err := BuildMessage("test", data, false, WithMaxFrameSize(100)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("BuildMessage() over the limit error = %v, want %v", err, ErrFrameTooLarge)
+	}
+	if _, err := BuildMessages("test", data, false, WithMaxFrameSize(100), WithVersion(ProtocolVersion1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("BuildMessages() with version 1 error = %v, want %v", err, ErrFrameTooLarge)
+	}
+	if _, err := BuildMessages("test", data, false, WithMaxFrameSize(100)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("BuildMessages() with no room for data error = %v, want %v", err, ErrFrameTooLarge)
+	}
+}
+
+// TestReassembler checks fragments are combined in any order, interleaved with other messages, and incomplete
+// messages expire
+func TestReassembler(t *testing.T) {
+	clock := newFakeClock()
+	r := NewReassembler(time.Minute)
+	r.clock = clock
+
+	build := func(data string) [][]byte {
+		frames, err := BuildMessages("test", data, false, WithMaxFrameSize(250), WithProducer("host"), WithSequence("test", 1))
+		if err != nil {
+			t.Fatalf("BuildMessages() error = %v", err)
+		}
+		return frames
+	}
+	first := build(strings.Repeat("a", 500))
+	second := build(strings.Repeat("b", 500))
+	if len(first) < 3 {
+		t.Fatalf("BuildMessages() = %d frames, want at least 3", len(first))
+	}
+
+	// Reverse the first message, interleave the second and repeat a fragment.
+	var frames [][]byte
+	for i := range first {
+		frames = append(frames, first[len(first)-1-i], second[min(i, len(second)-1)])
+	}
+	frames = append(frames, mustBuildMessage(t, "plain", "x"))
+	complete := reassemble(t, r, frames)
+	var got []string
+	for _, msg := range complete {
+		got = append(got, fmt.Sprintf("%s:%d", msg.Tag, len(msg.Data)))
+		if msg.Fragment() {
+			t.Errorf("reassembled message is still a fragment: %+v", msg.SerialPayload)
+		}
+	}
+	if want := []string{"test:500", "test:500", "plain:1"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("reassembled %q, want %q", got, want)
+	}
+
+	// Drop the last fragment, the rest expire after the timeout.
+	incomplete := build(strings.Repeat("c", 500))
+	reassemble(t, r, incomplete[:len(incomplete)-1])
+	if r.Pending() != 1 {
+		t.Errorf("Pending() = %d, want 1", r.Pending())
+	}
+	clock.Advance(59 * time.Second)
+	if r.Expire() != 0 {
+		t.Error("Expire() dropped a message before the timeout")
+	}
+	clock.Advance(time.Second)
+	if r.Expire() != 1 || r.Pending() != 0 || r.Expired() != 1 {
+		t.Errorf("after the timeout Pending() = %d, Expired() = %d, want 0 and 1", r.Pending(), r.Expired())
+	}
+
+	bad := &Message{Version: ProtocolVersion2, SerialPayload: SerialPayload{MessageID: "id", Part: 3, Parts: 2}}
+	var fragmentErr *FragmentError
+	if _, err := r.Add(bad); !errors.As(err, &fragmentErr) {
+		t.Errorf("Add() of an invalid fragment error = %v, want a *FragmentError", err)
+	}
+}
+
+// TestReassemblerLimits checks a message over the size limit and fragments over the pending limit are dropped
+func TestReassemblerLimits(t *testing.T) {
+	r := NewReassembler(time.Minute)
+	part := strings.Repeat("x", 1024*1024)
+	fragment := func(id string, n, parts int) *Message {
+		return &Message{Version: ProtocolVersion2, SerialPayload: SerialPayload{Tag: "test", Data: part, MessageID: id, Part: n, Parts: parts}}
+	}
+	add := func(msg *Message) error {
+		t.Helper()
+		complete, err := r.Add(msg)
+		if complete != nil {
+			t.Fatalf("Add() completed message %s early", msg.MessageID)
+		}
+		return err
+	}
+
+	// 16 fragments of 1 MiB fit, the 17th doesn't
+	for i := 1; i <= 16; i++ {
+		if err := add(fragment("large", i, 20)); err != nil {
+			t.Fatalf("Add() of fragment %d error = %v", i, err)
+		}
+	}
+	if err := add(fragment("large", 16, 20)); err != nil {
+		t.Errorf("Add() of a repeated fragment error = %v", err)
+	}
+	var dataErr *DataError
+	if err := add(fragment("large", 17, 20)); !errors.As(err, &dataErr) || !errors.Is(err, ErrDataTooLarge) {
+		t.Errorf("Add() over the message limit error = %v, want a *DataError for data that is too large", err)
+	}
+	if r.Pending() != 0 || r.size != 0 {
+		t.Errorf("Pending() = %d holding %d bytes, want the message dropped", r.Pending(), r.size)
+	}
+
+	// Four messages of 16 MiB fill the pending limit, a fragment of a fifth is dropped
+	for _, id := range []string{"a", "b", "c", "d"} {
+		for i := 1; i <= 16; i++ {
+			if err := add(fragment(id, i, 20)); err != nil {
+				t.Fatalf("Add() of fragment %d of %s error = %v", i, id, err)
+			}
+		}
+	}
+	if err := add(fragment("e", 1, 20)); !errors.Is(err, ErrDataTooLarge) {
+		t.Errorf("Add() over the pending limit error = %v, want %v", err, ErrDataTooLarge)
+	}
+	if r.Pending() != 4 {
+		t.Errorf("Pending() = %d, want 4", r.Pending())
+	}
+}
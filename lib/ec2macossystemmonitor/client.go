@@ -0,0 +1,205 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultDialTimeout bounds connecting to the relay socket.
+	DefaultDialTimeout = SocketTimeout
+	// DefaultWriteTimeout bounds writing a message to the relay socket, so a wedged relay can't hang its clients.
+	DefaultWriteTimeout = SocketTimeout
+)
+
+// Client sends messages to the relay over its UNIX socket. Each message is written on its own connection, so a Client
+// is safe for concurrent use and holds no connection between messages.
+type Client struct {
+	socketPath   string
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+	attempts     int
+	backoff      time.Duration
+	compress     bool
+	opts         []MessageOption
+	// stamper stamps the samples sent with SendSample, nil if they aren't stamped.
+	stamper *Stamper
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// defaultClient is used by PassToRelayd and SendMessage.
+var defaultClient = NewClient()
+
+// NewClient creates a Client for the relay at DefaultRelaydSocketPath with the default timeouts and no retries.
+func NewClient(opts ...ClientOption) *Client {
+	c := &Client{
+		socketPath:   DefaultRelaydSocketPath,
+		dialTimeout:  DefaultDialTimeout,
+		writeTimeout: DefaultWriteTimeout,
+		attempts:     1,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithSocketPath sets the relay socket to connect to, an empty path keeps DefaultRelaydSocketPath.
+func WithSocketPath(path string) ClientOption {
+	return func(c *Client) {
+		if path != "" {
+			c.socketPath = path
+		}
+	}
+}
+
+// WithDialTimeout bounds connecting to the relay, zero waits until the context is done.
+func WithDialTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.dialTimeout = d
+	}
+}
+
+// WithWriteTimeout bounds writing each message to the relay, zero waits until the context is done.
+func WithWriteTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.writeTimeout = d
+	}
+}
+
+// WithRetry makes up to attempts attempts to deliver each message, waiting backoff before the first retry and doubling
+// the wait for each retry after that. Only messages the relay hasn't received any of are retried, such as when the
+// socket doesn't exist yet or the connection is refused, since resending part of a message would duplicate it.
+func WithRetry(attempts int, backoff time.Duration) ClientOption {
+	return func(c *Client) {
+		c.attempts = max(attempts, 1)
+		c.backoff = backoff
+	}
+}
+
+// WithDefaultCompression sets whether Send compresses the data.
+func WithDefaultCompression(compress bool) ClientOption {
+	return func(c *Client) {
+		c.compress = compress
+	}
+}
+
+// WithStamper stamps the samples sent with SendSample with the time they were collected, the stamper's producer and a
+// sequence number for their tag. This sends version 2 messages.
+func WithStamper(stamper *Stamper) ClientOption {
+	return func(c *Client) {
+		c.stamper = stamper
+	}
+}
+
+// WithMessageOptions sets options used to build every message sent by the client, options given to SendMessage are
+// applied after them.
+func WithMessageOptions(opts ...MessageOption) ClientOption {
+	return func(c *Client) {
+		c.opts = append(c.opts, opts...)
+	}
+}
+
+// SocketPath returns the relay socket the client connects to.
+func (c *Client) SocketPath() string {
+	return c.socketPath
+}
+
+// Send sends data under tag with the client's default compression.
+func (c *Client) Send(ctx context.Context, tag string, data string) (n int, err error) {
+	return c.SendMessage(ctx, tag, data, c.compress)
+}
+
+// SendMessage builds the message for tag and data with BuildMessages and writes it to the relay. Messages are sent as a
+// single frame unless a frame size is given with WithMaxFrameSize, such as DefaultMaxFrameSize, in which case larger
+// messages are split into version 2 fragments that hosts must be able to reassemble.
+func (c *Client) SendMessage(ctx context.Context, tag string, data string, compress bool, opts ...MessageOption) (n int, err error) {
+	options := append(append(make([]MessageOption, 0, len(c.opts)+len(opts)), c.opts...), opts...)
+	frames, err := BuildMessages(tag, data, compress, options...)
+	if err != nil {
+		return 0, fmt.Errorf("ec2macossystemmonitor: error while building message bytes: %w", err)
+	}
+	return c.Write(ctx, bytes.Join(frames, nil))
+}
+
+// SendSample is a SendFunc that sends samples with the client, stamped using the tag as the source if the client has
+// a Stamper.
+func (c *Client) SendSample(ctx context.Context, tag string, sample Sample) (n int, err error) {
+	if c.stamper == nil {
+		return c.SendMessage(ctx, tag, sample.Data, sample.Compress)
+	}
+	return c.SendMessage(ctx, tag, sample.Data, sample.Compress, c.stamper.Stamp(tag, sample.Time)...)
+}
+
+// Write writes already built frames to the relay on a new connection, retrying as configured by WithRetry.
+func (c *Client) Write(ctx context.Context, messageBytes []byte) (n int, err error) {
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		n, retry, err := c.write(ctx, messageBytes)
+		if err == nil || !retry || attempt >= c.attempts {
+			return n, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, fmt.Errorf("%w: %w", err, ctx.Err())
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// write makes a single attempt to write messageBytes, reporting whether it may be retried.
+func (c *Client) write(ctx context.Context, messageBytes []byte) (n int, retry bool, err error) {
+	// Make sure we have socket to connect to.
+	if !fileExists(c.socketPath) {
+		return 0, true, fmt.Errorf("ec2macossystemmonitor: %s does not exist, cannot send %d byte message", c.socketPath, len(messageBytes))
+	}
+
+	// Connect and relay!
+	dialer := net.Dialer{Timeout: c.dialTimeout}
+	sock, err := dialer.DialContext(ctx, "unix", c.socketPath)
+	if err != nil {
+		return 0, ctx.Err() == nil, fmt.Errorf("ec2macossystemmonitor: could not connect to %s: %w", c.socketPath, err)
+	}
+	defer sock.Close()
+
+	var deadline time.Time
+	if c.writeTimeout > 0 {
+		deadline = time.Now().Add(c.writeTimeout)
+	}
+	ctxDeadline := false
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline, ctxDeadline = d, true
+	}
+	if err := sock.SetWriteDeadline(deadline); err != nil {
+		return 0, false, fmt.Errorf("ec2macossystemmonitor: unable to set write deadline: %w", err)
+	}
+	// Interrupt a blocked write when the context is canceled
+	stop := context.AfterFunc(ctx, func() {
+		_ = sock.SetWriteDeadline(time.Now())
+	})
+	defer stop()
+
+	n, err = sock.Write(messageBytes)
+	if err != nil {
+		switch {
+		case ctx.Err() != nil:
+			err = ctx.Err()
+		case ctxDeadline && errors.Is(err, os.ErrDeadlineExceeded):
+			// The socket deadline can expire just before the context reports it
+			err = context.DeadlineExceeded
+		}
+		return n, n == 0 && ctx.Err() == nil && !ctxDeadline, fmt.Errorf("ec2macossystemmonitor: error while writing to socket: %w", err)
+	}
+	return n, false, nil
+}
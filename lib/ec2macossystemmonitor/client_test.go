@@ -0,0 +1,248 @@
+package ec2macossystemmonitor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tempSocketPath returns a path for a socket in a new temporary directory, kept short since socket paths are limited
+// to around 100 bytes.
+func tempSocketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "ec2sm")
+	if err != nil {
+		t.Fatalf("MkdirTemp() error = %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "relay.sock")
+}
+
+// socketServer accepts connections on a UNIX socket and collects the bytes read from each.
+type socketServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	received []string
+	wg       sync.WaitGroup
+}
+
+// startSocketServer starts a socketServer on path, if read is false connections are accepted but never read.
+func startSocketServer(t *testing.T, path string, read bool) *socketServer {
+	t.Helper()
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	s := &socketServer{listener: listener}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if !read {
+				t.Cleanup(func() { conn.Close() })
+				continue
+			}
+			b, _ := io.ReadAll(conn)
+			conn.Close()
+			s.mu.Lock()
+			s.received = append(s.received, string(b))
+			s.mu.Unlock()
+		}
+	}()
+	t.Cleanup(s.close)
+	return s
+}
+
+// close stops accepting connections and waits for the server to stop.
+func (s *socketServer) close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+// messages returns the bytes read from each connection.
+func (s *socketServer) messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.received...)
+}
+
+// waitMessages waits for n connections to be read and returns the bytes read from each.
+func (s *socketServer) waitMessages(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.messages()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return s.messages()
+}
+
+// TestClientSend checks messages are built with the client's options and delivered on their own connections
+func TestClientSend(t *testing.T) {
+	path := tempSocketPath(t)
+	server := startSocketServer(t, path, true)
+	client := NewClient(WithSocketPath(path), WithDefaultCompression(true), WithMessageOptions(WithVersion(ProtocolVersion2)))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Send(context.Background(), "cpuutil", "2.0"); err != nil {
+				t.Errorf("Send() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := client.SendMessage(context.Background(), "ps", "plain", false, WithVersion(ProtocolVersion1)); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	messages := server.waitMessages(t, 11)
+	if len(messages) != 11 {
+		t.Fatalf("server received %d connections, want 11", len(messages))
+	}
+	for _, m := range messages {
+		msg, err := DecodeMessage([]byte(m))
+		if err != nil {
+			t.Fatalf("DecodeMessage() error = %v", err)
+		}
+		switch msg.Tag {
+		case "cpuutil":
+			if msg.Version != ProtocolVersion2 || !msg.Compress || msg.Data != "2.0" {
+				t.Errorf("Send() delivered %+v, want a compressed version 2 message", msg)
+			}
+		case "ps":
+			if msg.Version != ProtocolVersion1 || msg.Compress {
+				t.Errorf("SendMessage() delivered %+v, want an uncompressed version 1 message", msg)
+			}
+		}
+	}
+}
+
+// TestClientTimeouts checks a relay that stops reading can't block a client past its write deadline or context
+func TestClientTimeouts(t *testing.T) {
+	path := tempSocketPath(t)
+	startSocketServer(t, path, false)
+	// Larger than the socket buffers so the write blocks
+	frame := []byte(strings.Repeat("x", 16<<20))
+
+	tests := []struct {
+		name    string
+		client  *Client
+		timeout time.Duration
+		want    error
+	}{
+		{"write timeout", NewClient(WithSocketPath(path), WithWriteTimeout(50*time.Millisecond)), 0, os.ErrDeadlineExceeded},
+		{"context deadline", NewClient(WithSocketPath(path), WithWriteTimeout(0)), 50 * time.Millisecond, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			start := time.Now()
+			_, err := tt.client.Write(ctx, frame)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Write() error = %v, want %v", err, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Write() returned after %s", elapsed)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := NewClient(WithSocketPath(path), WithWriteTimeout(0)).Write(ctx, frame); !errors.Is(err, context.Canceled) {
+		t.Errorf("Write() after cancel error = %v, want %v", err, context.Canceled)
+	}
+}
+
+// TestClientRetry checks messages are retried until the relay socket appears, and not without WithRetry
+func TestClientRetry(t *testing.T) {
+	path := tempSocketPath(t)
+	frame := mustBuildMessage(t, "cpuutil", "2.0")
+	if _, err := NewClient(WithSocketPath(path)).Write(context.Background(), frame); err == nil {
+		t.Fatal("Write() without a relay succeeded")
+	}
+
+	servers := make(chan *socketServer, 1)
+	time.AfterFunc(100*time.Millisecond, func() {
+		servers <- startSocketServer(t, path, true)
+	})
+	client := NewClient(WithSocketPath(path), WithRetry(10, 20*time.Millisecond))
+	n, err := client.Write(context.Background(), frame)
+	if err != nil {
+		t.Fatalf("Write() with retries error = %v", err)
+	}
+	if n != len(frame) {
+		t.Errorf("Write() = %d, want %d", n, len(frame))
+	}
+	if got := (<-servers).waitMessages(t, 1); len(got) != 1 || got[0] != string(frame) {
+		t.Errorf("server received %q, want the frame", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewClient(WithSocketPath(tempSocketPath(t)), WithRetry(10, time.Hour)).Write(ctx, frame); !errors.Is(err, context.Canceled) {
+		t.Errorf("Write() with a canceled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+// TestClientFragmenting checks large messages are only split into fragments when a frame size is given
+func TestClientFragmenting(t *testing.T) {
+	path := tempSocketPath(t)
+	server := startSocketServer(t, path, true)
+	data := strings.Repeat("x", 2*DefaultMaxFrameSize)
+
+	if _, err := NewClient(WithSocketPath(path)).Send(context.Background(), "emf", data); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	fragmenting := NewClient(WithSocketPath(path), WithMessageOptions(WithMaxFrameSize(DefaultMaxFrameSize)))
+	if _, err := fragmenting.Send(context.Background(), "emf", data); err != nil {
+		t.Fatalf("Send() with a frame size error = %v", err)
+	}
+	messages := server.waitMessages(t, 2)
+	if len(messages) != 2 {
+		t.Fatalf("server received %d connections, want 2", len(messages))
+	}
+	for _, m := range messages {
+		frames := strings.SplitAfter(m, "\n")
+		frames = frames[:len(frames)-1]
+		msg, err := DecodeMessage([]byte(frames[0]))
+		if err != nil {
+			t.Fatalf("DecodeMessage() error = %v", err)
+		}
+		if len(frames) == 1 {
+			if msg.Version != ProtocolVersion1 || msg.Data != data {
+				t.Errorf("Send() delivered a version %d message, want the data in one version 1 frame", msg.Version)
+			}
+			continue
+		}
+		if msg.Parts != len(frames) {
+			t.Errorf("Send() with a frame size delivered %d frames of a %d part message", len(frames), msg.Parts)
+		}
+	}
+}
+
+// TestClientMissingSocket checks the error for a missing relay socket doesn't include the message
+func TestClientMissingSocket(t *testing.T) {
+	path := tempSocketPath(t)
+	_, err := NewClient(WithSocketPath(path)).Send(context.Background(), "cpuutil", "secret-data")
+	if err == nil || !strings.Contains(err.Error(), path) || strings.Contains(err.Error(), "secret-data") {
+		t.Errorf("Send() error = %v, want the socket path without the message", err)
+	}
+}
@@ -0,0 +1,210 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec names the compression applied to the data of a message. Compressed data is always base64 encoded so it only
+// contains characters safe for the serial device.
+type Codec string
+
+const (
+	// CodecNone sends the data as is.
+	CodecNone Codec = "none"
+	// CodecZlib is the original codec, implied by the compress flag when no codec is named.
+	CodecZlib Codec = "zlib"
+	CodecGzip Codec = "gzip"
+	CodecZstd Codec = "zstd"
+	// CodecSnappy is the snappy block format, it has no compression levels.
+	CodecSnappy Codec = "snappy"
+)
+
+// Codecs lists the supported codecs.
+var Codecs = []Codec{CodecNone, CodecZlib, CodecGzip, CodecZstd, CodecSnappy}
+
+// ErrUnknownCodec is returned for a codec name that isn't one of Codecs.
+var ErrUnknownCodec = errors.New("ec2macossystemmonitor: unknown codec")
+
+// ErrDataTooLarge is returned for compressed data that decompresses to more than the limit.
+var ErrDataTooLarge = errors.New("ec2macossystemmonitor: decompressed data too large")
+
+// DefaultCompressionLevel selects the default level of each codec. For zlib it is the best compression, matching
+// messages built before the codec was selectable. It is outside the range of every codec so level 0, which stores
+// zlib and gzip data uncompressed, can be requested.
+const DefaultCompressionLevel = -1
+
+// DefaultAutoCompressionThreshold is a reasonable threshold for WithAutoCompression, below it the codec headers and
+// base64 encoding outweigh any savings.
+const DefaultAutoCompressionThreshold = 256
+
+// maxDecodedSize limits the size of decompressed data, and the memory used to decode zstd data, so a small frame
+// can't expand to exhaust memory.
+const maxDecodedSize = 64 * 1024 * 1024
+
+// ParseCodec parses a codec name.
+func ParseCodec(name string) (Codec, error) {
+	for _, codec := range Codecs {
+		if string(codec) == name {
+			return codec, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+}
+
+// WithCodec sets the codec used to compress the data, overriding the compress argument: CodecNone sends the data
+// uncompressed and any other codec compresses it. Codecs other than zlib and none require version 2.
+func WithCodec(codec Codec) MessageOption {
+	return func(o *messageOptions) {
+		o.codec = codec
+	}
+}
+
+// WithCompressionLevel sets the compression level. The range depends on the codec: 0 to 9 for zlib and gzip, where 0
+// only stores the data, 1 to 22 for zstd, and snappy ignores it. DefaultCompressionLevel selects the codec's default,
+// as does not setting a level.
+func WithCompressionLevel(level int) MessageOption {
+	return func(o *messageOptions) {
+		o.level = level
+		o.levelSet = true
+	}
+}
+
+// WithAutoCompression lets BuildMessage decide whether to compress, overriding the compress argument: data of at
+// least threshold bytes is compressed with the codec selected by WithCodec, zlib by default, and sent compressed only
+// if that makes it smaller.
+func WithAutoCompression(threshold int) MessageOption {
+	return func(o *messageOptions) {
+		o.auto = true
+		o.autoThreshold = threshold
+	}
+}
+
+// encodeData compresses the data of payload as requested by compress and the options, returning the codec used.
+func (o *messageOptions) encodeData(payload *SerialPayload, compress bool) (Codec, error) {
+	codec := CodecNone
+	if compress {
+		codec = CodecZlib
+	}
+	if o.codec != "" {
+		codec = o.codec
+	}
+	if o.auto {
+		if len(payload.Data) < o.autoThreshold {
+			return CodecNone, nil
+		}
+		if o.codec == "" {
+			codec = CodecZlib
+		}
+	}
+	if codec == CodecNone {
+		return CodecNone, nil
+	}
+
+	level := DefaultCompressionLevel
+	if o.levelSet {
+		level = o.level
+	}
+	encoded, err := compressData(codec, level, payload.Data)
+	if err != nil {
+		return "", err
+	}
+	if o.auto && len(encoded) >= len(payload.Data) {
+		return CodecNone, nil
+	}
+	payload.Data = encoded
+	return codec, nil
+}
+
+// compressData compresses data with codec at level and base64 encodes it.
+func compressData(codec Codec, level int, data string) (string, error) {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch codec {
+	case CodecZlib:
+		if level == DefaultCompressionLevel {
+			level = zlib.BestCompression
+		}
+		w, err = zlib.NewWriterLevel(&b, level)
+	case CodecGzip:
+		if level == DefaultCompressionLevel {
+			level = gzip.DefaultCompression
+		}
+		w, err = gzip.NewWriterLevel(&b, level)
+	case CodecZstd:
+		zstdLevel := zstd.SpeedDefault
+		if level != DefaultCompressionLevel {
+			zstdLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		w, err = zstd.NewWriter(&b, zstd.WithEncoderLevel(zstdLevel), zstd.WithEncoderConcurrency(1))
+	case CodecSnappy:
+		return base64.StdEncoding.EncodeToString(s2.EncodeSnappy(nil, []byte(data))), nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownCodec, codec)
+	}
+	if err != nil {
+		return "", fmt.Errorf("ec2macossystemmonitor: couldn't get compression writer: %w", err)
+	}
+	_, err = w.Write([]byte(data))
+	if err != nil {
+		return "", fmt.Errorf("ec2macossystemmonitor: couldn't copy compressed data: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return "", fmt.Errorf("ec2macossystemmonitor: couldn't close compressor: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+// decompressData reverses compressData for the data of payload, a payload without a codec uses zlib.
+func decompressData(payload SerialPayload) (string, error) {
+	compressed, err := base64.StdEncoding.DecodeString(payload.Data)
+	if err != nil {
+		return "", err
+	}
+	var r io.ReadCloser
+	switch payload.Codec {
+	case "", CodecZlib:
+		r, err = zlib.NewReader(bytes.NewReader(compressed))
+	case CodecGzip:
+		r, err = gzip.NewReader(bytes.NewReader(compressed))
+	case CodecZstd:
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(bytes.NewReader(compressed), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecodedSize))
+		if err == nil {
+			r = d.IOReadCloser()
+		}
+	case CodecSnappy:
+		if n, err := s2.DecodedLen(compressed); err == nil && n > maxDecodedSize {
+			return "", fmt.Errorf("%w: %d bytes, limit is %d", ErrDataTooLarge, n, maxDecodedSize)
+		}
+		inflated, err := s2.Decode(nil, compressed)
+		if err != nil {
+			return "", err
+		}
+		return string(inflated), nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownCodec, payload.Codec)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	inflated, err := io.ReadAll(io.LimitReader(r, maxDecodedSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(inflated) > maxDecodedSize {
+		return "", fmt.Errorf("%w: limit is %d bytes", ErrDataTooLarge, maxDecodedSize)
+	}
+	return string(inflated), nil
+}
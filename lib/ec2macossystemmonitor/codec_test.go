@@ -0,0 +1,218 @@
+package ec2macossystemmonitor
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// TestCodecRoundTrip checks data compressed with each codec and level decodes to the original
+func TestCodecRoundTrip(t *testing.T) {
+	data := processList(200)
+	for _, codec := range Codecs {
+		for _, level := range []int{DefaultCompressionLevel, 1, 9} {
+			t.Run(fmt.Sprintf("%s/%d", codec, level), func(t *testing.T) {
+				frame, err := BuildMessage("test", data, false, WithCodec(codec), WithCompressionLevel(level))
+				if err != nil {
+					t.Fatalf("BuildMessage() error = %v", err)
+				}
+				msg, err := DecodeMessage(frame)
+				if err != nil {
+					t.Fatalf("DecodeMessage() error = %v", err)
+				}
+				if msg.Data != data {
+					t.Error("DecodeMessage() didn't return the original data")
+				}
+				wantVersion := ProtocolVersion2
+				if codec == CodecNone || codec == CodecZlib {
+					wantVersion = ProtocolVersion1
+				}
+				if msg.Version != wantVersion || msg.Compress != (codec != CodecNone) {
+					t.Errorf("DecodeMessage() version %d compress %v, want version %d", msg.Version, msg.Compress, wantVersion)
+				}
+				if codec != CodecNone && len(frame) >= len(data) {
+					t.Errorf("%s frame is %d bytes, not smaller than the %d bytes of data", codec, len(frame), len(data))
+				}
+			})
+		}
+	}
+}
+
+// TestStoreLevel checks level 0 stores zlib and gzip data rather than selecting the default level
+func TestStoreLevel(t *testing.T) {
+	data := processList(200)
+	for _, codec := range []Codec{CodecZlib, CodecGzip} {
+		t.Run(string(codec), func(t *testing.T) {
+			stored, err := BuildMessage("test", data, false, WithCodec(codec), WithCompressionLevel(0))
+			if err != nil {
+				t.Fatalf("BuildMessage() error = %v", err)
+			}
+			compressed, err := BuildMessage("test", data, false, WithCodec(codec))
+			if err != nil {
+				t.Fatalf("BuildMessage() error = %v", err)
+			}
+			if len(stored) <= len(data) || len(compressed) >= len(data) {
+				t.Errorf("stored frame is %d bytes and default frame %d bytes, data is %d bytes", len(stored), len(compressed), len(data))
+			}
+			msg, err := DecodeMessage(stored)
+			if err != nil {
+				t.Fatalf("DecodeMessage() error = %v", err)
+			}
+			if msg.Data != data {
+				t.Error("DecodeMessage() didn't return the original data")
+			}
+		})
+	}
+}
+
+// TestAutoCompression checks data is only sent compressed above the threshold and when it saves bytes
+func TestAutoCompression(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 1))
+	random := make([]byte, 600)
+	for i := range random {
+		random[i] = byte(rng.IntN(256))
+	}
+	tests := []struct {
+		name         string
+		data         string
+		opts         []MessageOption
+		wantCompress bool
+	}{
+		{"Below Threshold", strings.Repeat("x", 255), nil, false},
+		{"At Threshold", strings.Repeat("x", 256), nil, true},
+		{"Incompressible", base64.StdEncoding.EncodeToString(random), nil, false},
+		{"Selected Codec", processList(50), []MessageOption{WithCodec(CodecZstd)}, true},
+		{"Codec None", processList(50), []MessageOption{WithCodec(CodecNone)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append(tt.opts, WithAutoCompression(DefaultAutoCompressionThreshold))
+			frame, err := BuildMessage("test", tt.data, false, opts...)
+			if err != nil {
+				t.Fatalf("BuildMessage() error = %v", err)
+			}
+			msg, err := DecodeMessage(frame)
+			if err != nil {
+				t.Fatalf("DecodeMessage() error = %v", err)
+			}
+			if msg.Compress != tt.wantCompress || msg.Data != tt.data {
+				t.Errorf("DecodeMessage() compress = %v, want %v", msg.Compress, tt.wantCompress)
+			}
+		})
+	}
+}
+
+// TestCodecErrors checks unknown codecs are rejected when building and decoding
+func TestCodecErrors(t *testing.T) {
+	if _, err := ParseCodec("lz4"); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("ParseCodec() error = %v, want %v", err, ErrUnknownCodec)
+	}
+	if _, err := BuildMessage("test", "x", true, WithCodec("lz4")); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("BuildMessage() error = %v, want %v", err, ErrUnknownCodec)
+	}
+	if _, err := BuildMessage("test", "x", true, WithCodec(CodecGzip), WithVersion(ProtocolVersion1)); err == nil {
+		t.Error("BuildMessage() with gzip and version 1 succeeded")
+	}
+	frame := `{"v":2,"csum":3833008367,"payload":"{\"tag\":\"t\",\"compress\":true,\"data\":\"eA==\",\"codec\":\"lz4\"}"}`
+	var dataErr *DataError
+	if _, err := DecodeMessage([]byte(frame)); !errors.As(err, &dataErr) || !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("DecodeMessage() error = %v, want a *DataError for the unknown codec", err)
+	}
+}
+
+// TestDecompressLimit checks data decompressing to more than the limit is rejected by every codec
+func TestDecompressLimit(t *testing.T) {
+	data := strings.Repeat("0", maxDecodedSize+1)
+	for _, codec := range Codecs {
+		if codec == CodecNone {
+			continue
+		}
+		t.Run(string(codec), func(t *testing.T) {
+			frame, err := BuildMessage("test", data, true, WithCodec(codec), WithVersion(ProtocolVersion2))
+			if err != nil {
+				t.Fatalf("BuildMessage() error = %v", err)
+			}
+			var dataErr *DataError
+			if _, err := DecodeMessage(frame); !errors.As(err, &dataErr) || !errors.Is(err, ErrDataTooLarge) {
+				t.Errorf("DecodeMessage() error = %v, want a *DataError for data that is too large", err)
+			}
+		})
+	}
+}
+
+// benchmarkPayloads are realistic payloads for comparing codecs.
+func benchmarkPayloads() map[string]string {
+	var metrics strings.Builder
+	metrics.WriteString("[")
+	for i := 0; i < 100; i++ {
+		if i > 0 {
+			metrics.WriteString(",")
+		}
+		fmt.Fprintf(&metrics, `{"name":"cpu%d","value":%.2f,"unit":"Percent","timestamp":%d}`, i%8, float64(i*37%1000)/10, 1792324800000+int64(i)*60000)
+	}
+	metrics.WriteString("]")
+	var logs strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&logs, "2026-10-18 12:%02d:%02d.%03d kernel[0]: (AppleEthernet) link %d state changed to %s\n", i/60%60, i%60, i*7%1000, i%4, []string{"up", "down"}[i%2])
+	}
+	return map[string]string{
+		"cpuutil": "12.5",
+		"metrics": metrics.String(),
+		"logs":    logs.String(),
+		"ps":      processList(500),
+	}
+}
+
+// BenchmarkCodecs compares the CPU cost of each codec and level with the size saved, reported as the ratio of the
+// encoded size to the original size.
+func BenchmarkCodecs(b *testing.B) {
+	for name, data := range benchmarkPayloads() {
+		for _, codec := range Codecs {
+			for _, level := range []int{DefaultCompressionLevel, 1} {
+				if level != DefaultCompressionLevel && (codec == CodecNone || codec == CodecSnappy) {
+					continue
+				}
+				b.Run(fmt.Sprintf("%s/%s/%d", name, codec, level), func(b *testing.B) {
+					opts := []MessageOption{WithCodec(codec), WithCompressionLevel(level)}
+					frame, err := BuildMessage("test", data, false, opts...)
+					if err != nil {
+						b.Fatalf("BuildMessage() error = %v", err)
+					}
+					b.SetBytes(int64(len(data)))
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						if _, err := BuildMessage("test", data, false, opts...); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.ReportMetric(float64(len(frame))/float64(len(data)), "ratio")
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkDecodeCodecs measures the CPU cost of decoding each codec.
+func BenchmarkDecodeCodecs(b *testing.B) {
+	data := benchmarkPayloads()["ps"]
+	for _, codec := range Codecs {
+		b.Run(string(codec), func(b *testing.B) {
+			frame, err := BuildMessage("test", data, false, WithCodec(codec))
+			if err != nil {
+				b.Fatalf("BuildMessage() error = %v", err)
+			}
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeMessage(frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package ec2macossystemmonitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Sample is a single piece of data gathered by a Collector to be sent under the collector's tag.
+type Sample struct {
+	// Data is the payload, its format is specific to the tag.
+	Data string
+	// Compress requests the data be compressed in the message envelope.
+	Compress bool
+	// Time is when the sample was collected.
+	Time time.Time
+}
+
+// Collector gathers data on an interval for sending to the relay. New metrics are added by implementing Collector and
+// registering it with a Scheduler.
+type Collector interface {
+	// Name uniquely identifies the collector in logs.
+	Name() string
+	// Tag is the payload tag samples are sent under.
+	Tag() string
+	// Interval is the duration between collections.
+	Interval() time.Duration
+	// Collect gathers samples, it should return promptly once ctx is done.
+	Collect(ctx context.Context) ([]Sample, error)
+}
+
+// Snapshotter is implemented by collectors whose samples cover the time since their previous collection, such as CPU
+// utilization. CollectNow takes a Snapshot rather than calling Collect so the next collection on the collector's
+// interval still covers the whole interval.
+type Snapshotter interface {
+	// Snapshot gathers samples like Collect without changing what the next Collect measures from.
+	Snapshot(ctx context.Context) ([]Sample, error)
+}
+
+// SendFunc delivers a sample for tag, returning the number of bytes written. Client.SendSample sends samples to the
+// relay.
+type SendFunc func(ctx context.Context, tag string, sample Sample) (n int, err error)
+
+// Scheduler runs registered collectors, each on its own interval, and sends their samples.
+type Scheduler struct {
+	// Jitter is the maximum random delay before a collector's first collection, this keeps collectors sharing an
+	// interval from running in lockstep. Later collections follow the interval from there so the period isn't stretched.
+	Jitter time.Duration
+	// Timeout bounds each collection and send, the collector's interval is used if zero.
+	Timeout time.Duration
+	// OnError is called when a collection or send fails, the collector keeps running.
+	OnError func(c Collector, err error)
+	// OnSent is called with the bytes written after each sample is sent.
+	OnSent func(c Collector, n int)
+
+	send       SendFunc
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewScheduler creates a Scheduler that delivers samples with send.
+func NewScheduler(send SendFunc) *Scheduler {
+	return &Scheduler{send: send}
+}
+
+// Register adds a collector, it must be called before Run. Names must be unique.
+func (s *Scheduler) Register(c Collector) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.Interval() <= 0 {
+		return fmt.Errorf("ec2macossystemmonitor: collector %s has invalid interval %s", c.Name(), c.Interval())
+	}
+	for _, existing := range s.collectors {
+		if existing.Name() == c.Name() {
+			return fmt.Errorf("ec2macossystemmonitor: collector %s is already registered", c.Name())
+		}
+	}
+	s.collectors = append(s.collectors, c)
+	return nil
+}
+
+// Collectors returns the registered collectors.
+func (s *Scheduler) Collectors() []Collector {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Collector{}, s.collectors...)
+}
+
+// Run starts every registered collector in its own goroutine and blocks until ctx is done and they have stopped.
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, c := range s.Collectors() {
+		wg.Add(1)
+		go func(c Collector) {
+			defer wg.Done()
+			s.runCollector(ctx, c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// runCollector waits an interval, plus jitter, then collects and sends every interval until ctx is done.
+func (s *Scheduler) runCollector(ctx context.Context, c Collector) {
+	next := time.Now().Add(c.Interval())
+	if s.Jitter > 0 {
+		next = next.Add(rand.N(s.Jitter))
+	}
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			s.collect(ctx, c, false, func(err error) { s.reportError(c, err) })
+			next = nextCollection(next, c.Interval(), time.Now())
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// nextCollection returns the collection after last on a timeline of interval, skipping any collections before now
+// missed while a collection overran.
+func nextCollection(last time.Time, interval time.Duration, now time.Time) time.Time {
+	next := last.Add(interval)
+	if !next.After(now) {
+		next = next.Add((now.Sub(next)/interval + 1) * interval)
+	}
+	return next
+}
+
+// collect runs a single collection, or a snapshot of a Snapshotter if snapshot is set, and sends the samples, bounded
+// by the timeout, passing a failed collection and each sample that couldn't be sent to report.
+func (s *Scheduler) collect(ctx context.Context, c Collector, snapshot bool, report func(err error)) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = c.Interval()
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	collect := c.Collect
+	if snapshotter, ok := c.(Snapshotter); ok && snapshot {
+		collect = snapshotter.Snapshot
+	}
+	samples, err := collect(ctx)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		report(fmt.Errorf("ec2macossystemmonitor: collector %s failed: %w", c.Name(), err))
+		return
+	}
+
+	for _, sample := range samples {
+		if sample.Time.IsZero() {
+			sample.Time = time.Now()
+		}
+		n, err := s.send(ctx, c.Tag(), sample)
+		if err != nil {
+			report(fmt.Errorf("ec2macossystemmonitor: unable to send %s sample: %w", c.Name(), err))
+			continue
+		}
+		if s.OnSent != nil {
+			s.OnSent(c, n)
+		}
+	}
+}
+
+// CollectNow runs the named collector, or every collector if name is empty, once straight away and sends the samples.
+// It doesn't change when the collectors next run on their interval, or what a Snapshotter measures from. Failures are
+// returned rather than passed to OnError.
+func (s *Scheduler) CollectNow(ctx context.Context, name string) error {
+	found := false
+	var errs []error
+	for _, c := range s.Collectors() {
+		if name == "" || c.Name() == name {
+			found = true
+			s.collect(ctx, c, true, func(err error) { errs = append(errs, err) })
+		}
+	}
+	if !found {
+		return fmt.Errorf("ec2macossystemmonitor: no collector %s", name)
+	}
+	return errors.Join(errs...)
+}
+
+// reportError passes err to OnError if set.
+func (s *Scheduler) reportError(c Collector, err error) {
+	if s.OnError != nil {
+		s.OnError(c, err)
+	}
+}
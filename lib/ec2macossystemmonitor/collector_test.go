@@ -0,0 +1,206 @@
+package ec2macossystemmonitor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCollector is a Collector returning fixed data, or blocking until its context is done when block is set.
+type testCollector struct {
+	name     string
+	interval time.Duration
+	data     string
+	block    bool
+}
+
+func (c *testCollector) Name() string            { return c.name }
+func (c *testCollector) Tag() string             { return c.name + "-tag" }
+func (c *testCollector) Interval() time.Duration { return c.interval }
+
+func (c *testCollector) Collect(ctx context.Context) ([]Sample, error) {
+	if c.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return []Sample{{Data: c.data}}, nil
+}
+
+// sentSamples records samples passed to the send function of a Scheduler.
+type sentSamples struct {
+	mu   sync.Mutex
+	tags map[string][]Sample
+}
+
+func (s *sentSamples) send(_ context.Context, tag string, sample Sample) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags[tag] = append(s.tags[tag], sample)
+	return len(sample.Data), nil
+}
+
+func (s *sentSamples) count(tag string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tags[tag])
+}
+
+// TestSchedulerRegister checks invalid and duplicate collectors are rejected
+func TestSchedulerRegister(t *testing.T) {
+	s := NewScheduler(NewClient().SendSample)
+	if err := s.Register(&testCollector{name: "a", interval: time.Second}); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if err := s.Register(&testCollector{name: "a", interval: time.Second}); err == nil {
+		t.Error("Register() of a duplicate name succeeded")
+	}
+	if err := s.Register(&testCollector{name: "b"}); err == nil {
+		t.Error("Register() with zero interval succeeded")
+	}
+	if got := len(s.Collectors()); got != 1 {
+		t.Errorf("Collectors() has %d entries, want 1", got)
+	}
+}
+
+// TestSchedulerRun runs collectors on different intervals and checks each is sent under its own tag
+func TestSchedulerRun(t *testing.T) {
+	sent := &sentSamples{tags: make(map[string][]Sample)}
+	s := NewScheduler(sent.send)
+	s.Jitter = time.Millisecond
+	var mu sync.Mutex
+	written := 0
+	s.OnSent = func(_ Collector, n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		written += n
+	}
+	_ = s.Register(&testCollector{name: "fast", interval: 5 * time.Millisecond, data: "f"})
+	_ = s.Register(&testCollector{name: "slow", interval: time.Hour, data: "s"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for sent.count("fast-tag") < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if got := sent.count("fast-tag"); got < 3 {
+		t.Errorf("fast collector sent %d samples, want at least 3", got)
+	}
+	if got := sent.count("slow-tag"); got != 0 {
+		t.Errorf("slow collector sent %d samples, want 0", got)
+	}
+	for _, sample := range sent.tags["fast-tag"] {
+		if sample.Time.IsZero() {
+			t.Error("sample was sent without a collection time")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if written != sent.count("fast-tag") {
+		t.Errorf("OnSent reported %d bytes, want %d", written, sent.count("fast-tag"))
+	}
+}
+
+// TestNextCollection checks collections follow a fixed timeline, skipping those missed while a collection overran
+func TestNextCollection(t *testing.T) {
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		now  time.Duration
+		want time.Duration
+	}{
+		{"on time", 0, time.Minute},
+		{"late collection", 50 * time.Second, time.Minute},
+		{"overran one", 70 * time.Second, 2 * time.Minute},
+		{"overran several", 185 * time.Second, 4 * time.Minute},
+		{"exactly on the next", time.Minute, 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := nextCollection(start, time.Minute, start.Add(tt.now)); !got.Equal(start.Add(tt.want)) {
+			t.Errorf("%s: nextCollection() = %s, want %s", tt.name, got.Sub(start), tt.want)
+		}
+	}
+}
+
+// TestSchedulerTimeout ensures a collector that does not return is cancelled and reported without stopping the others
+func TestSchedulerTimeout(t *testing.T) {
+	sent := &sentSamples{tags: make(map[string][]Sample)}
+	s := NewScheduler(sent.send)
+	s.Timeout = 10 * time.Millisecond
+	errs := make(chan error, 10)
+	s.OnError = func(c Collector, err error) {
+		if c.Name() == "stuck" {
+			select {
+			case errs <- err:
+			default:
+			}
+		}
+	}
+	_ = s.Register(&testCollector{name: "stuck", interval: time.Millisecond, block: true})
+	_ = s.Register(&testCollector{name: "ok", interval: time.Millisecond, data: "x"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("OnError() got %v, want a deadline exceeded error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stuck collector to be reported")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sent.count("ok-tag") == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if sent.count("ok-tag") == 0 {
+		t.Error("stuck collector prevented other collectors from sending")
+	}
+}
+
+// TestSchedulerCollectNow checks collectors can be run on demand, one by name or all of them
+func TestSchedulerCollectNow(t *testing.T) {
+	sent := &sentSamples{tags: make(map[string][]Sample)}
+	s := NewScheduler(sent.send)
+	_ = s.Register(&testCollector{name: "a", interval: time.Hour, data: "a"})
+	_ = s.Register(&testCollector{name: "b", interval: time.Hour, data: "b"})
+
+	if err := s.CollectNow(context.Background(), "a"); err != nil {
+		t.Fatalf("CollectNow(a) error = %v", err)
+	}
+	if err := s.CollectNow(context.Background(), ""); err != nil {
+		t.Fatalf("CollectNow() error = %v", err)
+	}
+	if err := s.CollectNow(context.Background(), "missing"); err == nil {
+		t.Error("CollectNow(missing) succeeded")
+	}
+	if a, b := sent.count("a-tag"), sent.count("b-tag"); a != 2 || b != 1 {
+		t.Errorf("sent %d samples for a and %d for b, want 2 and 1", a, b)
+	}
+
+	// Failures are returned to the caller rather than reported
+	s.OnError = func(c Collector, err error) { t.Errorf("OnError(%s, %v)", c.Name(), err) }
+	s.Timeout = 10 * time.Millisecond
+	_ = s.Register(&testCollector{name: "stuck", interval: time.Hour, block: true})
+	if err := s.CollectNow(context.Background(), "stuck"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CollectNow(stuck) error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	failing := NewScheduler(func(context.Context, string, Sample) (int, error) { return 0, errors.New("relay is down") })
+	failing.OnError = s.OnError
+	_ = failing.Register(&testCollector{name: "a", interval: time.Hour, data: "a"})
+	if err := failing.CollectNow(context.Background(), "a"); err == nil || !strings.Contains(err.Error(), "relay is down") {
+		t.Errorf("CollectNow() with a failing send error = %v, want the send error", err)
+	}
+}
@@ -0,0 +1,219 @@
+package ec2macossystemmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// CommandTag is the tag of commands the host sends on the serial device, the data is a JSON Command.
+	CommandTag = "command"
+	// AckTag is the tag of the replies to commands, the data is a JSON Ack.
+	AckTag = "ack"
+)
+
+// DefaultCommandMaxAge is how far the timestamp of a command may be from the current time.
+const DefaultCommandMaxAge = 5 * time.Minute
+
+// DefaultCommandTimeout bounds each command handler.
+const DefaultCommandTimeout = 10 * time.Second
+
+// ErrCommandDenied is returned for a command that isn't allowed, is too old or is replayed.
+var ErrCommandDenied = errors.New("ec2macossystemmonitor: command denied")
+
+// Command is a request from the host to the monitor.
+type Command struct {
+	// ID identifies the command in its Ack, and must be unique so commands can't be replayed.
+	ID   string            `json:"id"`
+	Name string            `json:"name"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// Ack is the reply to a Command.
+type Ack struct {
+	ID string `json:"id"`
+	OK bool   `json:"ok"`
+	// Result is the output of a successful command.
+	Result string `json:"result,omitempty"`
+	// Error is why the command failed or was rejected.
+	Error string `json:"error,omitempty"`
+}
+
+// CommandHandler runs a command, returning the result for its Ack.
+type CommandHandler func(ctx context.Context, cmd Command) (result string, err error)
+
+// BuildCommand builds a command frame signed with keys, as the host sends it.
+func BuildCommand(cmd Command, keys *Keyring, opts ...MessageOption) ([]byte, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: %w", err)
+	}
+	opts = append([]MessageOption{WithVersion(ProtocolVersion2), WithTimestamp(time.Now())}, opts...)
+	return BuildMessage(CommandTag, string(data), false, append(opts, SignWith(keys))...)
+}
+
+// ParseAck returns the Ack carried by msg.
+func ParseAck(msg *Message) (Ack, error) {
+	if msg.Tag != AckTag {
+		return Ack{}, fmt.Errorf("ec2macossystemmonitor: %q isn't an ack", msg.Tag)
+	}
+	var ack Ack
+	if err := json.Unmarshal([]byte(msg.Data), &ack); err != nil {
+		return Ack{}, fmt.Errorf("ec2macossystemmonitor: invalid ack: %w", err)
+	}
+	return ack, nil
+}
+
+// CommandServer reads commands the host sends on the serial device, runs them with the registered handlers and
+// replies with an Ack for each.
+//
+// Commands must be signed with one of the server's keys, and frames without a valid MAC are dropped without a reply.
+// Signed commands must also have a timestamp within the maximum age of the current time and an ID not used within
+// that age, so a captured command can't be replayed, and their name must be allowed. Acks are signed with the current
+// key. It is safe for concurrent use.
+type CommandServer struct {
+	// OnError is called for frames that can't be decoded or verified and for acks that can't be sent.
+	OnError func(err error)
+
+	keys    *Keyring
+	allowed map[string]bool
+	maxAge  time.Duration
+	timeout time.Duration
+	clock   Clock
+
+	mu       sync.Mutex
+	handlers map[string]CommandHandler
+	// seen holds the IDs of commands within the maximum age by their timestamp.
+	seen map[string]time.Time
+}
+
+// NewCommandServer creates a CommandServer verifying and signing with keys that only runs the allowed commands.
+func NewCommandServer(keys *Keyring, allowed ...string) (*CommandServer, error) {
+	if keys == nil {
+		return nil, errors.New("ec2macossystemmonitor: commands require keys to authenticate them")
+	}
+	s := &CommandServer{
+		keys:     keys,
+		allowed:  make(map[string]bool, len(allowed)),
+		maxAge:   DefaultCommandMaxAge,
+		timeout:  DefaultCommandTimeout,
+		clock:    systemClock{},
+		handlers: make(map[string]CommandHandler),
+		seen:     make(map[string]time.Time),
+	}
+	for _, name := range allowed {
+		s.allowed[name] = true
+	}
+	return s, nil
+}
+
+// Handle registers handler for the command name, replacing any earlier handler. The command must also be allowed.
+func (s *CommandServer) Handle(name string, handler CommandHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[name] = handler
+}
+
+// Serve reads commands from r until it fails or ctx is done, writing acks to w. A command is only read once the
+// previous one has been acknowledged. It returns nil at the end of r.
+func (s *CommandServer) Serve(ctx context.Context, r io.Reader, w Sink) error {
+	reader := NewReader(r, VerifyWith(s.keys))
+	for ctx.Err() == nil {
+		msg, err := reader.Next()
+		var frameErr *FrameError
+		switch {
+		case errors.As(err, &frameErr):
+			s.reportError(err)
+			continue
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return fmt.Errorf("ec2macossystemmonitor: reading commands: %w", err)
+		case msg.Tag != CommandTag:
+			continue
+		}
+
+		ack := s.dispatch(ctx, msg)
+		data, err := json.Marshal(ack)
+		if err != nil {
+			s.reportError(fmt.Errorf("ec2macossystemmonitor: %w", err))
+			continue
+		}
+		frame, err := BuildMessage(AckTag, string(data), false, WithVersion(ProtocolVersion2), WithTimestamp(s.clock.Now()), SignWith(s.keys))
+		if err == nil {
+			_, err = w.WriteFrame(Frame{Tag: AckTag, Bytes: frame})
+		}
+		if err != nil {
+			s.reportError(fmt.Errorf("ec2macossystemmonitor: unable to send ack for command %s: %w", ack.ID, err))
+		}
+	}
+	return ctx.Err()
+}
+
+// dispatch checks and runs the command in msg, returning its Ack.
+func (s *CommandServer) dispatch(ctx context.Context, msg *Message) Ack {
+	var cmd Command
+	if err := json.Unmarshal([]byte(msg.Data), &cmd); err != nil {
+		return Ack{Error: fmt.Sprintf("invalid command: %s", err)}
+	}
+	handler, err := s.admit(cmd, msg.Timestamp())
+	if err != nil {
+		return Ack{ID: cmd.ID, Error: err.Error()}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	result, err := handler(ctx, cmd)
+	if err != nil {
+		return Ack{ID: cmd.ID, Error: err.Error()}
+	}
+	return Ack{ID: cmd.ID, OK: true, Result: result}
+}
+
+// admit checks cmd sent at sent may run, returning its handler or an error wrapping ErrCommandDenied.
+func (s *CommandServer) admit(cmd Command, sent time.Time) (CommandHandler, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	for id, t := range s.seen {
+		if now.Sub(t) > s.maxAge {
+			delete(s.seen, id)
+		}
+	}
+
+	switch age := now.Sub(sent); {
+	case cmd.ID == "":
+		return nil, fmt.Errorf("%w: command has no id", ErrCommandDenied)
+	case sent.IsZero():
+		return nil, fmt.Errorf("%w: command has no timestamp", ErrCommandDenied)
+	case age > s.maxAge:
+		return nil, fmt.Errorf("%w: command is %s old, limit is %s", ErrCommandDenied, age.Round(time.Second), s.maxAge)
+	case age < -s.maxAge:
+		return nil, fmt.Errorf("%w: command is %s in the future, limit is %s", ErrCommandDenied, -age.Round(time.Second), s.maxAge)
+	}
+	if _, ok := s.seen[cmd.ID]; ok {
+		return nil, fmt.Errorf("%w: command %s was already received", ErrCommandDenied, cmd.ID)
+	}
+	s.seen[cmd.ID] = sent
+
+	if !s.allowed[cmd.Name] {
+		return nil, fmt.Errorf("%w: command %q isn't allowed", ErrCommandDenied, cmd.Name)
+	}
+	handler, ok := s.handlers[cmd.Name]
+	if !ok {
+		return nil, fmt.Errorf("ec2macossystemmonitor: unknown command %q", cmd.Name)
+	}
+	return handler, nil
+}
+
+// reportError passes err to OnError if set.
+func (s *CommandServer) reportError(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
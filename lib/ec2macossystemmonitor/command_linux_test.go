@@ -0,0 +1,113 @@
+package ec2macossystemmonitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+	"golang.org/x/sys/unix"
+)
+
+// openPTY opens a pseudo terminal, returning the master and the name of the slave device.
+func openPTY(t *testing.T) (*os.File, string) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("pseudo terminals aren't available: %v", err)
+	}
+	t.Cleanup(func() { _ = master.Close() })
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatalf("unlocking pty: %v", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Fatalf("getting pty number: %v", err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+// TestCommandServerPTY runs commands over a pty pair, the host writing to the master and the monitor serving the
+// slave as its serial device
+func TestCommandServerPTY(t *testing.T) {
+	keys := mustKeyring(t, testKey("host"))
+	master, name := openPTY(t)
+	port, err := serial.Open(name, &serial.Mode{BaudRate: DefaultBaudRate})
+	if err != nil {
+		t.Fatalf("serial.Open(%s) error = %v", name, err)
+	}
+	conn := newSerialConnection(port, DefaultBaudRate, systemClock{})
+
+	server := testCommandServer(t, keys)
+	errs := make(chan error, 10)
+	server.OnError = func(err error) { errs <- err }
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(context.Background(), conn, conn) }()
+
+	unsigned, err := BuildMessage(CommandTag, `{"id":"unsigned","name":"ping"}`, false, WithVersion(ProtocolVersion2), WithTimestamp(time.Now()))
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	acks := NewReader(master, VerifyWith(keys))
+	tests := []struct {
+		cmd    Command
+		result string
+		error  string
+	}{
+		{Command{ID: "1", Name: "ping"}, "pong", ""},
+		{Command{ID: "2", Name: "reboot"}, "", "isn't allowed"},
+		{Command{ID: "3", Name: "interval", Args: map[string]string{"interval": "1m"}}, "1m", ""},
+	}
+	for _, tt := range tests {
+		// An unsigned command goes unanswered, the ack read next must be for the signed one
+		if _, err := master.Write(unsigned); err != nil {
+			t.Fatalf("writing to pty: %v", err)
+		}
+		frame, err := BuildCommand(tt.cmd, keys)
+		if err != nil {
+			t.Fatalf("BuildCommand() error = %v", err)
+		}
+		if _, err := master.Write(frame); err != nil {
+			t.Fatalf("writing to pty: %v", err)
+		}
+
+		if err := master.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatalf("SetReadDeadline() error = %v", err)
+		}
+		msg, err := acks.Next()
+		if err != nil {
+			t.Fatalf("reading ack for %s: %v", tt.cmd.Name, err)
+		}
+		ack, err := ParseAck(msg)
+		if err != nil {
+			t.Fatalf("ParseAck() error = %v", err)
+		}
+		if ack.ID != tt.cmd.ID || ack.Result != tt.result || !strings.Contains(ack.Error, tt.error) || (tt.error == "") != ack.OK {
+			t.Errorf("ack = %+v, want id %s result %q error containing %q", ack, tt.cmd.ID, tt.result, tt.error)
+		}
+		select {
+		case err := <-errs:
+			if !strings.Contains(err.Error(), "isn't signed") {
+				t.Errorf("OnError(%v), want the unsigned command", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("the unsigned command wasn't reported")
+		}
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() didn't return after the device was closed")
+	}
+	if stats := conn.Stats(); stats.Writes != int64(len(tests)) {
+		t.Errorf("serial writes = %d, want %d", stats.Writes, len(tests))
+	}
+}
@@ -0,0 +1,251 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// testCommandServer returns a CommandServer allowing ping, fail, status and interval with handlers for all but status,
+// and one more handler for reboot which isn't allowed.
+func testCommandServer(t *testing.T, keys *Keyring) *CommandServer {
+	t.Helper()
+	server, err := NewCommandServer(keys, "ping", "fail", "status", "interval")
+	if err != nil {
+		t.Fatalf("NewCommandServer() error = %v", err)
+	}
+	server.Handle("ping", func(context.Context, Command) (string, error) { return "pong", nil })
+	server.Handle("fail", func(context.Context, Command) (string, error) { return "", errors.New("failed") })
+	server.Handle("interval", func(_ context.Context, cmd Command) (string, error) { return cmd.Args["interval"], nil })
+	server.Handle("reboot", func(context.Context, Command) (string, error) { return "rebooting", nil })
+	return server
+}
+
+// readAcks decodes the acks written to sink, verifying they are signed with keys.
+func readAcks(t *testing.T, sink *memorySink, keys *Keyring) []Ack {
+	t.Helper()
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	var acks []Ack
+	for _, frame := range sink.frames {
+		msg, err := DecodeMessage(frame.Bytes, VerifyWith(keys))
+		if err != nil {
+			t.Fatalf("DecodeMessage() of ack error = %v", err)
+		}
+		ack, err := ParseAck(msg)
+		if err != nil {
+			t.Fatalf("ParseAck() error = %v", err)
+		}
+		acks = append(acks, ack)
+	}
+	return acks
+}
+
+// TestCommandServer checks commands are authenticated, checked for age, replays and the allowlist, and acknowledged
+func TestCommandServer(t *testing.T) {
+	keys := mustKeyring(t, testKey("host"))
+	other := mustKeyring(t, testKey("other"))
+	build := func(cmd Command, keys *Keyring, opts ...MessageOption) []byte {
+		t.Helper()
+		frame, err := BuildCommand(cmd, keys, opts...)
+		if err != nil {
+			t.Fatalf("BuildCommand() error = %v", err)
+		}
+		return frame
+	}
+	unsigned, err := BuildMessage(CommandTag, `{"id":"unsigned","name":"ping"}`, false, WithVersion(ProtocolVersion2), WithTimestamp(time.Now()))
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	ping := build(Command{ID: "1", Name: "ping"}, keys)
+	metric, err := BuildMessage("cpuutil", "2.0", false, WithVersion(ProtocolVersion2), SignWith(keys))
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+
+	var stream bytes.Buffer
+	for _, frame := range [][]byte{
+		ping,
+		unsigned,
+		[]byte("line noise\n"),
+		build(Command{ID: "other-key", Name: "ping"}, other),
+		metric,
+		ping,
+		build(Command{ID: "2", Name: "ping"}, keys, WithTimestamp(time.Now().Add(-10*time.Minute))),
+		build(Command{ID: "3", Name: "ping"}, keys, WithTimestamp(time.Now().Add(10*time.Minute))),
+		build(Command{ID: "4", Name: "reboot"}, keys),
+		build(Command{ID: "5", Name: "status"}, keys),
+		build(Command{ID: "6", Name: "fail"}, keys),
+		build(Command{Name: "ping"}, keys),
+		build(Command{ID: "7", Name: "interval", Args: map[string]string{"interval": "30s"}}, keys),
+	} {
+		stream.Write(frame)
+	}
+
+	server := testCommandServer(t, keys)
+	var rejected []string
+	server.OnError = func(err error) { rejected = append(rejected, err.Error()) }
+	sink := &memorySink{name: "serial"}
+	if err := server.Serve(context.Background(), &stream, sink); err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+
+	acks := readAcks(t, sink, keys)
+	want := []struct {
+		id     string
+		ok     bool
+		result string
+		error  string
+	}{
+		{"1", true, "pong", ""},
+		{"1", false, "", "already received"},
+		{"2", false, "", "is 10m0s old"},
+		{"3", false, "", "is 10m0s in the future"},
+		{"4", false, "", `"reboot" isn't allowed`},
+		{"5", false, "", `unknown command "status"`},
+		{"6", false, "", "failed"},
+		{"", false, "", "no id"},
+		{"7", true, "30s", ""},
+	}
+	if len(acks) != len(want) {
+		t.Fatalf("got %d acks %+v, want %d", len(acks), acks, len(want))
+	}
+	for i, w := range want {
+		ack := acks[i]
+		if ack.ID != w.id || ack.OK != w.ok || ack.Result != w.result || !strings.Contains(ack.Error, w.error) || (w.error == "") != (ack.Error == "") {
+			t.Errorf("ack %d = %+v, want id %q ok %v result %q error containing %q", i, ack, w.id, w.ok, w.result, w.error)
+		}
+	}
+	if len(rejected) != 2 || !strings.Contains(rejected[0], "isn't signed") || !strings.Contains(rejected[1], "unknown key") {
+		t.Errorf("rejected frames = %q, want the unsigned and other key commands", rejected)
+	}
+
+	if _, err := NewCommandServer(nil, "ping"); err == nil {
+		t.Error("NewCommandServer() without keys succeeded")
+	}
+}
+
+// TestCommandReplayWindow checks command IDs are forgotten once commands with them would be too old anyway
+func TestCommandReplayWindow(t *testing.T) {
+	server := testCommandServer(t, mustKeyring(t, testKey("host")))
+	clock := newFakeClock()
+	server.clock = clock
+	cmd := Command{ID: "1", Name: "ping"}
+
+	steps := []struct {
+		sent    time.Duration
+		advance time.Duration
+		denied  bool
+	}{
+		{0, 0, false},
+		{0, time.Minute, true},
+		{-DefaultCommandMaxAge - time.Second, 0, true},
+		{0, DefaultCommandMaxAge + time.Second, false},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		_, err := server.admit(cmd, clock.Now().Add(step.sent))
+		if step.denied != errors.Is(err, ErrCommandDenied) || (!step.denied && err != nil) {
+			t.Errorf("step %d: admit() error = %v, want denied %v", i, err, step.denied)
+		}
+	}
+	if got, want := len(server.seen), 1; got != want {
+		t.Errorf("remembered %d ids, want %d", got, want)
+	}
+}
+
+// bytewisePort is a serial.Port that writes a byte at a time, yielding in between, so concurrent writes would
+// interleave, and counts writes that overlap.
+type bytewisePort struct {
+	serial.Port
+	active   atomic.Int32
+	overlaps atomic.Int32
+
+	mu      sync.Mutex
+	written []byte
+}
+
+func (p *bytewisePort) Write(b []byte) (int, error) {
+	if p.active.Add(1) > 1 {
+		p.overlaps.Add(1)
+	}
+	defer p.active.Add(-1)
+	for _, c := range b {
+		p.mu.Lock()
+		p.written = append(p.written, c)
+		p.mu.Unlock()
+		runtime.Gosched()
+	}
+	return len(b), nil
+}
+
+// TestCommandAcksWithRelayedFrames checks acks and relayed frames written to the serial device at the same time
+// aren't interleaved
+func TestCommandAcksWithRelayedFrames(t *testing.T) {
+	keys := mustKeyring(t, testKey("host"))
+	const n = 50
+	var commands bytes.Buffer
+	for i := 0; i < n; i++ {
+		frame, err := BuildCommand(Command{ID: fmt.Sprint(i), Name: "ping"}, keys)
+		if err != nil {
+			t.Fatalf("BuildCommand() error = %v", err)
+		}
+		commands.Write(frame)
+	}
+	metric, err := BuildMessage("cpuutil", "2.0", false, WithVersion(ProtocolVersion2), SignWith(keys))
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+
+	for _, watchdog := range []SerialWatchdog{{}, DefaultSerialWatchdog} {
+		port := &bytewisePort{}
+		conn := newSerialConnection(port, DefaultBaudRate, systemClock{})
+		conn.SetWatchdog(watchdog)
+		server := testCommandServer(t, keys)
+		server.OnError = func(err error) { t.Errorf("OnError(%v)", err) }
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if _, err := conn.WriteFrame(Frame{Tag: "cpuutil", Bytes: metric}); err != nil {
+					t.Errorf("WriteFrame() error = %v", err)
+				}
+			}
+		}()
+		if err := server.Serve(context.Background(), bytes.NewReader(commands.Bytes()), conn); err != nil {
+			t.Fatalf("Serve() error = %v", err)
+		}
+		wg.Wait()
+
+		if overlaps := port.overlaps.Load(); overlaps != 0 {
+			t.Errorf("watchdog %+v: %d writes overlapped", watchdog, overlaps)
+		}
+		tags := make(map[string]int)
+		reader := NewReader(bytes.NewReader(port.written), VerifyWith(keys))
+		for {
+			msg, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("watchdog %+v: reading frames: %v", watchdog, err)
+			}
+			tags[msg.Tag]++
+		}
+		if tags[AckTag] != n || tags["cpuutil"] != n {
+			t.Errorf("watchdog %+v: read %v frames, want %d of each", watchdog, tags, n)
+		}
+	}
+}
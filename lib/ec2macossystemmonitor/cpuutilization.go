@@ -1,8 +1,14 @@
 package ec2macossystemmonitor
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/shirou/gopsutil/cpu"
 )
@@ -16,3 +22,108 @@ func RunningCpuUsage() (s string, err error) {
 	}
 	return strconv.FormatFloat(percent[0], 'f', -1, 64), nil
 }
+
+// CPUCollector is the Collector for CPU utilization, sent under the "cpuutil" tag. It keeps its own baseline rather
+// than sharing RunningCpuUsage's, so each collection covers the whole time since the previous one and snapshots don't
+// shorten it.
+type CPUCollector struct {
+	interval atomic.Int64
+	// times returns the CPU times summed over all CPUs, it is replaced in tests.
+	times func() (cpu.TimesStat, error)
+
+	mu sync.Mutex
+	// last holds the CPU times at the previous collection.
+	last cpu.TimesStat
+}
+
+// NewCPUCollector creates a CPUCollector that collects every interval.
+func NewCPUCollector(interval time.Duration) *CPUCollector {
+	return newCPUCollector(interval, totalCPUTimes)
+}
+
+// newCPUCollector creates a CPUCollector reading the CPU times with times.
+func newCPUCollector(interval time.Duration, times func() (cpu.TimesStat, error)) *CPUCollector {
+	c := &CPUCollector{times: times}
+	c.SetInterval(interval)
+	// Without a baseline the first collection covers the time since boot
+	c.last, _ = times()
+	return c
+}
+
+// totalCPUTimes returns the CPU times summed over all CPUs.
+func totalCPUTimes() (cpu.TimesStat, error) {
+	times, err := cpu.Times(false)
+	if err != nil {
+		return cpu.TimesStat{}, err
+	}
+	if len(times) == 0 {
+		return cpu.TimesStat{}, errors.New("no cpu times")
+	}
+	return times[0], nil
+}
+
+// SetInterval changes the duration between collections, it applies after the next collection.
+func (c *CPUCollector) SetInterval(interval time.Duration) {
+	c.interval.Store(int64(interval))
+}
+
+// Name returns the name of the collector.
+func (c *CPUCollector) Name() string {
+	return "cpuutilization"
+}
+
+// Tag returns the payload tag for CPU utilization.
+func (c *CPUCollector) Tag() string {
+	return "cpuutil"
+}
+
+// Interval returns the duration between collections.
+func (c *CPUCollector) Interval() time.Duration {
+	return time.Duration(c.interval.Load())
+}
+
+// Collect returns the CPU utilization since the previous collection as a percentage.
+func (c *CPUCollector) Collect(_ context.Context) ([]Sample, error) {
+	return c.sample(true)
+}
+
+// Snapshot returns the CPU utilization since the previous collection as a percentage, without starting a new
+// interval, so the next collection still covers the whole interval.
+func (c *CPUCollector) Snapshot(_ context.Context) ([]Sample, error) {
+	return c.sample(false)
+}
+
+// sample returns the CPU utilization since the previous collection, making now the baseline if advance is set.
+func (c *CPUCollector) sample(advance bool) ([]Sample, error) {
+	now, err := c.times()
+	if err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: error while getting cpu stats: %s", err)
+	}
+	c.mu.Lock()
+	percent := cpuPercent(c.last, now)
+	if advance {
+		c.last = now
+	}
+	c.mu.Unlock()
+	return []Sample{{Data: strconv.FormatFloat(percent, 'f', -1, 64), Time: time.Now()}}, nil
+}
+
+// cpuPercent returns the percentage of the time between two readings of the CPU times that was busy.
+func cpuPercent(t1, t2 cpu.TimesStat) float64 {
+	all1, busy1 := cpuBusy(t1)
+	all2, busy2 := cpuBusy(t2)
+	switch {
+	case busy2 <= busy1:
+		return 0
+	case all2 <= all1:
+		return 100
+	}
+	return math.Min(100, math.Max(0, (busy2-busy1)/(all2-all1)*100))
+}
+
+// cpuBusy returns the total and busy time of a reading of the CPU times. Guest time is left out rather than use
+// TimesStat.Total, which includes it in some gopsutil releases, since it is already counted in user time.
+func cpuBusy(t cpu.TimesStat) (all, busy float64) {
+	busy = t.User + t.System + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+	return busy + t.Idle, busy
+}
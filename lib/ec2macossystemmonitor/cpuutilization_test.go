@@ -0,0 +1,71 @@
+package ec2macossystemmonitor
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shirou/gopsutil/cpu"
+)
+
+// fakeCPUTimes returns CPU times that only change when advanced.
+type fakeCPUTimes struct {
+	mu    sync.Mutex
+	times cpu.TimesStat
+}
+
+func (f *fakeCPUTimes) get() (cpu.TimesStat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.times, nil
+}
+
+// advance adds busy and idle seconds to the times.
+func (f *fakeCPUTimes) advance(busy, idle float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.times.User += busy
+	f.times.Idle += idle
+}
+
+// TestCPUCollectorSnapshot checks a snapshot taken with CollectNow doesn't shorten the interval the next periodic
+// collection covers
+func TestCPUCollectorSnapshot(t *testing.T) {
+	times := &fakeCPUTimes{}
+	collector := newCPUCollector(time.Minute, times.get)
+	sent := &sentSamples{tags: make(map[string][]Sample)}
+	s := NewScheduler(sent.send)
+	if err := s.Register(collector); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	// Busy for the first half of the interval, idle for the second
+	times.advance(30, 0)
+	if err := s.CollectNow(context.Background(), collector.Name()); err != nil {
+		t.Fatalf("CollectNow() error = %v", err)
+	}
+	times.advance(0, 30)
+	s.collect(context.Background(), collector, false, func(err error) { t.Errorf("collect() error = %v", err) })
+	times.advance(15, 45)
+	s.collect(context.Background(), collector, false, func(err error) { t.Errorf("collect() error = %v", err) })
+
+	var got []string
+	for _, sample := range sent.tags[collector.Tag()] {
+		got = append(got, sample.Data)
+	}
+	want := []string{"100", "50", "25"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+// TestCPUPercentGuest checks guest time, which is already counted in user time, doesn't change the utilization
+func TestCPUPercentGuest(t *testing.T) {
+	t1 := cpu.TimesStat{User: 10, Idle: 10}
+	t2 := cpu.TimesStat{User: 40, Idle: 40, Guest: 20, GuestNice: 5}
+	if got := cpuPercent(t1, t2); got != 50 {
+		t.Errorf("cpuPercent() = %v, want 50", got)
+	}
+}
@@ -0,0 +1,357 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrUnsupportedVersion is returned when decoding a message with a version newer than MaxProtocolVersion.
+	ErrUnsupportedVersion = errors.New("ec2macossystemmonitor: unsupported protocol version")
+	// ErrChecksumMismatch is returned when a message payload doesn't match its checksum.
+	ErrChecksumMismatch = errors.New("ec2macossystemmonitor: checksum mismatch")
+)
+
+// EnvelopeError is returned when a frame isn't a valid SerialMessage.
+type EnvelopeError struct {
+	Err error
+}
+
+func (e *EnvelopeError) Error() string {
+	return fmt.Sprintf("ec2macossystemmonitor: invalid envelope: %s", e.Err)
+}
+
+func (e *EnvelopeError) Unwrap() error {
+	return e.Err
+}
+
+// VersionError is returned when a frame has a protocol version this package can't read.
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("%s: %d", ErrUnsupportedVersion, e.Version)
+}
+
+// Is allows matching with errors.Is(err, ErrUnsupportedVersion).
+func (e *VersionError) Is(target error) bool {
+	return target == ErrUnsupportedVersion
+}
+
+// ChecksumError is returned when the payload of a frame doesn't match its checksum, typically because bytes were
+// corrupted or lost in transit.
+type ChecksumError struct {
+	// Got is the checksum computed for the received payload.
+	Got uint32
+	// Want is the checksum in the envelope.
+	Want uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s: got %d, want %d", ErrChecksumMismatch, e.Got, e.Want)
+}
+
+// Is allows matching with errors.Is(err, ErrChecksumMismatch).
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// PayloadError is returned when the checksum matches but the payload isn't a valid SerialPayload.
+type PayloadError struct {
+	Err error
+}
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("ec2macossystemmonitor: invalid payload: %s", e.Err)
+}
+
+func (e *PayloadError) Unwrap() error {
+	return e.Err
+}
+
+// DataError is returned when compressed data can't be decoded or inflated, or uses an unknown codec.
+type DataError struct {
+	Err error
+}
+
+func (e *DataError) Error() string {
+	return fmt.Sprintf("ec2macossystemmonitor: invalid compressed data: %s", e.Err)
+}
+
+func (e *DataError) Unwrap() error {
+	return e.Err
+}
+
+// FrameError is returned by Reader for a frame that couldn't be decoded. Err is one of the error types above, the
+// Reader can continue with the next frame.
+type FrameError struct {
+	// Offset is the position of the frame in the stream.
+	Offset int64
+	// Frame is a copy of the frame's bytes.
+	Frame []byte
+	Err   error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("frame at offset %d: %s", e.Offset, e.Err)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// Message is a decoded frame.
+type Message struct {
+	// Version is the protocol version of the frame.
+	Version int
+	// SerialPayload is the payload with Data decompressed if it was sent compressed.
+	SerialPayload
+}
+
+// DecodeMessage decodes a single frame built by BuildMessage, verifying the checksum and decompressing the data.
+// A trailing newline is ignored. The data of fragments isn't decompressed, use a Reassembler to combine them. Errors are
+// an *EnvelopeError, *VersionError, *ChecksumError, *PayloadError or *DataError, and an *AuthError when verifying with
+// VerifyWith.
+func DecodeMessage(frame []byte, opts ...DecodeOption) (*Message, error) {
+	var options decodeOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	var msg *Message
+	var err error
+	if bytes.HasPrefix(frame, binaryMagic) {
+		msg, err = decodeBinaryFrame(frame, &options)
+	} else {
+		msg, err = decodeJSONFrame(frame, &options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Fragments are decompressed once reassembled.
+	if msg.Compress && !msg.Fragment() {
+		data, err := decompressData(msg.SerialPayload)
+		if err != nil {
+			return nil, &DataError{Err: err}
+		}
+		msg.Data = data
+	}
+	return msg, nil
+}
+
+// decodeJSONFrame decodes a JSON frame without decompressing the data.
+func decodeJSONFrame(frame []byte, options *decodeOptions) (*Message, error) {
+	var envelope SerialMessage
+	if err := json.Unmarshal(bytes.TrimSuffix(frame, []byte("\n")), &envelope); err != nil {
+		return nil, &EnvelopeError{Err: err}
+	}
+	version := envelope.Version
+	if version == 0 {
+		version = ProtocolVersion1
+	}
+	if version > MaxProtocolVersion || version < ProtocolVersion1 {
+		return nil, &VersionError{Version: version}
+	}
+	sum, err := checksum(envelope.Algorithm, []byte(envelope.Payload))
+	if err != nil {
+		return nil, &EnvelopeError{Err: err}
+	}
+	if sum != envelope.Checksum {
+		return nil, &ChecksumError{Got: sum, Want: envelope.Checksum}
+	}
+	if options.keys != nil {
+		if err := options.keys.verifyEnvelope(&envelope); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := &Message{Version: version}
+	if err := json.Unmarshal([]byte(envelope.Payload), &msg.SerialPayload); err != nil {
+		return nil, &PayloadError{Err: err}
+	}
+	return msg, nil
+}
+
+// DefaultMaxFrameLength is the default limit on the length of a frame read by Reader.
+const DefaultMaxFrameLength = 64 * 1024
+
+// readChunkSize is the number of bytes Reader reads from the stream at a time.
+const readChunkSize = 4096
+
+// frameStarts are the bytes every frame begins with, for version 1 and later JSON versions and binary frames
+// respectively. They can't occur inside a valid frame because quotes and control characters in the payload of a JSON
+// frame are escaped and the body of a binary frame is base64.
+var frameStarts = [][]byte{[]byte(`{"csum":`), []byte(`{"v":`), binaryMagic}
+
+// FrameTooLongError is returned when a frame exceeds the Reader's maximum length.
+type FrameTooLongError struct {
+	Max int
+}
+
+func (e *FrameTooLongError) Error() string {
+	return fmt.Sprintf("ec2macossystemmonitor: frame exceeds maximum length of %d bytes", e.Max)
+}
+
+// ReaderStats are counters kept by a Reader.
+type ReaderStats struct {
+	// Frames is the number of frames decoded.
+	Frames int64
+	// DiscardedBytes is the number of bytes skipped, either noise between frames or frames that couldn't be decoded.
+	DiscardedBytes int64
+	// ChecksumFailures is the number of frames with a checksum mismatch.
+	ChecksumFailures int64
+	// DecodeFailures is the number of frames that couldn't be decoded for reasons other than the checksum.
+	DecodeFailures int64
+	// TooLong is the number of frames discarded for exceeding the maximum length.
+	TooLong int64
+	// AuthFailures is the number of frames without a valid MAC when verifying with VerifyWith.
+	AuthFailures int64
+}
+
+// Reader decodes a stream of newline terminated frames, such as the output of the serial device.
+//
+// Serial links drop and corrupt bytes, so the Reader resynchronizes rather than trusting newlines: bytes before the
+// start of a frame are skipped, and when a lost newline merges two frames the first is decoded on its own and reading
+// continues at the start of the second. Frames longer than the maximum length are discarded.
+type Reader struct {
+	r      io.Reader
+	max    int
+	buf    []byte
+	offset int64
+	err    error
+	stats  ReaderStats
+	opts   []DecodeOption
+}
+
+// NewReader creates a Reader for the stream r with the default maximum frame length. Options are passed to
+// DecodeMessage for each frame.
+func NewReader(r io.Reader, opts ...DecodeOption) *Reader {
+	return NewReaderSize(r, DefaultMaxFrameLength, opts...)
+}
+
+// NewReaderSize creates a Reader for the stream r that discards frames longer than maxFrameLength.
+func NewReaderSize(r io.Reader, maxFrameLength int, opts ...DecodeOption) *Reader {
+	return &Reader{r: r, max: maxFrameLength, opts: opts}
+}
+
+// Stats returns the counters for the stream read so far.
+func (r *Reader) Stats() ReaderStats {
+	return r.stats
+}
+
+// Next returns the next message in the stream. A frame that can't be decoded is returned as a *FrameError and Next
+// can be called again to continue with the following frame. io.EOF is returned at the end of the stream, other
+// errors are from the underlying reader.
+func (r *Reader) Next() (*Message, error) {
+	for {
+		// Skip to the start of a frame, keeping a possible partial start at the end of the buffer.
+		start := indexFrameStart(r.buf)
+		if start < 0 {
+			keep := 0
+			if r.err == nil {
+				keep = min(len(r.buf), len(frameStarts[0])-1)
+			}
+			r.discard(len(r.buf) - keep)
+			if r.err != nil {
+				r.discard(len(r.buf))
+				return nil, r.err
+			}
+			r.fill()
+			continue
+		}
+		r.discard(start)
+
+		end := bytes.IndexByte(r.buf, '\n') + 1
+		if end == 0 || end > r.max {
+			switch {
+			case len(r.buf) > r.max:
+				return nil, r.tooLong()
+			case r.err == nil:
+				r.fill()
+				continue
+			}
+			// The final frame of the stream has no newline.
+			end = len(r.buf)
+		}
+
+		frame := r.buf[:end]
+		msg, err := DecodeMessage(frame, r.opts...)
+		if err != nil {
+			// A lost newline merges frames, decode the first on its own and continue at the second.
+			if next := indexFrameStart(frame[1:]) + 1; next > 0 {
+				frame = frame[:next]
+				msg, err = DecodeMessage(frame, r.opts...)
+			}
+		}
+		if err != nil {
+			return nil, r.frameError(frame, err, len(frame))
+		}
+		r.stats.Frames++
+		r.consume(len(frame))
+		return msg, nil
+	}
+}
+
+// fill reads more of the stream into the buffer.
+func (r *Reader) fill() {
+	chunk := make([]byte, readChunkSize)
+	n, err := r.r.Read(chunk)
+	r.buf = append(r.buf, chunk[:n]...)
+	if err != nil {
+		r.err = err
+	}
+}
+
+// consume removes n bytes from the front of the buffer.
+func (r *Reader) consume(n int) {
+	r.buf = r.buf[n:]
+	r.offset += int64(n)
+}
+
+// discard consumes n bytes that are skipped.
+func (r *Reader) discard(n int) {
+	r.stats.DiscardedBytes += int64(n)
+	r.consume(n)
+}
+
+// frameError discards skip bytes of a frame that couldn't be decoded and returns the error for it.
+func (r *Reader) frameError(frame []byte, err error, skip int) error {
+	switch err.(type) {
+	case *ChecksumError:
+		r.stats.ChecksumFailures++
+	case *AuthError:
+		r.stats.AuthFailures++
+	default:
+		r.stats.DecodeFailures++
+	}
+	frameErr := &FrameError{Offset: r.offset, Frame: append([]byte{}, frame...), Err: err}
+	r.discard(skip)
+	return frameErr
+}
+
+// tooLong discards the oversized frame at the front of the buffer up to the next frame start.
+func (r *Reader) tooLong() error {
+	r.stats.TooLong++
+	n := indexFrameStart(r.buf[1:]) + 1
+	if n == 0 || n > r.max {
+		n = r.max
+	}
+	frameErr := &FrameError{Offset: r.offset, Frame: append([]byte{}, r.buf[:n]...), Err: &FrameTooLongError{Max: r.max}}
+	r.discard(n)
+	return frameErr
+}
+
+// indexFrameStart returns the index of the first frame start in b, or -1.
+func indexFrameStart(b []byte) int {
+	first := -1
+	for _, start := range frameStarts {
+		if i := bytes.Index(b, start); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	return first
+}
@@ -0,0 +1,235 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// TestReader decodes a stream mixing valid frames with each kind of corruption
+func TestReader(t *testing.T) {
+	cpu := mustBuildMessage(t, "cpuutil", "2.0")
+	compressed, err := BuildMessage("logs", strings.Repeat("line\n", 100), true)
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	corrupted := bytes.Replace(cpu, []byte("2.0"), []byte("3.0"), 1)
+	badData := []byte(`{"csum":4178250763,"payload":"{\"tag\":\"t\",\"compress\":true,\"data\":\"!!\"}"}` + "\n")
+	future := []byte(`{"v":9,"csum":1,"payload":""}` + "\n")
+	noNewline := bytes.TrimSuffix(mustBuildMessage(t, "last", "x"), []byte("\n"))
+
+	var stream bytes.Buffer
+	for _, frame := range [][]byte{cpu, corrupted, []byte("\n"), compressed, []byte("noise{\"csum\":garbage\n"), badData, future, noNewline} {
+		stream.Write(frame)
+	}
+
+	type result struct {
+		tag     string
+		data    string
+		errType interface{}
+	}
+	want := []result{
+		{tag: "cpuutil", data: "2.0"},
+		{errType: &ChecksumError{}},
+		{tag: "logs", data: strings.Repeat("line\n", 100)},
+		{errType: &EnvelopeError{}},
+		{errType: &DataError{}},
+		{errType: &VersionError{}},
+		{tag: "last", data: "x"},
+	}
+
+	r := NewReader(&stream)
+	for i, w := range want {
+		msg, err := r.Next()
+		if w.errType != nil {
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) {
+				t.Fatalf("frame %d: Next() error = %v, want a *FrameError", i, err)
+			}
+			if reflect.TypeOf(frameErr.Err) != reflect.TypeOf(w.errType) {
+				t.Errorf("frame %d: error = %T, want %T", i, frameErr.Err, w.errType)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("frame %d: Next() error = %v", i, err)
+		}
+		if msg.Tag != w.tag || msg.Data != w.data {
+			t.Errorf("frame %d: got tag %q data %q, want tag %q data %q", i, msg.Tag, msg.Data, w.tag, w.data)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next() at end of stream error = %v, want io.EOF", err)
+	}
+}
+
+// TestDecodeErrorsIs checks typed errors match the sentinel errors
+func TestDecodeErrorsIs(t *testing.T) {
+	if !errors.Is(&FrameError{Err: &ChecksumError{}}, ErrChecksumMismatch) {
+		t.Error("ChecksumError doesn't match ErrChecksumMismatch")
+	}
+	if !errors.Is(&FrameError{Err: &VersionError{Version: 3}}, ErrUnsupportedVersion) {
+		t.Error("VersionError doesn't match ErrUnsupportedVersion")
+	}
+}
+
+// FuzzRoundTrip checks anything built by BuildMessage decodes to the original tag and data
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("cpuutil", "2.0", false)
+	f.Add("test", "", true)
+	f.Add("logs", strings.Repeat("\"quoted\"\n", 20), true)
+	f.Fuzz(func(t *testing.T, tag string, data string, compress bool) {
+		// JSON replaces invalid UTF-8 so it can't round trip, payloads are required to be valid strings.
+		if !utf8.ValidString(tag) || !utf8.ValidString(data) {
+			t.Skip()
+		}
+		frame, err := BuildMessage(tag, data, compress)
+		if err != nil {
+			t.Fatalf("BuildMessage() error = %v", err)
+		}
+		msg, err := DecodeMessage(frame)
+		if err != nil {
+			t.Fatalf("DecodeMessage() error = %v", err)
+		}
+		if msg.Tag != tag || msg.Data != data || msg.Compress != compress || msg.Version != ProtocolVersion1 {
+			t.Errorf("DecodeMessage() = %+v, want tag %q data %q compress %v", msg, tag, data, compress)
+		}
+	})
+}
+
+// FuzzDecodeMessage checks arbitrary input never panics and only returns the documented error types
+func FuzzDecodeMessage(f *testing.F) {
+	goldens, _ := filepath.Glob(filepath.Join("testdata", "protocol", "*.golden"))
+	for _, golden := range goldens {
+		if b, err := os.ReadFile(golden); err == nil {
+			f.Add(b)
+		}
+	}
+	f.Add([]byte(`{"csum":0,"payload":""}`))
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		msg, err := DecodeMessage(frame)
+		if err == nil {
+			if msg == nil {
+				t.Fatal("DecodeMessage() returned no message and no error")
+			}
+			return
+		}
+		switch err.(type) {
+		case *EnvelopeError, *VersionError, *ChecksumError, *PayloadError, *DataError:
+		default:
+			t.Errorf("DecodeMessage() error type %T is not documented", err)
+		}
+	})
+}
+
+// corruptStream builds frames with BuildMessage and applies random bit flips and truncations to some of them. It
+// returns the stream and the data of frames left intact, which a resynchronizing reader must recover.
+func corruptStream(t *testing.T, rng *rand.Rand, count int) ([]byte, map[string]bool) {
+	t.Helper()
+	var stream []byte
+	intact := make(map[string]bool)
+	for i := 0; i < count; i++ {
+		data := fmt.Sprintf("frame-%d-%s", i, strings.Repeat("x", rng.IntN(200)))
+		frame, err := BuildMessage("test", data, rng.IntN(2) == 0, WithSequence("test", uint64(i+1)))
+		if err != nil {
+			t.Fatalf("BuildMessage() error = %v", err)
+		}
+		switch rng.IntN(4) {
+		case 0:
+			// Flip 1 to 3 random bits anywhere in the frame, including the newline.
+			for flips := rng.IntN(3) + 1; flips > 0; flips-- {
+				frame[rng.IntN(len(frame))] ^= 1 << rng.IntN(8)
+			}
+		case 1:
+			// Truncate the frame, losing at least the newline.
+			frame = frame[:rng.IntN(len(frame))]
+		default:
+			intact[data] = true
+		}
+		stream = append(stream, frame...)
+	}
+	return stream, intact
+}
+
+// TestReaderResync injects random corruption and checks every intact frame is still decoded and nothing corrupt is
+// returned as a valid message
+func TestReaderResync(t *testing.T) {
+	for seed := uint64(1); seed <= 20; seed++ {
+		rng := rand.New(rand.NewPCG(seed, seed))
+		stream, intact := corruptStream(t, rng, 200)
+
+		r := NewReader(bytes.NewReader(stream))
+		decoded := make(map[string]bool)
+		var frameErrors int64
+		for {
+			msg, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			var frameErr *FrameError
+			if errors.As(err, &frameErr) {
+				frameErrors++
+				continue
+			}
+			if err != nil {
+				t.Fatalf("seed %d: Next() error = %v", seed, err)
+			}
+			if !strings.HasPrefix(msg.Data, "frame-") || msg.Tag != "test" {
+				t.Errorf("seed %d: decoded corrupt message %+v", seed, msg)
+			}
+			decoded[msg.Data] = true
+		}
+
+		for data := range intact {
+			if !decoded[data] {
+				t.Errorf("seed %d: intact frame %.12s... was not decoded", seed, data)
+			}
+		}
+		stats := r.Stats()
+		if stats.Frames != int64(len(decoded)) {
+			t.Errorf("seed %d: Stats().Frames = %d, want %d", seed, stats.Frames, len(decoded))
+		}
+		if stats.ChecksumFailures+stats.DecodeFailures != frameErrors {
+			t.Errorf("seed %d: Stats() failures = %d, want %d", seed, stats.ChecksumFailures+stats.DecodeFailures, frameErrors)
+		}
+		if stats.DiscardedBytes == 0 || stats.ChecksumFailures == 0 {
+			t.Errorf("seed %d: Stats() = %+v, want discarded bytes and checksum failures", seed, stats)
+		}
+	}
+}
+
+// TestReaderMaxFrameLength checks oversized frames are discarded and the following frame is still read
+func TestReaderMaxFrameLength(t *testing.T) {
+	large := mustBuildMessage(t, "large", strings.Repeat("x", 500))
+	small := mustBuildMessage(t, "small", "x")
+	for _, stream := range [][]byte{
+		append(append([]byte{}, large...), small...),
+		// Without the newline the oversized frame runs into the next frame.
+		append(bytes.TrimSuffix(large, []byte("\n")), small...),
+	} {
+		r := NewReaderSize(bytes.NewReader(stream), 256)
+		_, err := r.Next()
+		var tooLong *FrameTooLongError
+		if !errors.As(err, &tooLong) {
+			t.Fatalf("Next() error = %v, want a *FrameTooLongError", err)
+		}
+		msg, err := r.Next()
+		if err != nil || msg.Tag != "small" {
+			t.Fatalf("Next() after an oversized frame = %+v, %v, want the small frame", msg, err)
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Errorf("Next() at end of stream error = %v, want io.EOF", err)
+		}
+		if stats := r.Stats(); stats.TooLong != 1 || stats.DiscardedBytes < 256 {
+			t.Errorf("Stats() = %+v, want one oversized frame discarded", stats)
+		}
+	}
+}
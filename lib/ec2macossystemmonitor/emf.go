@@ -0,0 +1,325 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EMFTag is the tag of payloads holding a CloudWatch Embedded Metric Format (EMF) document. EMF documents are sent with
+// automatic compression since they repeat their metric and dimension names.
+const EMFTag = "emf"
+
+// Limits of EMF documents from the CloudWatch specification.
+const (
+	maxEMFNamespaceLength  = 255
+	maxEMFDimensions       = 30
+	maxEMFDimensionLength  = 250
+	maxEMFMetrics          = 100
+	maxEMFMetricNameLength = 1024
+	maxEMFValues           = 100
+)
+
+// emfUnits are the units accepted by CloudWatch.
+var emfUnits = map[string]bool{
+	"Seconds": true, "Microseconds": true, "Milliseconds": true,
+	"Bytes": true, "Kilobytes": true, "Megabytes": true, "Gigabytes": true, "Terabytes": true,
+	"Bits": true, "Kilobits": true, "Megabits": true, "Gigabits": true, "Terabits": true,
+	"Percent": true, "Count": true, "None": true,
+	"Bytes/Second": true, "Kilobytes/Second": true, "Megabytes/Second": true, "Gigabytes/Second": true,
+	"Terabytes/Second": true, "Bits/Second": true, "Kilobits/Second": true, "Megabits/Second": true,
+	"Gigabits/Second": true, "Terabits/Second": true, "Count/Second": true,
+}
+
+// ErrInvalidEMF is returned for a document that isn't valid EMF.
+var ErrInvalidEMF = errors.New("ec2macossystemmonitor: invalid EMF document")
+
+// EMFDocument builds a CloudWatch Embedded Metric Format document. Dimension values and metric values are properties
+// at the root of the document, which namespaces reference by name, so a value may be shared by several namespaces:
+//
+//	doc := NewEMFDocument().Dimension("InstanceId", id)
+//	doc.Namespace("EC2/macOS").DimensionSet("InstanceId").Metric("CPUUtilization", UnitPercent, 2.5)
+//
+// The document is validated against the EMF specification when it is marshaled.
+type EMFDocument struct {
+	timestamp  time.Time
+	namespaces []*EMFNamespace
+	properties map[string]interface{}
+}
+
+// EMFNamespace is a metric directive of an EMFDocument, naming the metrics and dimension sets of a namespace.
+type EMFNamespace struct {
+	doc           *EMFDocument
+	name          string
+	dimensionSets [][]string
+	metrics       []emfMetric
+}
+
+// emfMetric is a metric definition of a directive.
+type emfMetric struct {
+	Name              string `json:"Name"`
+	Unit              string `json:"Unit,omitempty"`
+	StorageResolution int    `json:"StorageResolution,omitempty"`
+}
+
+// emfDirective is a metric directive in the _aws metadata.
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+// emfMetadata is the _aws metadata of a document.
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// NewEMFDocument creates an empty document timestamped now.
+func NewEMFDocument() *EMFDocument {
+	return &EMFDocument{timestamp: time.Now(), properties: make(map[string]interface{})}
+}
+
+// At sets the timestamp of the metrics.
+func (d *EMFDocument) At(t time.Time) *EMFDocument {
+	d.timestamp = t
+	return d
+}
+
+// Dimension sets the value of a dimension referenced by dimension sets.
+func (d *EMFDocument) Dimension(name string, value string) *EMFDocument {
+	d.properties[name] = value
+	return d
+}
+
+// Property sets a property that isn't a metric or dimension, CloudWatch Logs keeps it with the document.
+func (d *EMFDocument) Property(name string, value interface{}) *EMFDocument {
+	d.properties[name] = value
+	return d
+}
+
+// Namespace returns the directive for the metric namespace name, adding it if needed.
+func (d *EMFDocument) Namespace(name string) *EMFNamespace {
+	for _, ns := range d.namespaces {
+		if ns.name == name {
+			return ns
+		}
+	}
+	ns := &EMFNamespace{doc: d, name: name}
+	d.namespaces = append(d.namespaces, ns)
+	return ns
+}
+
+// DimensionSet adds a set of dimension names the metrics of the namespace are aggregated by. An empty set publishes the
+// metrics without dimensions.
+func (n *EMFNamespace) DimensionSet(names ...string) *EMFNamespace {
+	n.dimensionSets = append(n.dimensionSets, append([]string{}, names...))
+	return n
+}
+
+// Metric adds a metric with standard resolution to the namespace. Several values are sent as an array and CloudWatch
+// aggregates them.
+func (n *EMFNamespace) Metric(name string, unit string, values ...float64) *EMFNamespace {
+	return n.metric(emfMetric{Name: name, Unit: unit}, values)
+}
+
+// HighResolutionMetric adds a metric stored with one second resolution to the namespace.
+func (n *EMFNamespace) HighResolutionMetric(name string, unit string, values ...float64) *EMFNamespace {
+	return n.metric(emfMetric{Name: name, Unit: unit, StorageResolution: 1}, values)
+}
+
+// metric adds the definition of a metric and sets its value.
+func (n *EMFNamespace) metric(metric emfMetric, values []float64) *EMFNamespace {
+	n.metrics = append(n.metrics, metric)
+	if len(values) == 1 {
+		n.doc.properties[metric.Name] = values[0]
+	} else {
+		n.doc.properties[metric.Name] = values
+	}
+	return n
+}
+
+// Marshal returns the JSON document, or an error wrapping ErrInvalidEMF if it isn't valid EMF.
+func (d *EMFDocument) Marshal() ([]byte, error) {
+	if _, ok := d.properties["_aws"]; ok {
+		return nil, fmt.Errorf("%w: _aws is reserved for the metadata", ErrInvalidEMF)
+	}
+	metadata := emfMetadata{Timestamp: d.timestamp.UnixMilli(), CloudWatchMetrics: []emfDirective{}}
+	for _, ns := range d.namespaces {
+		directive := emfDirective{Namespace: ns.name, Dimensions: ns.dimensionSets, Metrics: ns.metrics}
+		if directive.Dimensions == nil {
+			directive.Dimensions = [][]string{}
+		}
+		metadata.CloudWatchMetrics = append(metadata.CloudWatchMetrics, directive)
+	}
+	root := make(map[string]interface{}, len(d.properties)+1)
+	for name, value := range d.properties {
+		root[name] = value
+	}
+	root["_aws"] = metadata
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(root); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEMF, err)
+	}
+	data := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	if err := ValidateEMF(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ValidateEMF checks data is a valid EMF document: the _aws metadata holds a timestamp and at least one directive,
+// every directive has a namespace, dimension sets and metrics within the CloudWatch limits, dimensions reference string
+// properties and metrics reference numbers, or arrays of numbers, at the root of the document. Errors wrap
+// ErrInvalidEMF.
+func ValidateEMF(data []byte) error {
+	invalid := func(format string, v ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidEMF, fmt.Sprintf(format, v...))
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var root map[string]interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidEMF, err)
+	}
+	if decoder.More() {
+		return invalid("data after the document")
+	}
+	aws, ok := root["_aws"].(map[string]interface{})
+	if !ok {
+		return invalid("_aws metadata is missing")
+	}
+	ts, ok := aws["Timestamp"].(json.Number)
+	if !ok {
+		return invalid("_aws.Timestamp is missing")
+	}
+	if ms, err := ts.Int64(); err != nil || ms < 0 {
+		return invalid("_aws.Timestamp %s isn't milliseconds since the epoch", ts)
+	}
+	directives, ok := aws["CloudWatchMetrics"].([]interface{})
+	if !ok || len(directives) == 0 {
+		return invalid("_aws.CloudWatchMetrics has no directives")
+	}
+
+	for i, d := range directives {
+		directive, ok := d.(map[string]interface{})
+		if !ok {
+			return invalid("directive %d isn't an object", i)
+		}
+		namespace, _ := directive["Namespace"].(string)
+		if strings.TrimSpace(namespace) == "" || len(namespace) > maxEMFNamespaceLength {
+			return invalid("directive %d namespace %q must be 1 to %d characters", i, namespace, maxEMFNamespaceLength)
+		}
+
+		sets, ok := directive["Dimensions"].([]interface{})
+		if !ok {
+			return invalid("namespace %s has no dimensions", namespace)
+		}
+		for _, s := range sets {
+			set, ok := s.([]interface{})
+			if !ok {
+				return invalid("namespace %s has a dimension set that isn't an array", namespace)
+			}
+			if len(set) > maxEMFDimensions {
+				return invalid("namespace %s has a dimension set of %d dimensions, the limit is %d", namespace, len(set), maxEMFDimensions)
+			}
+			for _, n := range set {
+				name, _ := n.(string)
+				if name == "" || len(name) > maxEMFDimensionLength {
+					return invalid("namespace %s dimension name %q must be 1 to %d characters", namespace, name, maxEMFDimensionLength)
+				}
+				if _, ok := root[name].(string); !ok {
+					return invalid("namespace %s dimension %s has no string value", namespace, name)
+				}
+			}
+		}
+
+		metrics, ok := directive["Metrics"].([]interface{})
+		if !ok || len(metrics) == 0 || len(metrics) > maxEMFMetrics {
+			return invalid("namespace %s must have 1 to %d metrics", namespace, maxEMFMetrics)
+		}
+		for _, m := range metrics {
+			metric, ok := m.(map[string]interface{})
+			if !ok {
+				return invalid("namespace %s has a metric that isn't an object", namespace)
+			}
+			name, _ := metric["Name"].(string)
+			if name == "" || len(name) > maxEMFMetricNameLength {
+				return invalid("namespace %s metric name %q must be 1 to %d characters", namespace, name, maxEMFMetricNameLength)
+			}
+			if unit, ok := metric["Unit"]; ok {
+				if u, _ := unit.(string); !emfUnits[u] {
+					return invalid("metric %s has unknown unit %v", name, unit)
+				}
+			}
+			if resolution, ok := metric["StorageResolution"]; ok {
+				if r, _ := resolution.(json.Number); r != "1" && r != "60" {
+					return invalid("metric %s storage resolution %v must be 1 or 60", name, resolution)
+				}
+			}
+			if err := validateEMFValue(root[name]); err != nil {
+				return invalid("metric %s %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateEMFValue checks the value of a metric is a number or a non-empty array of numbers.
+func validateEMFValue(value interface{}) error {
+	switch v := value.(type) {
+	case json.Number:
+		return nil
+	case []interface{}:
+		if len(v) == 0 || len(v) > maxEMFValues {
+			return fmt.Errorf("must have 1 to %d values", maxEMFValues)
+		}
+		for _, e := range v {
+			if _, ok := e.(json.Number); !ok {
+				return errors.New("has a value that isn't a number")
+			}
+		}
+		return nil
+	case nil:
+		return errors.New("has no value")
+	}
+	return errors.New("value isn't a number")
+}
+
+// BuildEMF builds the frame for doc tagged EMFTag. Documents are compressed automatically, options may override this.
+func BuildEMF(doc *EMFDocument, opts ...MessageOption) ([]byte, error) {
+	data, err := doc.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return BuildMessage(EMFTag, string(data), false, emfOptions(opts)...)
+}
+
+// BuildRawEMF validates an EMF document built elsewhere and builds its frame like BuildEMF.
+func BuildRawEMF(data []byte, opts ...MessageOption) ([]byte, error) {
+	if err := ValidateEMF(data); err != nil {
+		return nil, err
+	}
+	return BuildMessage(EMFTag, string(data), false, emfOptions(opts)...)
+}
+
+// SendEMF sends doc to relayd tagged EMFTag, compressed automatically.
+func SendEMF(doc *EMFDocument, opts ...MessageOption) (n int, err error) {
+	data, err := doc.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return SendMessage(EMFTag, string(data), false, emfOptions(opts)...)
+}
+
+// emfOptions enables automatic compression before opts so they can override it.
+func emfOptions(opts []MessageOption) []MessageOption {
+	return append([]MessageOption{WithAutoCompression(DefaultAutoCompressionThreshold)}, opts...)
+}
@@ -0,0 +1,172 @@
+package ec2macossystemmonitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEMFDocument returns a document with two namespaces sharing the InstanceId dimension.
+func testEMFDocument() *EMFDocument {
+	doc := NewEMFDocument().At(time.UnixMilli(1792324800123)).
+		Dimension("InstanceId", "i-0123456789abcdef0").
+		Dimension("Device", "disk0")
+	doc.Namespace("EC2/macOS").
+		DimensionSet("InstanceId").
+		Metric("CPUUtilization", UnitPercent, 2.5).
+		HighResolutionMetric("LoadAverage", UnitNone, 1.25, 1.5)
+	doc.Namespace("EC2/macOS/Disk").
+		DimensionSet("InstanceId", "Device").
+		DimensionSet().
+		Metric("DiskReadBytes", UnitBytes, 4096)
+	return doc
+}
+
+// TestEMFDocument checks the builder produces the documented EMF structure
+func TestEMFDocument(t *testing.T) {
+	data, err := testEMFDocument().Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	want := `{"CPUUtilization":2.5,"Device":"disk0","DiskReadBytes":4096,"InstanceId":"i-0123456789abcdef0","LoadAverage":[1.25,1.5],` +
+		`"_aws":{"Timestamp":1792324800123,"CloudWatchMetrics":[` +
+		`{"Namespace":"EC2/macOS","Dimensions":[["InstanceId"]],"Metrics":[{"Name":"CPUUtilization","Unit":"Percent"},{"Name":"LoadAverage","Unit":"None","StorageResolution":1}]},` +
+		`{"Namespace":"EC2/macOS/Disk","Dimensions":[["InstanceId","Device"],[]],"Metrics":[{"Name":"DiskReadBytes","Unit":"Bytes"}]}]}}`
+	if string(data) != want {
+		t.Errorf("Marshal() = %s\nwant %s", data, want)
+	}
+}
+
+// TestValidateEMF checks documents breaking the EMF specification are rejected
+func TestValidateEMF(t *testing.T) {
+	tooMany := func(n int, format string) string {
+		items := make([]string, n)
+		for i := range items {
+			items[i] = fmt.Sprintf(format, i)
+		}
+		return strings.Join(items, ",")
+	}
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"not json", `cpuutil 2.0`},
+		{"trailing data", `{"_aws":{}} {}`},
+		{"no metadata", `{"m":1}`},
+		{"no timestamp", `{"_aws":{"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[],"Metrics":[{"Name":"m"}]}]},"m":1}`},
+		{"fractional timestamp", `{"_aws":{"Timestamp":1.5,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[],"Metrics":[{"Name":"m"}]}]},"m":1}`},
+		{"no directives", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[]}}`},
+		{"blank namespace", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":" ","Dimensions":[],"Metrics":[{"Name":"m"}]}]},"m":1}`},
+		{"long namespace", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"` + strings.Repeat("n", 256) + `","Dimensions":[],"Metrics":[{"Name":"m"}]}]},"m":1}`},
+		{"no dimensions", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Metrics":[{"Name":"m"}]}]},"m":1}`},
+		{"missing dimension value", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[["d"]],"Metrics":[{"Name":"m"}]}]},"m":1}`},
+		{"numeric dimension value", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[["d"]],"Metrics":[{"Name":"m"}]}]},"m":1,"d":2}`},
+		{"too many dimensions", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[[` + tooMany(31, `"d%d"`) + `]],"Metrics":[{"Name":"m"}]}]},"m":1}`},
+		{"no metrics", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[],"Metrics":[]}]}}`},
+		{"too many metrics", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[],"Metrics":[` + tooMany(101, `{"Name":"m"}`) + `]}]},"m":1}`},
+		{"unnamed metric", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[],"Metrics":[{"Unit":"Count"}]}]}}`},
+		{"unknown unit", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[],"Metrics":[{"Name":"m","Unit":"Furlongs"}]}]},"m":1}`},
+		{"bad resolution", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[],"Metrics":[{"Name":"m","StorageResolution":5}]}]},"m":1}`},
+		{"missing metric value", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[],"Metrics":[{"Name":"m"}]}]}}`},
+		{"string metric value", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[],"Metrics":[{"Name":"m"}]}]},"m":"1"}`},
+		{"empty values", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[],"Metrics":[{"Name":"m"}]}]},"m":[]}`},
+		{"too many values", `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[],"Metrics":[{"Name":"m"}]}]},"m":[` + tooMany(101, `%d`) + `]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateEMF([]byte(tt.doc)); !errors.Is(err, ErrInvalidEMF) {
+				t.Errorf("ValidateEMF() error = %v, want %v", err, ErrInvalidEMF)
+			}
+		})
+	}
+	valid := `{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"n","Dimensions":[["d"]],"Metrics":[{"Name":"m","Unit":"Count","StorageResolution":60}]}]},"m":[1,2],"d":"x","extra":{"a":1}}`
+	if err := ValidateEMF([]byte(valid)); err != nil {
+		t.Errorf("ValidateEMF() of a valid document error = %v", err)
+	}
+
+	// The builder validates before marshaling
+	for name, doc := range map[string]*EMFDocument{
+		"no namespaces": NewEMFDocument().Property("m", 1),
+		"metric without value": func() *EMFDocument {
+			doc := NewEMFDocument()
+			doc.Namespace("n").DimensionSet().Metric("m", UnitCount)
+			return doc
+		}(),
+		"reserved property": testEMFDocument().Property("_aws", "x"),
+		"unset dimension": func() *EMFDocument {
+			doc := NewEMFDocument()
+			doc.Namespace("n").DimensionSet("host").Metric("m", UnitCount, 1)
+			return doc
+		}(),
+	} {
+		if _, err := doc.Marshal(); !errors.Is(err, ErrInvalidEMF) {
+			t.Errorf("%s: Marshal() error = %v, want %v", name, err, ErrInvalidEMF)
+		}
+		if _, err := BuildEMF(doc); !errors.Is(err, ErrInvalidEMF) {
+			t.Errorf("%s: BuildEMF() error = %v, want %v", name, err, ErrInvalidEMF)
+		}
+	}
+}
+
+// TestBuildEMF checks EMF frames are tagged, compressed once large enough and decode to the original document
+func TestBuildEMF(t *testing.T) {
+	small := NewEMFDocument()
+	small.Namespace("EC2/macOS").DimensionSet().Metric("CPUUtilization", UnitPercent, 2.5)
+	smallData, err := small.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	large := NewEMFDocument().Dimension("InstanceId", "i-0123456789abcdef0")
+	ns := large.Namespace("EC2/macOS/Process").DimensionSet("InstanceId")
+	for i := 0; i < 20; i++ {
+		ns.Metric(fmt.Sprintf("ProcessCPUUtilization%d", i), UnitPercent, float64(i))
+	}
+	largeData, err := large.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		build    func() ([]byte, error)
+		data     []byte
+		compress bool
+	}{
+		{"small", func() ([]byte, error) { return BuildEMF(small) }, smallData, false},
+		{"large", func() ([]byte, error) { return BuildEMF(large) }, largeData, true},
+		{"uncompressed", func() ([]byte, error) { return BuildEMF(large, WithCodec(CodecNone)) }, largeData, false},
+		{"raw", func() ([]byte, error) { return BuildRawEMF(largeData) }, largeData, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := tt.build()
+			if err != nil {
+				t.Fatalf("build error = %v", err)
+			}
+			var envelope SerialMessage
+			var payload SerialPayload
+			if err := json.Unmarshal(frame, &envelope); err != nil {
+				t.Fatalf("Unmarshal() of envelope error = %v", err)
+			}
+			if err := json.Unmarshal([]byte(envelope.Payload), &payload); err != nil {
+				t.Fatalf("Unmarshal() of payload error = %v", err)
+			}
+			if payload.Compress != tt.compress {
+				t.Errorf("payload compress = %v, want %v", payload.Compress, tt.compress)
+			}
+			msg, err := DecodeMessage(frame)
+			if err != nil {
+				t.Fatalf("DecodeMessage() error = %v", err)
+			}
+			if msg.Tag != EMFTag || msg.Data != string(tt.data) {
+				t.Errorf("DecodeMessage() = %s %s, want %s %s", msg.Tag, msg.Data, EMFTag, tt.data)
+			}
+		})
+	}
+	if _, err := BuildRawEMF([]byte(`{"m":1}`)); !errors.Is(err, ErrInvalidEMF) {
+		t.Errorf("BuildRawEMF() of an invalid document error = %v, want %v", err, ErrInvalidEMF)
+	}
+}
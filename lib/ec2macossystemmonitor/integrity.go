@@ -0,0 +1,259 @@
+package ec2macossystemmonitor
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"hash/crc32"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ChecksumAlgorithm names the checksum of the payload in the envelope.
+type ChecksumAlgorithm string
+
+const (
+	// ChecksumAdler32 is the original checksum, implied when the envelope names no algorithm.
+	ChecksumAdler32 ChecksumAlgorithm = "adler32"
+	// ChecksumCRC32C is CRC-32 with the Castagnoli polynomial, it detects more errors in short payloads than Adler-32.
+	ChecksumCRC32C ChecksumAlgorithm = "crc32c"
+)
+
+// ErrUnknownChecksum is returned for a checksum algorithm name that isn't supported.
+var ErrUnknownChecksum = errors.New("ec2macossystemmonitor: unknown checksum algorithm")
+
+// ErrAuthentication is returned when a message doesn't carry a valid MAC from a known key.
+var ErrAuthentication = errors.New("ec2macossystemmonitor: message authentication failed")
+
+// MinKeySize is the minimum length in bytes of a MAC key.
+const MinKeySize = 16
+
+// castagnoli is the CRC-32C table.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ParseChecksumAlgorithm parses a checksum algorithm name.
+func ParseChecksumAlgorithm(name string) (ChecksumAlgorithm, error) {
+	switch alg := ChecksumAlgorithm(name); alg {
+	case ChecksumAdler32, ChecksumCRC32C:
+		return alg, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownChecksum, name)
+}
+
+// checksum computes the checksum of payload with alg, an empty algorithm is Adler-32.
+func checksum(alg ChecksumAlgorithm, payload []byte) (uint32, error) {
+	switch alg {
+	case "", ChecksumAdler32:
+		return adler32.Checksum(payload), nil
+	case ChecksumCRC32C:
+		return crc32.Checksum(payload, castagnoli), nil
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownChecksum, alg)
+}
+
+// AuthError is returned by DecodeMessage, when verifying with a Keyring, for a frame without a valid MAC.
+type AuthError struct {
+	// KeyID is the key the frame claims to be signed with, empty if it isn't signed.
+	KeyID  string
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s: key %q: %s", ErrAuthentication, e.KeyID, e.Reason)
+}
+
+// Is allows matching with errors.Is(err, ErrAuthentication).
+func (e *AuthError) Is(target error) bool {
+	return target == ErrAuthentication
+}
+
+// Key is a secret shared between the instance and the receiver to authenticate messages with HMAC-SHA256.
+type Key struct {
+	// ID names the key in signed messages so receivers can pick the right key during rotation.
+	ID     string
+	Secret []byte
+}
+
+// mac returns the HMAC-SHA256 of payload.
+func (k Key) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, k.Secret)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// Keyring holds the keys used to sign and verify messages. The last key signs new messages and every key is accepted
+// when verifying, so keys are rotated by adding the new key to receivers, then appending it on instances and finally
+// removing the old key everywhere.
+type Keyring struct {
+	keys []Key
+}
+
+// NewKeyring creates a Keyring from keys, which must have unique, non-empty ids and secrets of at least MinKeySize
+// bytes.
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("ec2macossystemmonitor: keyring has no keys")
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		switch {
+		case key.ID == "" || strings.ContainsAny(key.ID, " \t\n"):
+			return nil, fmt.Errorf("ec2macossystemmonitor: invalid key id %q", key.ID)
+		case seen[key.ID]:
+			return nil, fmt.Errorf("ec2macossystemmonitor: duplicate key id %q", key.ID)
+		case len(key.Secret) < MinKeySize:
+			return nil, fmt.Errorf("ec2macossystemmonitor: key %q is shorter than %d bytes", key.ID, MinKeySize)
+		}
+		seen[key.ID] = true
+	}
+	return &Keyring{keys: keys}, nil
+}
+
+// LoadKeyring loads keys from a file that must be owned by root and not accessible by group or others. Each line holds
+// a key id and the base64 encoded secret separated by whitespace, blank lines and lines starting with # are ignored.
+// The last key signs new messages.
+func LoadKeyring(path string) (*Keyring, error) {
+	return loadKeyring(path, 0)
+}
+
+// loadKeyring loads keys from a file owned by owner.
+func loadKeyring(path string, owner uint32) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: couldn't open key file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: couldn't stat key file: %w", err)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return nil, fmt.Errorf("ec2macossystemmonitor: key file %s has mode %#o, it must not be accessible by group or others", path, perm)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Uid != owner {
+		return nil, fmt.Errorf("ec2macossystemmonitor: key file %s must be owned by uid %d", path, owner)
+	}
+
+	var keys []Key
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("ec2macossystemmonitor: key file %s line %d: want a key id and secret", path, line)
+		}
+		secret, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("ec2macossystemmonitor: key file %s line %d: %w", path, line, err)
+		}
+		keys = append(keys, Key{ID: fields[0], Secret: secret})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: couldn't read key file: %w", err)
+	}
+	return NewKeyring(keys...)
+}
+
+// Current returns the key used to sign new messages.
+func (k *Keyring) Current() Key {
+	return k.keys[len(k.keys)-1]
+}
+
+// Key returns the key with id.
+func (k *Keyring) Key(id string) (Key, bool) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// verify checks mac is the MAC of payload with the key keyID.
+func (k *Keyring) verify(keyID string, payload []byte, mac []byte) error {
+	if len(mac) == 0 {
+		return &AuthError{Reason: "message isn't signed"}
+	}
+	key, ok := k.Key(keyID)
+	if !ok {
+		return &AuthError{KeyID: keyID, Reason: "unknown key"}
+	}
+	if !hmac.Equal(key.mac(payload), mac) {
+		return &AuthError{KeyID: keyID, Reason: "MAC mismatch"}
+	}
+	return nil
+}
+
+// verifyEnvelope checks the base64 encoded MAC of a JSON envelope.
+func (k *Keyring) verifyEnvelope(envelope *SerialMessage) error {
+	mac, err := base64.StdEncoding.DecodeString(envelope.MAC)
+	if err != nil {
+		return &AuthError{KeyID: envelope.KeyID, Reason: "invalid MAC encoding"}
+	}
+	return k.verify(envelope.KeyID, []byte(envelope.Payload), mac)
+}
+
+// WithChecksum selects the checksum algorithm, algorithms other than Adler-32 require version 2.
+func WithChecksum(alg ChecksumAlgorithm) MessageOption {
+	return func(o *messageOptions) {
+		o.checksum = alg
+	}
+}
+
+// SignWith adds an HMAC-SHA256 of the payload using the current key of keys, this requires version 2.
+func SignWith(keys *Keyring) MessageOption {
+	return func(o *messageOptions) {
+		o.keys = keys
+	}
+}
+
+// seal wraps payloadBytes in the envelope for version with the checksum and MAC selected by the options.
+func (o *messageOptions) seal(payloadBytes []byte, version int) (SerialMessage, error) {
+	sum, err := checksum(o.checksum, payloadBytes)
+	if err != nil {
+		return SerialMessage{}, err
+	}
+	message := SerialMessage{
+		Checksum: sum,
+		Payload:  string(payloadBytes),
+	}
+	// Version 1 omits the version so the bytes match messages written before versioning
+	if version > ProtocolVersion1 {
+		message.Version = version
+	}
+	// Adler-32 is implied when no algorithm is named
+	if o.checksum != ChecksumAdler32 {
+		message.Algorithm = o.checksum
+	}
+	if o.keys != nil {
+		key := o.keys.Current()
+		message.KeyID = key.ID
+		message.MAC = base64.StdEncoding.EncodeToString(key.mac(payloadBytes))
+	}
+	return message, nil
+}
+
+// DecodeOption configures DecodeMessage and Reader.
+type DecodeOption func(*decodeOptions)
+
+// decodeOptions are the options collected from DecodeOption values.
+type decodeOptions struct {
+	keys *Keyring
+}
+
+// VerifyWith requires every message to be signed with one of keys, messages without a valid MAC are rejected with an
+// *AuthError.
+func VerifyWith(keys *Keyring) DecodeOption {
+	return func(o *decodeOptions) {
+		o.keys = keys
+	}
+}
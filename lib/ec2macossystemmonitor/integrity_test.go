@@ -0,0 +1,154 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKey returns a key with a secret derived from id.
+func testKey(id string) Key {
+	return Key{ID: id, Secret: []byte(strings.Repeat(id, MinKeySize))}
+}
+
+// mustKeyring creates a keyring or fails the test.
+func mustKeyring(t *testing.T, keys ...Key) *Keyring {
+	t.Helper()
+	keyring, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	return keyring
+}
+
+// TestChecksumAlgorithms checks each algorithm is verified when decoding and detects corruption
+func TestChecksumAlgorithms(t *testing.T) {
+	for _, alg := range []ChecksumAlgorithm{ChecksumAdler32, ChecksumCRC32C} {
+		t.Run(string(alg), func(t *testing.T) {
+			frame, err := BuildMessage("cpuutil", "2.0", false, WithChecksum(alg))
+			if err != nil {
+				t.Fatalf("BuildMessage() error = %v", err)
+			}
+			msg, err := DecodeMessage(frame)
+			if err != nil || msg.Data != "2.0" {
+				t.Fatalf("DecodeMessage() = %+v, %v", msg, err)
+			}
+			if alg == ChecksumAdler32 && msg.Version != ProtocolVersion1 {
+				t.Errorf("Adler-32 message has version %d, want 1", msg.Version)
+			}
+			corrupted := bytes.Replace(frame, []byte("2.0"), []byte("3.0"), 1)
+			if _, err := DecodeMessage(corrupted); !errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("DecodeMessage() of corrupted frame error = %v, want %v", err, ErrChecksumMismatch)
+			}
+		})
+	}
+	if _, err := ParseChecksumAlgorithm("md5"); !errors.Is(err, ErrUnknownChecksum) {
+		t.Errorf("ParseChecksumAlgorithm() error = %v, want %v", err, ErrUnknownChecksum)
+	}
+	if _, err := BuildMessage("test", "", false, WithChecksum(ChecksumCRC32C), WithVersion(ProtocolVersion1)); err == nil {
+		t.Error("BuildMessage() with CRC32C and version 1 succeeded")
+	}
+}
+
+// TestSignedMessages checks messages are only accepted with a valid MAC from a known key, including during rotation
+func TestSignedMessages(t *testing.T) {
+	old, current := testKey("k1"), testKey("k2")
+	sender := mustKeyring(t, old, current)
+	receiver := VerifyWith(mustKeyring(t, old, current))
+
+	signed, err := BuildMessage("cpuutil", "2.0", false, SignWith(sender))
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	if msg, err := DecodeMessage(signed, receiver); err != nil || msg.Data != "2.0" {
+		t.Fatalf("DecodeMessage() of signed frame = %+v, %v", msg, err)
+	}
+	// Readers that don't verify still decode signed messages.
+	if _, err := DecodeMessage(signed); err != nil {
+		t.Errorf("DecodeMessage() without verifying error = %v", err)
+	}
+
+	rotated, _ := BuildMessage("cpuutil", "2.0", false, SignWith(mustKeyring(t, old)))
+	unsigned, _ := BuildMessage("cpuutil", "2.0", false, WithVersion(ProtocolVersion2))
+	injected, _ := BuildMessage("cpuutil", "99.0", false, SignWith(mustKeyring(t, Key{ID: "k2", Secret: []byte(strings.Repeat("x", MinKeySize))})))
+	retired, _ := BuildMessage("cpuutil", "2.0", false, SignWith(mustKeyring(t, testKey("k0"))))
+
+	if _, err := DecodeMessage(rotated, receiver); err != nil {
+		t.Errorf("DecodeMessage() of frame signed with the previous key error = %v", err)
+	}
+	for name, frame := range map[string][]byte{"unsigned": unsigned, "injected": injected, "retired": retired} {
+		var authErr *AuthError
+		if _, err := DecodeMessage(frame, receiver); !errors.As(err, &authErr) || !errors.Is(err, ErrAuthentication) {
+			t.Errorf("DecodeMessage() of %s frame error = %v, want an *AuthError", name, err)
+		}
+	}
+
+	var stream bytes.Buffer
+	stream.Write(signed)
+	stream.Write(injected)
+	r := NewReader(&stream, receiver)
+	if _, err := r.Next(); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if _, err := r.Next(); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Next() of injected frame error = %v, want %v", err, ErrAuthentication)
+	}
+	if stats := r.Stats(); stats.AuthFailures != 1 || stats.ChecksumFailures != 0 {
+		t.Errorf("Stats() = %+v, want one authentication failure", stats)
+	}
+
+	// Fragments of a signed message are each signed and still fit.
+	frames, err := BuildMessages("test", strings.Repeat("x", 2000), false, WithMaxFrameSize(400), SignWith(sender))
+	if err != nil {
+		t.Fatalf("BuildMessages() error = %v", err)
+	}
+	for _, frame := range frames {
+		if len(frame) > 400 {
+			t.Errorf("signed fragment is %d bytes, limit is 400", len(frame))
+		}
+		if _, err := DecodeMessage(frame, receiver); err != nil {
+			t.Errorf("DecodeMessage() of signed fragment error = %v", err)
+		}
+	}
+}
+
+// TestLoadKeyring checks key files are parsed and must only be accessible by their owner
+func TestLoadKeyring(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("s", MinKeySize)))
+	tests := []struct {
+		name     string
+		contents string
+		mode     os.FileMode
+		owner    int
+		wantErr  bool
+	}{
+		{"Valid", "# keys\nold " + secret + "\n\nnew " + secret + "\n", 0o600, os.Getuid(), false},
+		{"Readable By Others", "new " + secret + "\n", 0o644, os.Getuid(), true},
+		{"Wrong Owner", "new " + secret + "\n", 0o600, os.Getuid() + 1, true},
+		{"Short Secret", "new c2hvcnQ=\n", 0o600, os.Getuid(), true},
+		{"Missing Secret", "new\n", 0o600, os.Getuid(), true},
+		{"Empty", "# no keys\n", 0o600, os.Getuid(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys")
+			if err := os.WriteFile(path, []byte(tt.contents), tt.mode); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+			if err := os.Chmod(path, tt.mode); err != nil {
+				t.Fatalf("Chmod() error = %v", err)
+			}
+			keyring, err := loadKeyring(path, uint32(tt.owner))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadKeyring() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && keyring.Current().ID != "new" {
+				t.Errorf("Current() = %q, want the last key", keyring.Current().ID)
+			}
+		})
+	}
+}
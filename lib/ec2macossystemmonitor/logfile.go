@@ -0,0 +1,351 @@
+package ec2macossystemmonitor
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFileMode is the mode used when creating log files and their rotated copies.
+const logFileMode = 0o640
+
+// backupTimeFormat is the timestamp appended to rotated log files, it sorts lexically in time order.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// LogRotation configures when a LogFile is rotated and how many rotated files are kept.
+type LogRotation struct {
+	// MaxSize is the size in bytes a file may reach before it is rotated, 0 disables size based rotation.
+	MaxSize int64
+	// MaxAge is how long a file is written to before it is rotated, 0 disables age based rotation. Age is measured
+	// from when the file was opened by this process.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files to keep, 0 keeps all of them.
+	MaxBackups int
+	// Compress gzips rotated files.
+	Compress bool
+}
+
+// LogFile is a log destination that writes directly to a file and rotates it. It is safe for concurrent use, so
+// the relay goroutine and the main loop can share it through a Logger. Rotated files are compressed and pruned in the
+// background so writes aren't held up.
+type LogFile struct {
+	// OnError is called when compressing or pruning rotated files fails, it may be called from another goroutine.
+	OnError func(err error)
+
+	path     string
+	rotation LogRotation
+
+	// cleanupMu serializes compressing and pruning rotated files, cleanup tracks the goroutines doing it.
+	cleanupMu sync.Mutex
+	cleanup   sync.WaitGroup
+
+	mu sync.Mutex
+	// file is nil once closed, or if opening a new file after rotating failed, in which case it is retried on the next
+	// write.
+	file     *os.File
+	closed   bool
+	size     int64
+	openedAt time.Time
+	// now is the clock used for rotation decisions and backup names.
+	now func() time.Time
+	// openFile opens the log file, it is os.OpenFile outside of tests.
+	openFile func(name string, flag int, perm os.FileMode) (*os.File, error)
+}
+
+// OpenLogFile opens, or creates, the log file at path for appending and rotates it according to rotation.
+func OpenLogFile(path string, rotation LogRotation) (*LogFile, error) {
+	f := &LogFile{
+		path:     path,
+		rotation: rotation,
+		now:      time.Now,
+		openFile: os.OpenFile,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: unable to create log directory: %w", err)
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Path returns the path of the active log file.
+func (f *LogFile) Path() string {
+	return f.path
+}
+
+// Write writes p to the log file, rotating first if p would exceed the maximum size or the file is too old.
+func (f *LogFile) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, fmt.Errorf("ec2macossystemmonitor: log file %s is closed", f.path)
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.shouldRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the current file aside, opens a new one and prunes old rotated files.
+func (f *LogFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.rotate()
+}
+
+// Reopen closes and reopens the log file at its path. This allows external tools like newsyslog to move the file away
+// and have logging continue in a new file at the original path.
+func (f *LogFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		_ = f.file.Close()
+		f.file = nil
+	}
+	f.closed = false
+	return f.open()
+}
+
+// ReopenOnSignal calls Reopen whenever one of sigs is received, typically SIGUSR1 sent by an external rotator. The
+// returned function stops handling the signals.
+func (f *LogFile) ReopenOnSignal(onError func(error), sigs ...os.Signal) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+	go func() {
+		for {
+			select {
+			case <-ch:
+				if err := f.Reopen(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+// Close closes the log file and waits for rotated files to be compressed and pruned, further writes fail.
+func (f *LogFile) Close() error {
+	f.mu.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.closed = true
+	f.mu.Unlock()
+
+	f.cleanup.Wait()
+	return err
+}
+
+// open opens the file at path for appending, the caller must hold mu.
+func (f *LogFile) open() error {
+	file, err := f.openFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, logFileMode)
+	if err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("ec2macossystemmonitor: unable to stat log file: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = f.now()
+	return nil
+}
+
+// shouldRotate decides if writing n more bytes requires rotating first, the caller must hold mu.
+func (f *LogFile) shouldRotate(n int64) bool {
+	// Never rotate an empty file, a single write larger than MaxSize would otherwise rotate forever.
+	if f.size == 0 {
+		return false
+	}
+	if f.rotation.MaxSize > 0 && f.size+n > f.rotation.MaxSize {
+		return true
+	}
+	return f.rotation.MaxAge > 0 && f.now().Sub(f.openedAt) >= f.rotation.MaxAge
+}
+
+// rotate renames the active file with a timestamp suffix and opens a fresh file, the rotated files are then
+// compressed and pruned in the background. If the fresh file can't be opened the next write tries again. The caller
+// must hold mu.
+func (f *LogFile) rotate() error {
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			return fmt.Errorf("ec2macossystemmonitor: unable to close log file for rotation: %w", err)
+		}
+		f.file = nil
+	}
+
+	backup := f.backupName()
+	if err := os.Rename(f.path, backup); err != nil && !os.IsNotExist(err) {
+		// Keep logging to the existing file rather than losing output.
+		_ = f.open()
+		return fmt.Errorf("ec2macossystemmonitor: unable to rotate log file: %w", err)
+	}
+	// The backup is complete whether or not the fresh file opens, so it is still compressed and pruned.
+	err := f.open()
+
+	f.cleanup.Add(1)
+	go func() {
+		defer f.cleanup.Done()
+		if err := f.compressAndPrune(backup); err != nil && f.OnError != nil {
+			f.OnError(err)
+		}
+	}()
+	return err
+}
+
+// compressAndPrune compresses backup if configured and prunes old rotated files, one rotation at a time.
+func (f *LogFile) compressAndPrune(backup string) error {
+	f.cleanupMu.Lock()
+	defer f.cleanupMu.Unlock()
+
+	if f.rotation.Compress {
+		// A later rotation may already have pruned the file.
+		if err := compressFile(backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return f.prune()
+}
+
+// backupName returns an unused name for the next rotated file.
+func (f *LogFile) backupName() string {
+	name := f.path + "." + f.now().Format(backupTimeFormat)
+	candidate := name
+	for i := 1; ; i++ {
+		_, errPlain := os.Lstat(candidate)
+		_, errGzip := os.Lstat(candidate + ".gz")
+		if os.IsNotExist(errPlain) && os.IsNotExist(errGzip) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// backups returns the rotated files for this log, oldest first.
+func (f *LogFile) backups() ([]string, error) {
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, m := range matches {
+		// Skip in-progress compression output and other files sharing the log's name.
+		if isBackupSuffix(strings.TrimPrefix(m, f.path+".")) {
+			backups = append(backups, m)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// isBackupSuffix returns true if suffix is one backupName creates: a backupTimeFormat timestamp, optionally followed by
+// -N to make it unique and .gz once compressed.
+func isBackupSuffix(suffix string) bool {
+	suffix = strings.TrimSuffix(suffix, ".gz")
+	if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+		return true
+	}
+	i := strings.LastIndexByte(suffix, '-')
+	if i < 0 {
+		return false
+	}
+	if _, err := strconv.ParseUint(suffix[i+1:], 10, 64); err != nil {
+		return false
+	}
+	_, err := time.Parse(backupTimeFormat, suffix[:i])
+	return err == nil
+}
+
+// prune removes the oldest rotated files beyond MaxBackups.
+func (f *LogFile) prune() error {
+	if f.rotation.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := f.backups()
+	if err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to list rotated log files: %w", err)
+	}
+	for len(backups) > f.rotation.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("ec2macossystemmonitor: unable to remove rotated log file: %w", err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// compressFile gzips path to path.gz and removes path once the compressed copy is complete.
+func compressFile(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to open rotated log file: %w", err)
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, logFileMode)
+	if err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to create compressed log file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = dst.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to compress log file: %w", err)
+	}
+	if err = gz.Close(); err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to compress log file: %w", err)
+	}
+	if err = dst.Close(); err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to close compressed log file: %w", err)
+	}
+	if err = os.Rename(tmp, path+".gz"); err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to rename compressed log file: %w", err)
+	}
+	if err = os.Remove(path); err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to remove log file after compressing it: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLogFile opens a LogFile in a temporary directory with a controllable clock.
+func testLogFile(t *testing.T, rotation LogRotation) (*LogFile, *time.Time) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "system-monitoring.log")
+	f, err := OpenLogFile(path, rotation)
+	if err != nil {
+		t.Fatalf("OpenLogFile() error = %v", err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now }
+	f.openedAt = now
+	return f, &now
+}
+
+// readLog returns the contents of a log file, decompressing rotated .gz files.
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if strings.HasSuffix(path, ".gz") {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("gzip.NewReader() error = %v", err)
+		}
+		if b, err = io.ReadAll(r); err != nil {
+			t.Fatalf("gzip read error = %v", err)
+		}
+	}
+	return string(b)
+}
+
+// TestLogFileRotateSize checks rotation on size, gzip of rotated files and retention of MaxBackups
+func TestLogFileRotateSize(t *testing.T) {
+	f, now := testLogFile(t, LogRotation{MaxSize: 10, MaxBackups: 2, Compress: true})
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		*now = now.Add(time.Second)
+	}
+	// Close waits for the rotated files to be compressed and pruned
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if got := readLog(t, f.Path()); got != "fourth\n" {
+		t.Errorf("active log = %q, want %q", got, "fourth\n")
+	}
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatalf("backups() error = %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("backups = %v, want 2 files", backups)
+	}
+	for i, want := range []string{"second\n", "third\n"} {
+		if !strings.HasSuffix(backups[i], ".gz") {
+			t.Errorf("backup %s is not compressed", backups[i])
+		}
+		if got := readLog(t, backups[i]); got != want {
+			t.Errorf("backup %s = %q, want %q", backups[i], got, want)
+		}
+	}
+}
+
+// TestLogFileRotateBackground checks writes carry on while rotated files are still being compressed
+func TestLogFileRotateBackground(t *testing.T) {
+	f, now := testLogFile(t, LogRotation{MaxSize: 10, MaxBackups: 1, Compress: true})
+	errs := make(chan error, 10)
+	f.OnError = func(err error) { errs <- err }
+
+	// Hold up compression until all lines are written
+	f.cleanupMu.Lock()
+	written := make(chan error, 1)
+	go func() {
+		for _, line := range []string{"first\n", "second\n", "third\n"} {
+			if _, err := f.Write([]byte(line)); err != nil {
+				written <- err
+				return
+			}
+			*now = now.Add(time.Second)
+		}
+		written <- nil
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write() waited for rotated files to be compressed")
+	}
+	f.cleanupMu.Unlock()
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("OnError(%v), want no error", err)
+	default:
+	}
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatalf("backups() error = %v", err)
+	}
+	if len(backups) != 1 || !strings.HasSuffix(backups[0], ".gz") || readLog(t, backups[0]) != "second\n" {
+		t.Errorf("backups = %v, want the second line compressed", backups)
+	}
+}
+
+// TestLogFilePruneSiblings checks pruning only removes rotated files, not other files sharing the log's name
+func TestLogFilePruneSiblings(t *testing.T) {
+	f, _ := testLogFile(t, LogRotation{MaxSize: 10, MaxBackups: 1})
+	siblings := []string{".bak", ".lock", ".2026-10-18.gz", ".gz.tmp"}
+	for _, suffix := range siblings {
+		if err := os.WriteFile(f.Path()+suffix, []byte("keep\n"), 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	// The clock doesn't move, so later rotated files get a -N suffix
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatalf("backups() error = %v", err)
+	}
+	if len(backups) != 1 || !strings.HasSuffix(backups[0], "-2") || readLog(t, backups[0]) != "third\n" {
+		t.Errorf("backups = %v, want the third line", backups)
+	}
+	for _, suffix := range siblings {
+		if _, err := os.Stat(f.Path() + suffix); err != nil {
+			t.Errorf("Stat(%s) error = %v, want it kept", f.Path()+suffix, err)
+		}
+	}
+}
+
+// TestLogFileRotateAge checks rotation once the file has been open for MaxAge
+func TestLogFileRotateAge(t *testing.T) {
+	f, now := testLogFile(t, LogRotation{MaxAge: time.Hour})
+
+	_, _ = f.Write([]byte("old\n"))
+	*now = now.Add(59 * time.Minute)
+	_, _ = f.Write([]byte("still\n"))
+	*now = now.Add(time.Minute)
+	_, _ = f.Write([]byte("new\n"))
+
+	if got := readLog(t, f.Path()); got != "new\n" {
+		t.Errorf("active log = %q, want %q", got, "new\n")
+	}
+	backups, _ := f.backups()
+	if len(backups) != 1 || readLog(t, backups[0]) != "old\nstill\n" {
+		t.Errorf("backups = %v, want one uncompressed file with the old entries", backups)
+	}
+}
+
+// TestLogFileReopen simulates an external rotator moving the file and requesting a reopen
+func TestLogFileReopen(t *testing.T) {
+	f, _ := testLogFile(t, LogRotation{})
+
+	_, _ = f.Write([]byte("before\n"))
+	moved := f.Path() + ".0"
+	if err := os.Rename(f.Path(), moved); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatalf("Reopen() error = %v", err)
+	}
+	_, _ = f.Write([]byte("after\n"))
+
+	if got := readLog(t, moved); got != "before\n" {
+		t.Errorf("moved log = %q, want %q", got, "before\n")
+	}
+	if got := readLog(t, f.Path()); got != "after\n" {
+		t.Errorf("reopened log = %q, want %q", got, "after\n")
+	}
+}
+
+// TestLogFileRotateOpenFailure checks a failure to open the new file after rotating is retried by the next write
+// rather than stopping logging
+func TestLogFileRotateOpenFailure(t *testing.T) {
+	f, _ := testLogFile(t, LogRotation{})
+
+	_, _ = f.Write([]byte("before\n"))
+	f.openFile = func(string, int, os.FileMode) (*os.File, error) { return nil, os.ErrPermission }
+	if err := f.Rotate(); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("Rotate() error = %v, want %v", err, os.ErrPermission)
+	}
+	if _, err := f.Write([]byte("lost\n")); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Write() error = %v, want %v", err, os.ErrPermission)
+	}
+	f.openFile = os.OpenFile
+	if _, err := f.Write([]byte("after\n")); err != nil {
+		t.Fatalf("Write() after open recovers error = %v", err)
+	}
+
+	if got := readLog(t, f.Path()); got != "after\n" {
+		t.Errorf("log = %q, want %q", got, "after\n")
+	}
+	backups, _ := filepath.Glob(f.Path() + ".*")
+	if len(backups) != 1 || readLog(t, backups[0]) != "before\n" {
+		t.Errorf("backups = %q, want one holding %q", backups, "before\n")
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := f.Write([]byte("closed\n")); err == nil {
+		t.Error("Write() after Close succeeded")
+	}
+}
+
+// TestLogFileConcurrent writes from many goroutines while rotating to ensure no entries are lost or interleaved
+func TestLogFileConcurrent(t *testing.T) {
+	f, _ := testLogFile(t, LogRotation{MaxSize: 256})
+	const writers, lines = 8, 100
+	line := strings.Repeat("x", 15) + "\n"
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				if _, err := f.Write([]byte(line)); err != nil {
+					t.Errorf("Write() error = %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	backups, _ := f.backups()
+	var all strings.Builder
+	for _, b := range append(backups, f.Path()) {
+		all.WriteString(readLog(t, b))
+	}
+	if got, want := all.String(), strings.Repeat(line, writers*lines); got != want {
+		t.Errorf("combined logs have %d bytes, want %d", len(got), len(want))
+	}
+}
@@ -1,36 +1,97 @@
 package ec2macossystemmonitor
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"log/syslog"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// Logger contains booleans for where to log, a tag used in syslog and the syslog Writer itself.
+// Level is the severity of a log entry. The values match those of log/slog so levels can be converted directly.
+type Level int
+
+const (
+	// LevelDebug is for verbose output useful when troubleshooting.
+	LevelDebug Level = Level(slog.LevelDebug)
+	// LevelInfo is for normal operational messages, this is the default minimum level.
+	LevelInfo Level = Level(slog.LevelInfo)
+	// LevelWarn is for unexpected conditions that can be recovered from.
+	LevelWarn Level = Level(slog.LevelWarn)
+	// LevelError is for failures.
+	LevelError Level = Level(slog.LevelError)
+)
+
+// String returns the upper case name of the level, matching log/slog.
+func (l Level) String() string {
+	return slog.Level(l).String()
+}
+
+// ParseLevel returns the Level for a name such as "debug" or "WARN".
+func ParseLevel(s string) (Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return LevelInfo, fmt.Errorf("ec2macossystemmonitor: invalid log level %q", s)
+	}
+	return Level(level), nil
+}
+
+// fileTimeFormat prefixes text entries written to a LogFile, matching the standard log package flags used for stdout.
+const fileTimeFormat = "2006/01/02 15:04:05.000000 "
+
+// Format selects how log entries are encoded.
+type Format int
+
+const (
+	// FormatText writes the message followed by key=value fields.
+	FormatText Format = iota
+	// FormatJSON writes one JSON object per line with time, level, tag, message and fields.
+	FormatJSON
+)
+
+// ParseFormat returns the Format for "text" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatText, fmt.Errorf("ec2macossystemmonitor: invalid log format %q", s)
+}
+
+// Logger contains booleans for where to log, a tag used in syslog and the syslog Writer itself. The zero value logs at
+// LevelInfo and above until SetLevel is called. A Logger must not be copied after first use, use With to derive one.
 type Logger struct {
 	LogToStdout    bool
 	LogToSystemLog bool
 	Tag            string
 	SystemLog      *syslog.Writer
-}
-
-// defaultLogInterval is the number of writes before emitting a log entry 10 = once every 10 minutes
-const DefaultLogInterval = 10
+	// File is an optional log file written to directly, rotating as configured, in addition to stdout and syslog.
+	File *LogFile
+	// Format is the encoding used for stdout and File, defaults to FormatText. The system log always receives text
+	// since syslog carries the level itself.
+	Format Format
 
-// StatusLogBuffer contains a message format string and a written bytes for this format string for flushing the logs
-type StatusLogBuffer struct {
-	Message string
-	Written int64
+	// level is the minimum level to emit, it is shared by all loggers derived using With so it can be changed at
+	// runtime for all of them. Use levelVar, it is created by levelOnce for a Logger not created by NewLogger.
+	level     *slog.LevelVar
+	levelOnce sync.Once
+	// json encodes entries for FormatJSON, it is shared by all loggers derived using With.
+	json *jsonEncoder
+	// fields are key/value pairs added to every entry.
+	fields []any
 }
 
-// IntervalLogger is a special logger that provides a way to only log at a certain interval.
-type IntervalLogger struct {
-	logger      Logger
-	LogInterval int
-	Counter     int
-	Message     string
-}
+// DefaultLogInterval is the number of minutes between summaries of repeated log messages and counters.
+const DefaultLogInterval = 10
 
 // NewLogger creates a new logger.  Logger writes using the LOG_LOCAL0 facility by default if system logging is enabled.
 func NewLogger(tag string, systemLog bool, stdout bool) (logger *Logger, err error) {
@@ -49,70 +110,227 @@ func NewLogger(tag string, systemLog bool, stdout bool) (logger *Logger, err err
 
 	return &Logger{
 		LogToSystemLog: systemLog,
-		LogToStdout: stdout,
-		Tag: tag,
-		SystemLog: syslogger,
+		LogToStdout:    stdout,
+		Tag:            tag,
+		SystemLog:      syslogger,
+		level:          new(slog.LevelVar),
+		json:           newJSONEncoder(),
 	}, nil
 }
 
-// Info writes info to stdout and/or the system log.
-func (l *Logger) Info(v ...interface{}) {
+// SetLevel changes the minimum level emitted by the logger and every logger derived from it. It is safe to call while
+// logging from other goroutines.
+func (l *Logger) SetLevel(level Level) {
+	l.levelVar().Set(slog.Level(level))
+}
+
+// Level returns the current minimum level.
+func (l *Logger) Level() Level {
+	return Level(l.levelVar().Level())
+}
+
+// levelVar returns the logger's level, creating it at LevelInfo for a Logger not created by NewLogger.
+func (l *Logger) levelVar() *slog.LevelVar {
+	l.levelOnce.Do(func() {
+		if l.level == nil {
+			l.level = new(slog.LevelVar)
+		}
+	})
+	return l.level
+}
+
+// Enabled reports whether entries at level would be emitted.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// With returns a logger that adds the given key/value pairs to every entry. The minimum level remains shared with l.
+func (l *Logger) With(keysAndValues ...any) *Logger {
+	return &Logger{
+		LogToStdout:    l.LogToStdout,
+		LogToSystemLog: l.LogToSystemLog,
+		Tag:            l.Tag,
+		SystemLog:      l.SystemLog,
+		File:           l.File,
+		Format:         l.Format,
+		level:          l.levelVar(),
+		json:           l.json,
+		fields:         append(append([]any{}, l.fields...), keysAndValues...),
+	}
+}
+
+// Log writes msg at level with key/value pairs to stdout and/or the system log.
+func (l *Logger) Log(level Level, msg string, keysAndValues ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+	fields := l.fields
+	if len(keysAndValues) > 0 {
+		fields = append(append([]any{}, l.fields...), keysAndValues...)
+	}
+	// A JSON entry is encoded once for both stdout and the file
+	var entry []byte
+	if l.Format == FormatJSON && (l.LogToStdout || l.File != nil) {
+		entry = l.jsonEntry(level, msg, fields)
+	}
 	if l.LogToStdout {
-		log.Print(v...)
+		if entry != nil {
+			_, _ = log.Writer().Write(entry)
+		} else {
+			log.Print(textEntry(msg, fields))
+		}
+	}
+	if l.File != nil {
+		if entry != nil {
+			_, _ = l.File.Write(entry)
+		} else {
+			_, _ = io.WriteString(l.File, time.Now().Format(fileTimeFormat)+textEntry(msg, fields)+"\n")
+		}
 	}
 	if l.LogToSystemLog {
-		_ = l.SystemLog.Info(fmt.Sprint(v...))
+		l.writeSystemLog(level, textEntry(msg, fields))
 	}
 }
 
-// Infof writes formatted info to stdout and/or the system log.
-func (l *Logger) Infof(format string, v ...interface{}) {
-	if l.LogToStdout {
-		log.Printf(format, v...)
+// writeSystemLog sends an already formatted entry to syslog at the severity matching level.
+func (l *Logger) writeSystemLog(level Level, entry string) {
+	switch {
+	case level >= LevelError:
+		_ = l.SystemLog.Err(entry)
+	case level >= LevelWarn:
+		_ = l.SystemLog.Warning(entry)
+	case level >= LevelInfo:
+		_ = l.SystemLog.Info(entry)
+	default:
+		_ = l.SystemLog.Debug(entry)
 	}
-	if l.LogToSystemLog {
-		_ = l.SystemLog.Info(fmt.Sprintf(format, v...))
+}
+
+// jsonEntry encodes a single entry as a JSON line.
+func (l *Logger) jsonEntry(level Level, msg string, fields []any) []byte {
+	record := slog.NewRecord(time.Now(), slog.Level(level), msg, 0)
+	if l.Tag != "" {
+		record.AddAttrs(slog.String("tag", l.Tag))
 	}
+	record.Add(fields...)
+	json := l.json
+	if json == nil {
+		// A Logger not created by NewLogger has no encoder of its own
+		json = newJSONEncoder()
+	}
+	return json.encode(record)
 }
 
-// Warn writes a warning to stdout and/or the system log.
-func (l *Logger) Warn(v ...interface{}) {
-	if l.LogToStdout {
-		log.Print(v...)
+// jsonEncoder encodes records as JSON lines using a single slog.JSONHandler.
+type jsonEncoder struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	handler slog.Handler
+}
+
+// newJSONEncoder creates a jsonEncoder.
+func newJSONEncoder() *jsonEncoder {
+	e := &jsonEncoder{}
+	// The level is checked by the Logger so the handler accepts everything.
+	e.handler = slog.NewJSONHandler(&e.buf, &slog.HandlerOptions{Level: slog.Level(-1 << 16)})
+	return e
+}
+
+// encode returns record as a JSON line.
+func (e *jsonEncoder) encode(record slog.Record) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.buf.Reset()
+	_ = e.handler.Handle(context.Background(), record)
+	return bytes.Clone(e.buf.Bytes())
+}
+
+// textEntry formats msg followed by key=value pairs, quoting values when needed.
+func textEntry(msg string, fields []any) string {
+	if len(fields) == 0 {
+		return msg
 	}
-	if l.LogToSystemLog {
-		_ = l.SystemLog.Warning(fmt.Sprint(v...))
+	var b strings.Builder
+	b.WriteString(msg)
+	record := slog.Record{}
+	record.Add(fields...)
+	record.Attrs(func(a slog.Attr) bool {
+		b.WriteByte(' ')
+		b.WriteString(a.Key)
+		b.WriteByte('=')
+		b.WriteString(quoteIfNeeded(a.Value.Resolve().String()))
+		return true
+	})
+	return b.String()
+}
+
+// quoteIfNeeded quotes s if it is empty or contains characters that would make key=value output ambiguous.
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
 	}
+	return s
+}
+
+// Debug writes debug output to stdout and/or the system log.
+func (l *Logger) Debug(v ...interface{}) {
+	l.Log(LevelDebug, fmt.Sprint(v...))
+}
+
+// Debugf writes formatted debug output to stdout and/or the system log.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.Log(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+// Debugw writes a debug message with key/value pairs to stdout and/or the system log.
+func (l *Logger) Debugw(msg string, keysAndValues ...any) {
+	l.Log(LevelDebug, msg, keysAndValues...)
+}
+
+// Info writes info to stdout and/or the system log.
+func (l *Logger) Info(v ...interface{}) {
+	l.Log(LevelInfo, fmt.Sprint(v...))
+}
+
+// Infof writes formatted info to stdout and/or the system log.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.Log(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Infow writes an info message with key/value pairs to stdout and/or the system log.
+func (l *Logger) Infow(msg string, keysAndValues ...any) {
+	l.Log(LevelInfo, msg, keysAndValues...)
+}
+
+// Warn writes a warning to stdout and/or the system log.
+func (l *Logger) Warn(v ...interface{}) {
+	l.Log(LevelWarn, fmt.Sprint(v...))
 }
 
 // Warnf writes a formatted warning to stdout and/or the system log.
 func (l *Logger) Warnf(format string, v ...interface{}) {
-	if l.LogToStdout {
-		log.Printf(format, v...)
-	}
-	if l.LogToSystemLog {
-		_ = l.SystemLog.Warning(fmt.Sprintf(format, v...))
-	}
+	l.Log(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+// Warnw writes a warning with key/value pairs to stdout and/or the system log.
+func (l *Logger) Warnw(msg string, keysAndValues ...any) {
+	l.Log(LevelWarn, msg, keysAndValues...)
 }
 
 // Error writes an error to stdout and/or the system log.
 func (l *Logger) Error(v ...interface{}) {
-	if l.LogToStdout {
-		log.Print(v...)
-	}
-	if l.LogToSystemLog {
-		_ = l.SystemLog.Err(fmt.Sprint(v...))
-	}
+	l.Log(LevelError, fmt.Sprint(v...))
 }
 
 // Errorf writes a formatted error to stdout and/or the system log.
 func (l *Logger) Errorf(format string, v ...interface{}) {
-	if l.LogToStdout {
-		log.Printf(format, v...)
-	}
-	if l.LogToSystemLog {
-		_ = l.SystemLog.Err(fmt.Sprintf(format, v...))
-	}
+	l.Log(LevelError, fmt.Sprintf(format, v...))
+}
+
+// Errorw writes an error with key/value pairs to stdout and/or the system log.
+func (l *Logger) Errorw(msg string, keysAndValues ...any) {
+	l.Log(LevelError, msg, keysAndValues...)
 }
 
 // Fatal writes an error to stdout and/or the system log then exits 1.
@@ -127,15 +345,60 @@ func (l *Logger) Fatalf(format string, v ...interface{}) {
 	os.Exit(1)
 }
 
-// PushToInterval adds to the counter and sets the Message, care should be taken to retrieve the Message before setting since
-// its overwritten
-func (t *IntervalLogger) PushToInterval(i int, message string) (flushed bool) {
-	t.Counter = +i
-	t.Message = message
-	if t.Counter > t.LogInterval {
-		t.logger.Info(message)
-		t.Counter = 0
+// Slog returns a log/slog Logger that writes through l, allowing packages built on slog to share its sinks and level.
+func (l *Logger) Slog() *slog.Logger {
+	return slog.New(l.Handler())
+}
+
+// Handler returns a slog.Handler that writes records through l.
+func (l *Logger) Handler() slog.Handler {
+	return &slogHandler{logger: l}
+}
+
+// slogHandler bridges log/slog records to a Logger.
+type slogHandler struct {
+	logger *Logger
+	// prefix is the dotted group name applied to attribute keys.
+	prefix string
+}
+
+// Enabled implements slog.Handler.
+func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.logger.Enabled(Level(level))
+}
+
+// Handle implements slog.Handler.
+func (h *slogHandler) Handle(_ context.Context, record slog.Record) error {
+	var fields []any
+	record.Attrs(func(a slog.Attr) bool {
+		fields = append(fields, h.attr(a))
 		return true
+	})
+	h.logger.Log(Level(record.Level), record.Message, fields...)
+	return nil
+}
+
+// WithAttrs implements slog.Handler.
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := make([]any, 0, len(attrs))
+	for _, a := range attrs {
+		fields = append(fields, h.attr(a))
+	}
+	return &slogHandler{logger: h.logger.With(fields...), prefix: h.prefix}
+}
+
+// WithGroup implements slog.Handler.
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &slogHandler{logger: h.logger, prefix: h.prefix + name + "."}
+}
+
+// attr applies the group prefix to an attribute key.
+func (h *slogHandler) attr(a slog.Attr) slog.Attr {
+	if h.prefix != "" {
+		a.Key = h.prefix + a.Key
 	}
-	return false
+	return a
 }
@@ -0,0 +1,184 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureStdout redirects the standard logger output for the duration of a test.
+func captureStdout(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prevOutput, prevFlags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(prevOutput)
+		log.SetFlags(prevFlags)
+	})
+	return &buf
+}
+
+// TestParseLevel checks level names are accepted case insensitively and bad names are rejected
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Level
+		wantErr bool
+	}{
+		{"debug", LevelDebug, false},
+		{"INFO", LevelInfo, false},
+		{"Warn", LevelWarn, false},
+		{"error", LevelError, false},
+		{"loud", LevelInfo, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLevel(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLevel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLevel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoggerLevel ensures entries below the minimum level are dropped and that the level is shared with derived loggers
+func TestLoggerLevel(t *testing.T) {
+	logger, err := NewLogger("", false, true)
+	if err != nil {
+		t.Fatalf("NewLogger() error = %v", err)
+	}
+	buf := captureStdout(t)
+	child := logger.With("component", "test")
+
+	child.Debug("hidden")
+	logger.SetLevel(LevelDebug)
+	child.Debug("shown")
+	logger.SetLevel(LevelError)
+	child.Warn("hidden")
+
+	if got, want := buf.String(), "shown component=test\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+// TestLoggerZeroValueLevel checks the level of a Logger not created by NewLogger can be changed and is shared with
+// loggers derived from it
+func TestLoggerZeroValueLevel(t *testing.T) {
+	logger := &Logger{LogToStdout: true}
+	buf := captureStdout(t)
+	if got := logger.Level(); got != LevelInfo {
+		t.Errorf("Level() = %s, want %s", got, LevelInfo)
+	}
+	child := logger.With("component", "test")
+	child.Debug("hidden")
+	logger.SetLevel(LevelDebug)
+	child.Debug("shown")
+
+	if got, want := buf.String(), "shown component=test\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+// TestLoggerText checks the text format of fields, including quoting
+func TestLoggerText(t *testing.T) {
+	buf := captureStdout(t)
+	logger := &Logger{LogToStdout: true}
+
+	logger.Infow("sent data\n", "bytes", 10, "device", "/dev/cu serial", "empty", "")
+
+	if got, want := buf.String(), "sent data bytes=10 device=\"/dev/cu serial\" empty=\"\"\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+// TestLoggerJSON checks JSON entries carry the level, tag, message and fields
+func TestLoggerJSON(t *testing.T) {
+	buf := captureStdout(t)
+	logger := &Logger{LogToStdout: true, Format: FormatJSON, Tag: "unit"}
+
+	logger.With("component", "relay").Warnw("write failed", "bytes", 3)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("output is not JSON: %v: %q", err, buf.String())
+	}
+	want := map[string]interface{}{
+		"level":     "WARN",
+		"tag":       "unit",
+		"msg":       "write failed",
+		"component": "relay",
+		"bytes":     float64(3),
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("entry[%q] = %v, want %v", k, entry[k], v)
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Error("entry is missing time")
+	}
+}
+
+// TestLoggerConcurrent derives loggers, changes the level and writes JSON entries from several goroutines, checking
+// every entry is written whole
+func TestLoggerConcurrent(t *testing.T) {
+	logger, err := NewLogger("unit", false, false)
+	if err != nil {
+		t.Fatalf("NewLogger() error = %v", err)
+	}
+	logger.Format = FormatJSON
+	logger.File, err = OpenLogFile(filepath.Join(t.TempDir(), "system-monitoring.log"), LogRotation{})
+	if err != nil {
+		t.Fatalf("OpenLogFile() error = %v", err)
+	}
+	t.Cleanup(func() { _ = logger.File.Close() })
+
+	const writers, entries = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			child := logger.With("writer", i)
+			for j := 0; j < entries; j++ {
+				child.Warnw("entry", "n", j)
+				logger.SetLevel(LevelWarn)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSpace(readLog(t, logger.File.Path())), "\n")
+	if len(lines) != writers*entries {
+		t.Fatalf("%d entries written, want %d", len(lines), writers*entries)
+	}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry["msg"] != "entry" {
+			t.Fatalf("entry %q isn't whole: %v", line, err)
+		}
+	}
+}
+
+// TestLoggerSlog ensures log/slog records are routed through the Logger with groups flattened into keys
+func TestLoggerSlog(t *testing.T) {
+	buf := captureStdout(t)
+	logger := &Logger{LogToStdout: true}
+
+	sl := logger.Slog().WithGroup("relay").With("socket", "/tmp/sock")
+	sl.Debug("hidden")
+	sl.Info("accepted", "bytes", 5)
+
+	if got, want := strings.TrimSpace(buf.String()), "accepted relay.socket=/tmp/sock relay.bytes=5"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,216 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// MetricTag is the tag of payloads holding a typed Metric in its canonical serialization.
+const MetricTag = "metric"
+
+// MetricKind describes how the values of a metric combine.
+type MetricKind string
+
+const (
+	// KindGauge is a value sampled at a point in time, such as CPU utilization.
+	KindGauge MetricKind = "gauge"
+	// KindCounter is a non-negative amount accumulated since the previous sample, such as bytes sent.
+	KindCounter MetricKind = "counter"
+	// KindHistogram is a distribution of values, each with the number of times it was observed.
+	KindHistogram MetricKind = "histogram"
+)
+
+// Units of metrics, named as in CloudWatch so they can be used unchanged.
+const (
+	UnitNone         = "None"
+	UnitPercent      = "Percent"
+	UnitCount        = "Count"
+	UnitBytes        = "Bytes"
+	UnitSeconds      = "Seconds"
+	UnitMilliseconds = "Milliseconds"
+	UnitBytesSecond  = "Bytes/Second"
+)
+
+// Metric is a typed sample. Its canonical serialization is a JSON object with the fields in a fixed order and the
+// dimensions sorted by name, so equal metrics always produce the same data:
+//
+//	{"name":"CPUUtilization","kind":"gauge","value":2.5,"unit":"Percent","dims":{"host":"a"},"ts":1792324800123}
+//
+// Histograms carry values and counts instead of value.
+type Metric struct {
+	Name string
+	Kind MetricKind
+	// Value is the gauge or counter value, unused by histograms.
+	Value float64
+	// Unit is the unit of the values, see UnitPercent and the other Unit constants. Empty means UnitNone.
+	Unit string
+	// Dimensions qualify the metric, for example by device or process.
+	Dimensions map[string]string
+	// Time is when the metric was collected, it is omitted when zero.
+	Time time.Time
+	// Values and Counts are the observed values of a histogram and the number of times each was observed.
+	Values []float64
+	Counts []float64
+}
+
+// metricJSON is the canonical serialization of a Metric.
+type metricJSON struct {
+	Name       string            `json:"name"`
+	Kind       MetricKind        `json:"kind"`
+	Value      *float64          `json:"value,omitempty"`
+	Unit       string            `json:"unit,omitempty"`
+	Dimensions map[string]string `json:"dims,omitempty"`
+	Time       int64             `json:"ts,omitempty"`
+	Values     []float64         `json:"values,omitempty"`
+	Counts     []float64         `json:"counts,omitempty"`
+}
+
+// ErrInvalidMetric is returned for a metric that can't be serialized.
+var ErrInvalidMetric = errors.New("ec2macossystemmonitor: invalid metric")
+
+// Gauge returns a gauge metric collected now.
+func Gauge(name string, value float64, unit string, dimensions map[string]string) Metric {
+	return Metric{Name: name, Kind: KindGauge, Value: value, Unit: unit, Dimensions: dimensions, Time: time.Now()}
+}
+
+// Counter returns a counter metric collected now.
+func Counter(name string, value float64, unit string, dimensions map[string]string) Metric {
+	return Metric{Name: name, Kind: KindCounter, Value: value, Unit: unit, Dimensions: dimensions, Time: time.Now()}
+}
+
+// Validate checks the metric can be serialized, errors wrap ErrInvalidMetric.
+func (m Metric) Validate() error {
+	invalid := func(format string, v ...interface{}) error {
+		return fmt.Errorf("%w %q: %s", ErrInvalidMetric, m.Name, fmt.Sprintf(format, v...))
+	}
+	if m.Name == "" {
+		return invalid("name is empty")
+	}
+	for name := range m.Dimensions {
+		if name == "" {
+			return invalid("dimension name is empty")
+		}
+	}
+	switch m.Kind {
+	case KindGauge, KindCounter:
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			return invalid("value %v isn't finite", m.Value)
+		}
+		if m.Kind == KindCounter && m.Value < 0 {
+			return invalid("counter value %v is negative", m.Value)
+		}
+		if m.Values != nil || m.Counts != nil {
+			return invalid("only histograms have values and counts")
+		}
+	case KindHistogram:
+		if len(m.Values) == 0 || len(m.Values) != len(m.Counts) {
+			return invalid("histogram has %d values and %d counts", len(m.Values), len(m.Counts))
+		}
+		for i, value := range m.Values {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return invalid("value %v isn't finite", value)
+			}
+			if count := m.Counts[i]; math.IsNaN(count) || math.IsInf(count, 0) || count < 0 {
+				return invalid("count %v isn't a finite, non-negative number", count)
+			}
+		}
+	default:
+		return invalid("unknown kind %q", m.Kind)
+	}
+	return nil
+}
+
+// EncodeMetric returns the canonical serialization of m for the data of a payload.
+func EncodeMetric(m Metric) (string, error) {
+	if err := m.Validate(); err != nil {
+		return "", err
+	}
+	mj := metricJSON{
+		Name:       m.Name,
+		Kind:       m.Kind,
+		Unit:       m.Unit,
+		Dimensions: m.Dimensions,
+		Values:     m.Values,
+		Counts:     m.Counts,
+	}
+	if m.Kind != KindHistogram {
+		mj.Value = &m.Value
+	}
+	if !m.Time.IsZero() {
+		mj.Time = m.Time.UnixMilli()
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(mj); err != nil {
+		return "", fmt.Errorf("ec2macossystemmonitor: marshal: %w", err)
+	}
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+// ParseMetric parses the canonical serialization of a metric, the data of a payload tagged MetricTag.
+func ParseMetric(data string) (Metric, error) {
+	var mj metricJSON
+	if err := json.Unmarshal([]byte(data), &mj); err != nil {
+		return Metric{}, fmt.Errorf("%w: %w", ErrInvalidMetric, err)
+	}
+	m := Metric{
+		Name:       mj.Name,
+		Kind:       mj.Kind,
+		Unit:       mj.Unit,
+		Dimensions: mj.Dimensions,
+		Values:     mj.Values,
+		Counts:     mj.Counts,
+	}
+	if mj.Value != nil {
+		m.Value = *mj.Value
+	}
+	if mj.Time != 0 {
+		m.Time = time.UnixMilli(mj.Time)
+	}
+	if err := m.Validate(); err != nil {
+		return Metric{}, err
+	}
+	return m, nil
+}
+
+// Sample returns the metric as a Sample to send under MetricTag, for collectors of typed metrics.
+func (m Metric) Sample() (Sample, error) {
+	data, err := EncodeMetric(m)
+	if err != nil {
+		return Sample{}, err
+	}
+	return Sample{Data: data, Time: m.Time}, nil
+}
+
+// BuildMetric builds the frame for m tagged MetricTag.
+func BuildMetric(m Metric, opts ...MessageOption) ([]byte, error) {
+	data, err := EncodeMetric(m)
+	if err != nil {
+		return nil, err
+	}
+	return BuildMessage(MetricTag, data, false, opts...)
+}
+
+// SendMetric sends m to relayd tagged MetricTag.
+func SendMetric(m Metric, opts ...MessageOption) (n int, err error) {
+	data, err := EncodeMetric(m)
+	if err != nil {
+		return 0, err
+	}
+	return SendMessage(MetricTag, data, false, opts...)
+}
+
+// SendGauge sends a gauge metric collected now to relayd.
+func SendGauge(name string, value float64, unit string, dimensions map[string]string, opts ...MessageOption) (n int, err error) {
+	return SendMetric(Gauge(name, value, unit, dimensions), opts...)
+}
+
+// SendCounter sends a counter metric collected now to relayd.
+func SendCounter(name string, value float64, unit string, dimensions map[string]string, opts ...MessageOption) (n int, err error) {
+	return SendMetric(Counter(name, value, unit, dimensions), opts...)
+}
@@ -0,0 +1,122 @@
+package ec2macossystemmonitor
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestEncodeMetric checks the canonical serialization of each kind and that it parses back to the same metric
+func TestEncodeMetric(t *testing.T) {
+	ts := time.UnixMilli(1792324800123)
+	tests := []struct {
+		name   string
+		metric Metric
+		want   string
+	}{
+		{
+			name:   "gauge",
+			metric: Metric{Name: "CPUUtilization", Kind: KindGauge, Value: 2.5, Unit: UnitPercent, Time: ts},
+			want:   `{"name":"CPUUtilization","kind":"gauge","value":2.5,"unit":"Percent","ts":1792324800123}`,
+		},
+		{
+			name:   "zero gauge",
+			metric: Metric{Name: "Load", Kind: KindGauge},
+			want:   `{"name":"Load","kind":"gauge","value":0}`,
+		},
+		{
+			name:   "counter with dimensions",
+			metric: Metric{Name: "BytesSent", Kind: KindCounter, Value: 1024, Unit: UnitBytes, Dimensions: map[string]string{"sink": "serial", "device": "<ttys0>"}, Time: ts},
+			want:   `{"name":"BytesSent","kind":"counter","value":1024,"unit":"Bytes","dims":{"device":"<ttys0>","sink":"serial"},"ts":1792324800123}`,
+		},
+		{
+			name:   "histogram",
+			metric: Metric{Name: "Latency", Kind: KindHistogram, Unit: UnitMilliseconds, Values: []float64{1, 2.5, 10}, Counts: []float64{4, 1, 2}},
+			want:   `{"name":"Latency","kind":"histogram","unit":"Milliseconds","values":[1,2.5,10],"counts":[4,1,2]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EncodeMetric(tt.metric)
+			if err != nil {
+				t.Fatalf("EncodeMetric() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("EncodeMetric() = %s, want %s", got, tt.want)
+			}
+			parsed, err := ParseMetric(got)
+			if err != nil {
+				t.Fatalf("ParseMetric() error = %v", err)
+			}
+			if !reflect.DeepEqual(parsed, tt.metric) {
+				t.Errorf("ParseMetric() = %+v, want %+v", parsed, tt.metric)
+			}
+		})
+	}
+}
+
+// TestMetricValidate checks metrics that can't be serialized are rejected
+func TestMetricValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric Metric
+	}{
+		{"no name", Metric{Kind: KindGauge}},
+		{"no kind", Metric{Name: "m"}},
+		{"unknown kind", Metric{Name: "m", Kind: "summary"}},
+		{"NaN", Metric{Name: "m", Kind: KindGauge, Value: math.NaN()}},
+		{"infinite", Metric{Name: "m", Kind: KindGauge, Value: math.Inf(1)}},
+		{"negative counter", Metric{Name: "m", Kind: KindCounter, Value: -1}},
+		{"empty dimension name", Metric{Name: "m", Kind: KindGauge, Dimensions: map[string]string{"": "x"}}},
+		{"gauge with values", Metric{Name: "m", Kind: KindGauge, Values: []float64{1}, Counts: []float64{1}}},
+		{"empty histogram", Metric{Name: "m", Kind: KindHistogram}},
+		{"mismatched histogram", Metric{Name: "m", Kind: KindHistogram, Values: []float64{1, 2}, Counts: []float64{1}}},
+		{"negative count", Metric{Name: "m", Kind: KindHistogram, Values: []float64{1}, Counts: []float64{-1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := EncodeMetric(tt.metric); !errors.Is(err, ErrInvalidMetric) {
+				t.Errorf("EncodeMetric() error = %v, want %v", err, ErrInvalidMetric)
+			}
+		})
+	}
+	for _, data := range []string{"2.0", `{"name":"m","kind":"gauge","value":"2"}`, `{"name":"m","kind":"counter","value":-1}`} {
+		if _, err := ParseMetric(data); !errors.Is(err, ErrInvalidMetric) {
+			t.Errorf("ParseMetric(%s) error = %v, want %v", data, err, ErrInvalidMetric)
+		}
+	}
+}
+
+// TestBuildMetric checks a metric frame decodes to a payload tagged MetricTag holding the metric
+func TestBuildMetric(t *testing.T) {
+	metric := Gauge("CPUUtilization", 12.5, UnitPercent, map[string]string{"host": "i-0123456789abcdef0"})
+	frame, err := BuildMetric(metric, WithVersion(ProtocolVersion2))
+	if err != nil {
+		t.Fatalf("BuildMetric() error = %v", err)
+	}
+	msg, err := DecodeMessage(frame)
+	if err != nil {
+		t.Fatalf("DecodeMessage() error = %v", err)
+	}
+	if msg.Tag != MetricTag {
+		t.Errorf("DecodeMessage() tag = %q, want %q", msg.Tag, MetricTag)
+	}
+	got, err := ParseMetric(msg.Data)
+	if err != nil {
+		t.Fatalf("ParseMetric() error = %v", err)
+	}
+	// Times are serialized in milliseconds
+	metric.Time = metric.Time.Truncate(time.Millisecond)
+	if !got.Time.Equal(metric.Time) {
+		t.Errorf("ParseMetric() time = %v, want %v", got.Time, metric.Time)
+	}
+	got.Time = metric.Time
+	if !reflect.DeepEqual(got, metric) {
+		t.Errorf("ParseMetric() = %+v, want %+v", got, metric)
+	}
+	if _, err := BuildMetric(Metric{Name: "m", Kind: KindCounter, Value: -1}); !errors.Is(err, ErrInvalidMetric) {
+		t.Errorf("BuildMetric() with an invalid metric error = %v, want %v", err, ErrInvalidMetric)
+	}
+}
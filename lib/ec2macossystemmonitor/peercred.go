@@ -0,0 +1,334 @@
+package ec2macossystemmonitor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ErrPeerDenied is returned when the policy rejects a connection or frame from a peer.
+var ErrPeerDenied = errors.New("ec2macossystemmonitor: peer denied")
+
+// PeerCredentials identify the process on the other end of a relay connection, as reported by the kernel.
+type PeerCredentials struct {
+	UID uint32
+	// GID is the primary group of the peer.
+	GID uint32
+	// PID is the process id of the peer, 0 if the platform doesn't report it.
+	PID int32
+}
+
+// PeerCredentialsOf returns the credentials of the peer connected to conn, which must be a UNIX socket connection.
+func PeerCredentialsOf(conn net.Conn) (PeerCredentials, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return PeerCredentials{}, fmt.Errorf("ec2macossystemmonitor: %T has no peer credentials", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return PeerCredentials{}, fmt.Errorf("ec2macossystemmonitor: %w", err)
+	}
+	var creds PeerCredentials
+	var credsErr error
+	if err := raw.Control(func(fd uintptr) {
+		creds, credsErr = peerCredentials(int(fd))
+	}); err != nil {
+		return PeerCredentials{}, fmt.Errorf("ec2macossystemmonitor: %w", err)
+	}
+	if credsErr != nil {
+		return PeerCredentials{}, fmt.Errorf("ec2macossystemmonitor: unable to get peer credentials: %w", credsErr)
+	}
+	return creds, nil
+}
+
+// PeerRule allows the peers with a user or group id to send to the relay.
+type PeerRule struct {
+	// ID is the user id of the peers the rule applies to, or their primary group id if Group is set. Supplementary
+	// groups aren't matched since SO_PEERCRED on Linux only reports the primary group.
+	ID    uint32
+	Group bool
+	// Tags are the tags the peers may send, any tag if empty.
+	Tags []string
+	// Rate limits the average bytes per second each user may send, unlimited if zero. Bursts of up to a second of
+	// data are allowed.
+	Rate int
+}
+
+// matches returns true if the rule applies to creds, a group rule only matches the peer's primary group.
+func (r *PeerRule) matches(creds PeerCredentials) bool {
+	if r.Group {
+		return r.ID == creds.GID
+	}
+	return r.ID == creds.UID
+}
+
+// allows returns true if the rule allows tag.
+func (r *PeerRule) allows(tag string) bool {
+	if len(r.Tags) == 0 {
+		return true
+	}
+	for _, t := range r.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns why the rule denies frame, or an empty string if it allows it, along with the tag it was decided by:
+// the tag of the frame or, for a batch, of its first denied entry.
+func (r *PeerRule) check(frame Frame) (tag string, denied string) {
+	if frame.Tag != BatchTag || len(r.Tags) == 0 {
+		if !r.allows(frame.Tag) {
+			return frame.Tag, "tag isn't allowed by " + r.String()
+		}
+		return frame.Tag, ""
+	}
+	tags, err := batchTags(frame.Bytes)
+	if err != nil {
+		return frame.Tag, fmt.Sprintf("batch entries can't be checked: %s", err)
+	}
+	for _, tag := range tags {
+		if !r.allows(tag) {
+			return tag, "batch entry tag isn't allowed by " + r.String()
+		}
+	}
+	return frame.Tag, ""
+}
+
+// String returns the rule as written in a policy file.
+func (r *PeerRule) String() string {
+	who := "user"
+	if r.Group {
+		who = "group"
+	}
+	return fmt.Sprintf("%s:%d", who, r.ID)
+}
+
+// PeerError is returned when the policy rejects a connection or frame.
+type PeerError struct {
+	Peer PeerCredentials
+	// Tag is the tag of the rejected frame, empty for a rejected connection.
+	Tag    string
+	Reason string
+}
+
+func (e *PeerError) Error() string {
+	if e.Tag == "" {
+		return fmt.Sprintf("%s: uid %d gid %d pid %d: %s", ErrPeerDenied, e.Peer.UID, e.Peer.GID, e.Peer.PID, e.Reason)
+	}
+	return fmt.Sprintf("%s: uid %d gid %d pid %d: tag %q: %s", ErrPeerDenied, e.Peer.UID, e.Peer.GID, e.Peer.PID, e.Tag, e.Reason)
+}
+
+// Is allows matching with errors.Is(err, ErrPeerDenied).
+func (e *PeerError) Is(target error) bool {
+	return target == ErrPeerDenied
+}
+
+// PeerPolicyStats counts the connections and frames rejected by a PeerPolicy.
+type PeerPolicyStats struct {
+	// DeniedConnections are connections from peers no rule applies to, or whose credentials couldn't be read.
+	DeniedConnections int64
+	// DeniedFrames are frames from peers no rule applies to, or with a tag the peer may not send.
+	DeniedFrames int64
+	// RateLimitedFrames and RateLimitedBytes are frames dropped for exceeding the peer's rate.
+	RateLimitedFrames int64
+	RateLimitedBytes  int64
+}
+
+// PeerPolicy decides which peers may send to the relay, which tags they may send and how fast. Rules for a user id
+// take precedence over rules for a group id, and otherwise the first matching rule applies. Peers no rule applies to
+// are rejected. It is safe for concurrent use.
+type PeerPolicy struct {
+	rules []PeerRule
+	clock Clock
+
+	mu      sync.Mutex
+	buckets map[uint32]*tokenBucket
+	stats   PeerPolicyStats
+}
+
+// NewPeerPolicy creates a PeerPolicy from rules.
+func NewPeerPolicy(rules ...PeerRule) *PeerPolicy {
+	return &PeerPolicy{
+		rules:   rules,
+		clock:   systemClock{},
+		buckets: make(map[uint32]*tokenBucket),
+	}
+}
+
+// LoadPeerPolicy loads rules from a file that must be owned by root and not writable by group or others. Each line
+// holds a user or group, the comma separated tags it may send, or * for any tag, and its rate in bytes per second, or
+// 0 for unlimited. Users and groups are given by name or id, blank lines and lines starting with # are ignored:
+//
+//	# who          tags             rate
+//	user:root      *                0
+//	group:staff    cpuutil,metric   4096
+func LoadPeerPolicy(path string) (*PeerPolicy, error) {
+	return loadPeerPolicy(path, 0)
+}
+
+// loadPeerPolicy loads rules from a file owned by owner.
+func loadPeerPolicy(path string, owner uint32) (*PeerPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: couldn't open peer policy: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: couldn't stat peer policy: %w", err)
+	}
+	if perm := info.Mode().Perm(); perm&0o022 != 0 {
+		return nil, fmt.Errorf("ec2macossystemmonitor: peer policy %s has mode %#o, it must not be writable by group or others", path, perm)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Uid != owner {
+		return nil, fmt.Errorf("ec2macossystemmonitor: peer policy %s must be owned by uid %d", path, owner)
+	}
+
+	var rules []PeerRule
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rule, err := parsePeerRule(strings.Fields(text))
+		if err != nil {
+			return nil, fmt.Errorf("ec2macossystemmonitor: peer policy %s line %d: %w", path, line, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: couldn't read peer policy: %w", err)
+	}
+	return NewPeerPolicy(rules...), nil
+}
+
+// parsePeerRule parses the fields of a policy file line.
+func parsePeerRule(fields []string) (PeerRule, error) {
+	if len(fields) != 3 {
+		return PeerRule{}, errors.New("want a user or group, tags and rate")
+	}
+	var rule PeerRule
+	kind, name, _ := strings.Cut(fields[0], ":")
+	var id string
+	switch kind {
+	case "user":
+		if u, err := user.Lookup(name); err == nil {
+			id = u.Uid
+		} else {
+			id = name
+		}
+	case "group":
+		rule.Group = true
+		if g, err := user.LookupGroup(name); err == nil {
+			id = g.Gid
+		} else {
+			id = name
+		}
+	default:
+		return PeerRule{}, fmt.Errorf("%q isn't user:<name or id> or group:<name or id>", fields[0])
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return PeerRule{}, fmt.Errorf("unknown %s %q", kind, name)
+	}
+	rule.ID = uint32(n)
+
+	if fields[1] != "*" {
+		rule.Tags = strings.Split(fields[1], ",")
+	}
+	if rule.Rate, err = strconv.Atoi(fields[2]); err != nil || rule.Rate < 0 {
+		return PeerRule{}, fmt.Errorf("invalid rate %q", fields[2])
+	}
+	return rule, nil
+}
+
+// rule returns the rule that applies to creds.
+func (p *PeerPolicy) rule(creds PeerCredentials) (*PeerRule, bool) {
+	for _, group := range []bool{false, true} {
+		for i := range p.rules {
+			if rule := &p.rules[i]; rule.Group == group && rule.matches(creds) {
+				return rule, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Admit checks a peer may connect, returning a *PeerError if no rule applies to it.
+func (p *PeerPolicy) Admit(creds PeerCredentials) error {
+	if _, ok := p.rule(creds); !ok {
+		p.mu.Lock()
+		p.stats.DeniedConnections++
+		p.mu.Unlock()
+		return &PeerError{Peer: creds, Reason: "no rule allows the peer"}
+	}
+	return nil
+}
+
+// Allow checks a peer may send frame, returning a *PeerError if its tag isn't allowed or the peer's user has exceeded
+// its rate. A batch is allowed if the tags of all its entries are, the batch tag itself needn't be allowed.
+func (p *PeerPolicy) Allow(creds PeerCredentials, frame Frame) error {
+	rule, ok := p.rule(creds)
+	tag, n := frame.Tag, len(frame.Bytes)
+	var denied string
+	if ok {
+		tag, denied = rule.check(frame)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case !ok:
+		p.stats.DeniedFrames++
+		return &PeerError{Peer: creds, Tag: tag, Reason: "no rule allows the peer"}
+	case denied != "":
+		p.stats.DeniedFrames++
+		return &PeerError{Peer: creds, Tag: tag, Reason: denied}
+	case rule.Rate == 0:
+		return nil
+	}
+
+	bucket, ok := p.buckets[creds.UID]
+	if !ok || bucket.rate != float64(rule.Rate) {
+		bucket = newTokenBucket(float64(rule.Rate), float64(rule.Rate), p.clock.Now())
+		p.buckets[creds.UID] = bucket
+	}
+	if !bucket.take(float64(n), p.clock.Now()) {
+		p.stats.RateLimitedFrames++
+		p.stats.RateLimitedBytes += int64(n)
+		return &PeerError{Peer: creds, Tag: tag, Reason: fmt.Sprintf("rate of %d bytes per second exceeded", rule.Rate)}
+	}
+	return nil
+}
+
+// Stats returns the number of connections and frames rejected so far.
+func (p *PeerPolicy) Stats() PeerPolicyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Summary is a SummaryFunc logging the connections and frames rejected so far, it is skipped if none were.
+func (p *PeerPolicy) Summary() (string, []any) {
+	stats := p.Stats()
+	if stats == (PeerPolicyStats{}) {
+		return "", nil
+	}
+	return "[relayd] Rejected peers", []any{
+		"denied_connections", stats.DeniedConnections,
+		"denied_frames", stats.DeniedFrames,
+		"rate_limited_frames", stats.RateLimitedFrames,
+		"rate_limited_bytes", stats.RateLimitedBytes,
+	}
+}
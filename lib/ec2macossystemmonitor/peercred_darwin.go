@@ -0,0 +1,21 @@
+package ec2macossystemmonitor
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials reads the credentials of the peer of the UNIX socket fd with LOCAL_PEERCRED and LOCAL_PEERPID.
+func peerCredentials(fd int) (PeerCredentials, error) {
+	cred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return PeerCredentials{}, err
+	}
+	creds := PeerCredentials{UID: cred.Uid}
+	if cred.Ngroups > 0 {
+		creds.GID = cred.Groups[0]
+	}
+	if pid, err := unix.GetsockoptInt(fd, unix.SOL_LOCAL, unix.LOCAL_PEERPID); err == nil {
+		creds.PID = int32(pid)
+	}
+	return creds, nil
+}
@@ -0,0 +1,14 @@
+package ec2macossystemmonitor
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials reads the credentials of the peer of the UNIX socket fd with SO_PEERCRED.
+func peerCredentials(fd int) (PeerCredentials, error) {
+	cred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return PeerCredentials{}, err
+	}
+	return PeerCredentials{UID: cred.Uid, GID: cred.Gid, PID: cred.Pid}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package ec2macossystemmonitor
+
+import (
+	"errors"
+)
+
+// peerCredentials isn't supported on this platform.
+func peerCredentials(fd int) (PeerCredentials, error) {
+	return PeerCredentials{}, errors.New("peer credentials aren't supported on this platform")
+}
@@ -0,0 +1,256 @@
+package ec2macossystemmonitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestPeerCredentialsOf checks the kernel reports this process as the peer of its own connection
+func TestPeerCredentialsOf(t *testing.T) {
+	listener, err := net.Listen("unix", tempSocketPath(t))
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	defer server.Close()
+
+	got, err := PeerCredentialsOf(server)
+	if err != nil {
+		t.Fatalf("PeerCredentialsOf() error = %v", err)
+	}
+	want := PeerCredentials{UID: uint32(os.Getuid()), GID: uint32(os.Getgid()), PID: int32(os.Getpid())}
+	if got != want {
+		t.Errorf("PeerCredentialsOf() = %+v, want %+v", got, want)
+	}
+
+	pipe, _ := net.Pipe()
+	if _, err := PeerCredentialsOf(pipe); err == nil {
+		t.Error("PeerCredentialsOf() of a pipe succeeded")
+	}
+}
+
+// TestPeerPolicy checks rules are matched by user before group, tags are restricted and rates are per user
+func TestPeerPolicy(t *testing.T) {
+	root := PeerCredentials{UID: 0, GID: 0}
+	agent := PeerCredentials{UID: 501, GID: 20}
+	other := PeerCredentials{UID: 502, GID: 20}
+	stranger := PeerCredentials{UID: 1000, GID: 1000}
+	policy := NewPeerPolicy(
+		PeerRule{ID: 20, Group: true, Tags: []string{"cpuutil", "metric"}, Rate: 1000},
+		PeerRule{ID: 0},
+		PeerRule{ID: 501, Tags: []string{"emf"}},
+	)
+	clock := newFakeClock()
+	policy.clock = clock
+
+	steps := []struct {
+		name    string
+		peer    PeerCredentials
+		tag     string
+		n       int
+		advance time.Duration
+		allowed bool
+	}{
+		{"root sends anything", root, "anything", 1 << 20, 0, true},
+		{"user rule before group rule", agent, "emf", 100, 0, true},
+		{"user rule replaces group tags", agent, "cpuutil", 100, 0, false},
+		{"group member", other, "cpuutil", 600, 0, true},
+		{"group member other tag", other, "emf", 10, 0, false},
+		{"within burst", other, "metric", 400, 0, true},
+		{"rate exceeded", other, "metric", 100, 0, false},
+		{"refilled", other, "metric", 100, 100 * time.Millisecond, true},
+		{"larger than burst once full", other, "metric", 5000, time.Second, true},
+		{"in debt", other, "metric", 1, 2 * time.Second, false},
+		{"stranger", stranger, "cpuutil", 10, 0, false},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		err := policy.Allow(step.peer, Frame{Tag: step.tag, Bytes: make([]byte, step.n)})
+		if step.allowed && err != nil {
+			t.Errorf("%s: Allow() error = %v", step.name, err)
+		}
+		if !step.allowed && !errors.Is(err, ErrPeerDenied) {
+			t.Errorf("%s: Allow() error = %v, want %v", step.name, err, ErrPeerDenied)
+		}
+	}
+
+	if err := policy.Admit(agent); err != nil {
+		t.Errorf("Admit() error = %v", err)
+	}
+	if err := policy.Admit(stranger); !errors.Is(err, ErrPeerDenied) {
+		t.Errorf("Admit() of a stranger error = %v, want %v", err, ErrPeerDenied)
+	}
+	want := PeerPolicyStats{DeniedConnections: 1, DeniedFrames: 3, RateLimitedFrames: 2, RateLimitedBytes: 101}
+	if got := policy.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+// TestPeerPolicySummary checks the summary is skipped until a peer is rejected and frames refused by no rule matching
+// aren't counted as connections
+func TestPeerPolicySummary(t *testing.T) {
+	policy := NewPeerPolicy(PeerRule{ID: 0})
+	if msg, _ := policy.Summary(); msg != "" {
+		t.Errorf("Summary() = %q before any rejection, want it skipped", msg)
+	}
+	_ = policy.Allow(PeerCredentials{UID: 501, GID: 20}, Frame{Tag: "cpuutil", Bytes: []byte("1")})
+	msg, args := policy.Summary()
+	want := []any{"denied_connections", int64(0), "denied_frames", int64(1), "rate_limited_frames", int64(0), "rate_limited_bytes", int64(0)}
+	if msg == "" || !reflect.DeepEqual(args, want) {
+		t.Errorf("Summary() = %q %v, want %v", msg, args, want)
+	}
+}
+
+// TestPeerPolicyBatches checks the entries of a batch are checked against the rule's tags
+func TestPeerPolicyBatches(t *testing.T) {
+	peer := PeerCredentials{UID: 501, GID: 20}
+	batch := func(tags ...string) Frame {
+		t.Helper()
+		var entries []BatchEntry
+		for _, tag := range tags {
+			entries = append(entries, BatchEntry{Tag: tag, Data: "2.0"})
+		}
+		frame, err := BuildBatch(entries, WithAutoCompression(1))
+		if err != nil {
+			t.Fatalf("BuildBatch() error = %v", err)
+		}
+		return Frame{Tag: BatchTag, Bytes: frame}
+	}
+
+	tests := []struct {
+		name    string
+		tags    []string
+		frame   Frame
+		allowed bool
+	}{
+		{"allowed entries", []string{"cpuutil", "emf"}, batch("cpuutil", "emf"), true},
+		{"denied entry", []string{"cpuutil"}, batch("cpuutil", "emf"), false},
+		{"batch tag allows nothing", []string{BatchTag}, batch("emf"), false},
+		{"any tag", nil, batch("emf"), true},
+		{"unreadable batch", []string{"cpuutil"}, Frame{Tag: BatchTag, Bytes: []byte("not a batch\n")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := NewPeerPolicy(PeerRule{ID: peer.UID, Tags: tt.tags})
+			err := policy.Allow(peer, tt.frame)
+			if tt.allowed && err != nil {
+				t.Errorf("Allow() error = %v", err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrPeerDenied) {
+				t.Errorf("Allow() error = %v, want %v", err, ErrPeerDenied)
+			}
+		})
+	}
+}
+
+// TestLoadPeerPolicy checks policy files are parsed and insecure or invalid files are rejected
+func TestLoadPeerPolicy(t *testing.T) {
+	owner := uint32(os.Getuid())
+	write := func(t *testing.T, content string, mode os.FileMode) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "peers")
+		if err := os.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatalf("Chmod() error = %v", err)
+		}
+		return path
+	}
+
+	path := write(t, "# who tags rate\n\nuser:0 * 0\ngroup:20 cpuutil,metric 4096\n  user:501   emf 10\n", 0o644)
+	policy, err := loadPeerPolicy(path, owner)
+	if err != nil {
+		t.Fatalf("loadPeerPolicy() error = %v", err)
+	}
+	want := []PeerRule{
+		{ID: 0},
+		{ID: 20, Group: true, Tags: []string{"cpuutil", "metric"}, Rate: 4096},
+		{ID: 501, Tags: []string{"emf"}, Rate: 10},
+	}
+	if !reflect.DeepEqual(policy.rules, want) {
+		t.Errorf("loadPeerPolicy() rules = %+v, want %+v", policy.rules, want)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		mode    os.FileMode
+	}{
+		{"group writable", "user:0 * 0\n", 0o664},
+		{"missing field", "user:0 *\n", 0o600},
+		{"unknown kind", "pid:1 * 0\n", 0o600},
+		{"unknown user", "user:no-such-user-ec2sm * 0\n", 0o600},
+		{"negative rate", "user:0 * -1\n", 0o600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadPeerPolicy(write(t, tt.content, tt.mode), owner); err == nil {
+				t.Error("loadPeerPolicy() succeeded")
+			}
+		})
+	}
+	if _, err := loadPeerPolicy(write(t, "user:0 * 0\n", 0o600), owner+1); err == nil {
+		t.Error("loadPeerPolicy() of a file owned by another user succeeded")
+	}
+}
+
+// TestRelayPeerPolicy checks the relay enforces the policy using the credentials of real connections
+func TestRelayPeerPolicy(t *testing.T) {
+	self := uint32(os.Getuid())
+	tests := []struct {
+		name   string
+		rules  []PeerRule
+		want   []string
+		denied PeerPolicyStats
+	}{
+		{"allowed tags", []PeerRule{{ID: self, Tags: []string{"cpuutil"}}}, []string{"cpuutil", "cpuutil"}, PeerPolicyStats{DeniedFrames: 1}},
+		{"group rule", []PeerRule{{ID: uint32(os.Getgid()), Group: true}}, []string{"cpuutil", "emf", "cpuutil"}, PeerPolicyStats{}},
+		{"no rule", []PeerRule{{ID: self + 1}}, nil, PeerPolicyStats{DeniedConnections: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			path := tempSocketPath(t)
+			sink := &memorySink{name: tt.name}
+			policy := NewPeerPolicy(tt.rules...)
+			startRelay(t, path, sink, func(relay *SerialRelay) { relay.SetPeerPolicy(policy) })
+
+			client := NewClient(WithSocketPath(path))
+			for i, tag := range []string{"cpuutil", "emf", "cpuutil"} {
+				// A rejected connection may be closed before the client has written
+				_, _ = client.Send(context.Background(), tag, fmt.Sprint(i))
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) {
+				stats := policy.Stats()
+				if len(sink.tags())+int(stats.DeniedConnections+stats.DeniedFrames) >= 3 {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if got := sink.tags(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("relayed tags = %q, want %q", got, tt.want)
+			}
+			if got := policy.Stats(); got != tt.denied {
+				t.Errorf("Stats() = %+v, want %+v", got, tt.denied)
+			}
+		})
+	}
+}
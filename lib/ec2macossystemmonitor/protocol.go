@@ -0,0 +1,257 @@
+package ec2macossystemmonitor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Wire protocol versions.
+//
+// Version 1 is the original format: a SerialMessage with only csum and payload, where the payload holds the tag,
+// compress flag and data. Version 1 messages have no "v" field so they are byte for byte identical to messages
+// written before versioning was introduced.
+//
+// Version 2 adds "v":2 to the envelope and allows additional fields in the payload: metadata, a collection timestamp,
+// a producer identifier, a per-source sequence number, the message id and part numbers of fragments and the codec of
+// compressed data. The envelope may also name a checksum algorithm other than Adler-32 and carry an HMAC-SHA256 of the
+// payload with the id of the key used.
+//
+// Readers must treat the version as follows:
+//   - A missing "v" field means version 1.
+//   - A version newer than MaxProtocolVersion must be rejected with ErrUnsupportedVersion. The frame is skipped and
+//     reading continues with the next frame.
+//   - Unknown fields in the envelope or payload must be ignored, new optional fields may be added to a version
+//     without changing it. Changes that alter the meaning of existing fields require a new version.
+const (
+	ProtocolVersion1 = 1
+	ProtocolVersion2 = 2
+
+	// MaxProtocolVersion is the newest version this package reads and writes.
+	MaxProtocolVersion = ProtocolVersion2
+)
+
+// MessageOption configures optional features of messages built by BuildMessage.
+type MessageOption func(*messageOptions)
+
+// messageOptions are the options collected from MessageOption values.
+type messageOptions struct {
+	// version is the requested version, 0 selects the lowest version supporting the other options.
+	version  int
+	meta     map[string]string
+	time     time.Time
+	producer string
+	source   string
+	seq      uint64
+	// maxFrameSize limits the size of built frames, 0 for no limit.
+	maxFrameSize int
+	// codec overrides the compress argument when set.
+	codec Codec
+	// level is the compression level if levelSet, otherwise the codec's default is used.
+	level    int
+	levelSet bool
+	// auto enables automatic compression of data of at least autoThreshold bytes.
+	auto          bool
+	autoThreshold int
+	checksum      ChecksumAlgorithm
+	encoding      Encoding
+	// keys signs the message with its current key when set.
+	keys *Keyring
+}
+
+// WithVersion sets the protocol version of the message. By default the lowest version supporting the other options
+// is used, which is version 1 unless version 2 features are requested.
+func WithVersion(version int) MessageOption {
+	return func(o *messageOptions) {
+		o.version = version
+	}
+}
+
+// WithMetadata adds a key/value pair to the payload metadata, this requires version 2.
+func WithMetadata(key, value string) MessageOption {
+	return func(o *messageOptions) {
+		if o.meta == nil {
+			o.meta = make(map[string]string)
+		}
+		o.meta[key] = value
+	}
+}
+
+// WithTimestamp sets the collection time of the data, this requires version 2.
+func WithTimestamp(t time.Time) MessageOption {
+	return func(o *messageOptions) {
+		o.time = t
+	}
+}
+
+// WithProducer sets the identifier of the host or process building the message, this requires version 2.
+func WithProducer(producer string) MessageOption {
+	return func(o *messageOptions) {
+		o.producer = producer
+	}
+}
+
+// WithSequence sets the sequence number of the message within source, this requires version 2. Sequence numbers
+// start at 1 and increase by one for each message from the source so readers can detect gaps and reordering.
+func WithSequence(source string, seq uint64) MessageOption {
+	return func(o *messageOptions) {
+		o.source = source
+		o.seq = seq
+	}
+}
+
+// WithMaxFrameSize limits the size in bytes of each frame, including the trailing newline. BuildMessage fails for
+// larger messages while BuildMessages splits them into fragments.
+func WithMaxFrameSize(size int) MessageOption {
+	return func(o *messageOptions) {
+		o.maxFrameSize = size
+	}
+}
+
+// apply sets the version 2 payload fields from the options.
+func (o *messageOptions) apply(payload *SerialPayload) {
+	payload.Meta = o.meta
+	if !o.time.IsZero() {
+		payload.Time = o.time.UnixMilli()
+	}
+	payload.Producer = o.producer
+	payload.Source = o.source
+	payload.Seq = o.seq
+}
+
+// resolveVersion returns the version to write, or an error if the options need a newer version than requested.
+func (o *messageOptions) resolveVersion() (int, error) {
+	required := ProtocolVersion1
+	if len(o.meta) > 0 || !o.time.IsZero() || o.producer != "" || o.source != "" || o.seq != 0 {
+		required = ProtocolVersion2
+	}
+	if o.keys != nil {
+		required = ProtocolVersion2
+	}
+	switch o.encoding {
+	case "", EncodingJSON:
+	case EncodingCBOR:
+		required = ProtocolVersion2
+	default:
+		return 0, fmt.Errorf("ec2macossystemmonitor: unknown encoding %q", o.encoding)
+	}
+	switch o.checksum {
+	case "", ChecksumAdler32:
+	case ChecksumCRC32C:
+		required = ProtocolVersion2
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnknownChecksum, o.checksum)
+	}
+	switch o.codec {
+	case "", CodecNone, CodecZlib:
+	case CodecGzip, CodecZstd, CodecSnappy:
+		required = ProtocolVersion2
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnknownCodec, o.codec)
+	}
+	switch {
+	case o.version == 0:
+		return required, nil
+	case o.version > MaxProtocolVersion || o.version < ProtocolVersion1:
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, o.version)
+	case o.version < required:
+		return 0, fmt.Errorf("ec2macossystemmonitor: message options require protocol version %d, %d requested", required, o.version)
+	}
+	return o.version, nil
+}
+
+// Stamper stamps messages from a producer with collection timestamps and per-source sequence numbers. It is safe
+// for concurrent use.
+//
+// Timestamps are monotonic-safe: they are derived from the wall clock when the Stamper was created plus the monotonic
+// time elapsed since, so a wall clock step (eg: NTP adjusting the clock) can't make timestamps go backwards.
+type Stamper struct {
+	producer string
+	base     time.Time
+
+	mu   sync.Mutex
+	seqs map[string]uint64
+}
+
+// NewStamper creates a Stamper for producer.
+func NewStamper(producer string) *Stamper {
+	return &Stamper{
+		producer: producer,
+		base:     time.Now(),
+		seqs:     make(map[string]uint64),
+	}
+}
+
+// Timestamp converts t, which should come from time.Now, to a monotonic-safe wall clock time.
+func (s *Stamper) Timestamp(t time.Time) time.Time {
+	return s.base.Add(t.Sub(s.base)).Round(0)
+}
+
+// Next returns the next sequence number for source.
+func (s *Stamper) Next(source string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seqs[source]++
+	return s.seqs[source]
+}
+
+// Stamp returns the options for the next message from source collected at collected, or now if collected is zero.
+func (s *Stamper) Stamp(source string, collected time.Time) []MessageOption {
+	if collected.IsZero() {
+		collected = time.Now()
+	}
+	return []MessageOption{
+		WithProducer(s.producer),
+		WithTimestamp(s.Timestamp(collected)),
+		WithSequence(source, s.Next(source)),
+	}
+}
+
+// SequenceStatus is the result of checking a message's sequence number with a SequenceTracker.
+type SequenceStatus struct {
+	// Missing is the number of messages skipped between the previous message from the source and this one.
+	Missing uint64
+	// Reordered is true if the message arrived after a later message from the same source, or is a duplicate.
+	Reordered bool
+	// Restarted is true if the sequence started again at 1, typically because the producer restarted.
+	Restarted bool
+}
+
+// SequenceTracker detects gaps and reordering in decoded messages using their producer, source and sequence number.
+// Messages without a sequence number are ignored, as are fragments after the first since they share its sequence number.
+type SequenceTracker struct {
+	last map[sequenceKey]uint64
+}
+
+// sequenceKey identifies an independent sequence.
+type sequenceKey struct {
+	producer string
+	source   string
+}
+
+// NewSequenceTracker creates an empty SequenceTracker.
+func NewSequenceTracker() *SequenceTracker {
+	return &SequenceTracker{last: make(map[sequenceKey]uint64)}
+}
+
+// Observe records the sequence number of msg and reports how it relates to the previous message from its source.
+func (t *SequenceTracker) Observe(msg *Message) SequenceStatus {
+	if msg.Seq == 0 || msg.Part > 1 {
+		return SequenceStatus{}
+	}
+	key := sequenceKey{producer: msg.Producer, source: msg.Source}
+	last, seen := t.last[key]
+	switch {
+	case !seen:
+		t.last[key] = msg.Seq
+		return SequenceStatus{}
+	case msg.Seq == 1 && last > 1:
+		t.last[key] = msg.Seq
+		return SequenceStatus{Restarted: true}
+	case msg.Seq <= last:
+		return SequenceStatus{Reordered: true}
+	}
+	t.last[key] = msg.Seq
+	return SequenceStatus{Missing: msg.Seq - last - 1}
+}
@@ -0,0 +1,222 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// updateGolden rewrites the golden files from the current BuildMessage output, use with care since the golden files
+// lock the wire format.
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// goldenKeyring signs the golden messages.
+var goldenKeyring, _ = NewKeyring(Key{ID: "golden-1", Secret: []byte("0123456789abcdef0123456789abcdef")})
+
+// TestProtocolGolden locks the bytes written for each protocol version. Uncompressed messages must match exactly.
+// Compressed data depends on the zlib implementation of the Go toolchain, so those messages must instead decode to the
+// same payload as the golden file, which also checks that previously written messages remain readable.
+func TestProtocolGolden(t *testing.T) {
+	tests := []struct {
+		name     string
+		tag      string
+		data     string
+		compress bool
+		opts     []MessageOption
+	}{
+		{"v1_empty", "test", "", false, nil},
+		{"v1_empty_compressed", "test", "", true, nil},
+		{"v1_cpuutil", "cpuutil", "2.0", false, nil},
+		{"v1_cpuutil_compressed", "cpuutil", "2.0", true, nil},
+		{"v1_explicit", "cpuutil", "2.0", false, []MessageOption{WithVersion(ProtocolVersion1)}},
+		{"v2_cpuutil", "cpuutil", "2.0", false, []MessageOption{WithVersion(ProtocolVersion2)}},
+		{"v2_metadata", "cpuutil", "2.0", false, []MessageOption{WithMetadata("instance", "i-0123456789abcdef0"), WithMetadata("agent", "cpuutilization")}},
+		{"v2_metadata_compressed", "cpuutil", "2.0", true, []MessageOption{WithMetadata("instance", "i-0123456789abcdef0")}},
+		{"v2_gzip_compressed", "cpuutil", "2.0", true, []MessageOption{WithCodec(CodecGzip)}},
+		{"v2_zstd_compressed", "cpuutil", "2.0", true, []MessageOption{WithCodec(CodecZstd)}},
+		{"v2_snappy_compressed", "cpuutil", "2.0", true, []MessageOption{WithCodec(CodecSnappy)}},
+		{"v2_crc32c", "cpuutil", "2.0", false, []MessageOption{WithChecksum(ChecksumCRC32C)}},
+		{"v2_signed", "cpuutil", "2.0", false, []MessageOption{WithChecksum(ChecksumCRC32C), SignWith(goldenKeyring)}},
+		{"v2_cbor_stamped", "cpuutil", "2.0", false, []MessageOption{WithEncoding(EncodingCBOR), WithProducer("i-0123456789abcdef0"), WithTimestamp(time.UnixMilli(1792324800123)), WithSequence("cpuutil", 42)}},
+		{"v2_cbor_compressed", "cpuutil", "2.0", true, []MessageOption{WithEncoding(EncodingCBOR)}},
+		{"v2_stamped", "cpuutil", "2.0", false, []MessageOption{WithProducer("i-0123456789abcdef0"), WithTimestamp(time.UnixMilli(1792324800123)), WithSequence("cpuutil", 42)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BuildMessage(tt.tag, tt.data, tt.compress, tt.opts...)
+			if err != nil {
+				t.Fatalf("BuildMessage() error = %v", err)
+			}
+			golden := filepath.Join("testdata", "protocol", tt.name+".golden")
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatalf("WriteFile() error = %v", err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+
+			if !tt.compress {
+				if !bytes.Equal(got, want) {
+					t.Errorf("BuildMessage() got = %s, want %s", got, want)
+				}
+				return
+			}
+			gotMsg, err := DecodeMessage(got)
+			if err != nil {
+				t.Fatalf("DecodeMessage() of built message error = %v", err)
+			}
+			wantMsg, err := DecodeMessage(want)
+			if err != nil {
+				t.Fatalf("DecodeMessage() of golden message error = %v", err)
+			}
+			if !reflect.DeepEqual(gotMsg, wantMsg) {
+				t.Errorf("decoded message = %+v, want %+v", gotMsg, wantMsg)
+			}
+		})
+	}
+}
+
+// TestDecodeMessage covers the reader rules for versions, unknown fields and checksums
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   string
+		want    *Message
+		wantErr error
+	}{
+		{
+			"Missing Version Is 1",
+			`{"csum":2118192950,"payload":"{\"tag\":\"cpuutil\",\"compress\":false,\"data\":\"2.0\"}"}`,
+			&Message{Version: 1, SerialPayload: SerialPayload{Tag: "cpuutil", Data: "2.0"}},
+			nil,
+		},
+		{
+			"Unknown Fields Ignored",
+			`{"v":2,"csum":955388588,"payload":"{\"tag\":\"cpuutil\",\"compress\":false,\"data\":\"2.0\",\"future\":1}","later":true}`,
+			&Message{Version: 2, SerialPayload: SerialPayload{Tag: "cpuutil", Data: "2.0"}},
+			nil,
+		},
+		{
+			"Unknown Version",
+			`{"v":3,"csum":2118192950,"payload":"{\"tag\":\"cpuutil\",\"compress\":false,\"data\":\"2.0\"}"}`,
+			nil,
+			ErrUnsupportedVersion,
+		},
+		{
+			"Checksum Mismatch",
+			`{"csum":1,"payload":"{\"tag\":\"cpuutil\",\"compress\":false,\"data\":\"2.0\"}"}`,
+			nil,
+			ErrChecksumMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeMessage([]byte(tt.frame))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DecodeMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeMessage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestBuildMessageVersion checks invalid version options are rejected
+func TestBuildMessageVersion(t *testing.T) {
+	if _, err := BuildMessage("test", "", false, WithVersion(3)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("BuildMessage() with version 3 error = %v, want %v", err, ErrUnsupportedVersion)
+	}
+	if _, err := BuildMessage("test", "", false, WithVersion(1), WithMetadata("k", "v")); err == nil {
+		t.Error("BuildMessage() with version 1 and metadata succeeded")
+	}
+}
+
+// TestStamper checks timestamps never go backwards and sequences are independent per source
+func TestStamper(t *testing.T) {
+	s := NewStamper("host")
+	var last time.Time
+	for i := 0; i < 100; i++ {
+		ts := s.Timestamp(time.Now())
+		if ts.Before(last) {
+			t.Fatalf("Timestamp() went backwards: %s before %s", ts, last)
+		}
+		last = ts
+	}
+	for source, want := range map[string][]uint64{"a": {1, 2, 3}, "b": {1, 2, 3}} {
+		for _, seq := range want {
+			if got := s.Next(source); got != seq {
+				t.Errorf("Next(%q) = %d, want %d", source, got, seq)
+			}
+		}
+	}
+}
+
+// TestSequenceGaps builds a stream of stamped messages, drops and reorders some, then checks the reference decoder
+// and SequenceTracker detect them
+func TestSequenceGaps(t *testing.T) {
+	stamper := NewStamper("i-0123456789abcdef0")
+	var frames [][]byte
+	for i := 0; i < 10; i++ {
+		source := "cpuutil"
+		if i%2 == 1 {
+			source = "other"
+		}
+		frame, err := BuildMessage(source, "x", false, stamper.Stamp(source, time.Now())...)
+		if err != nil {
+			t.Fatalf("BuildMessage() error = %v", err)
+		}
+		frames = append(frames, frame)
+	}
+	// cpuutil is sent as sequences 1-5 in even frames, other as 1-5 in odd frames. Drop cpuutil 3 and swap other
+	// 4 and 5.
+	received := [][]byte{frames[0], frames[1], frames[2], frames[3], frames[5], frames[6], frames[9], frames[7], frames[8]}
+
+	tracker := NewSequenceTracker()
+	var missing uint64
+	var reordered int
+	for _, frame := range received {
+		msg, err := DecodeMessage(frame)
+		if err != nil {
+			t.Fatalf("DecodeMessage() error = %v", err)
+		}
+		if msg.Producer != "i-0123456789abcdef0" || msg.Timestamp().IsZero() {
+			t.Errorf("decoded message is missing stamps: %+v", msg)
+		}
+		status := tracker.Observe(msg)
+		missing += status.Missing
+		if status.Reordered {
+			reordered++
+		}
+	}
+	// cpuutil 3 is missing, other 4 is first reported missing when 5 arrives and then arrives late.
+	if missing != 2 {
+		t.Errorf("missing = %d, want 2", missing)
+	}
+	if reordered != 1 {
+		t.Errorf("reordered = %d, want 1", reordered)
+	}
+
+	restart, _ := DecodeMessage(mustBuild(t, "cpuutil", WithProducer("i-0123456789abcdef0"), WithSequence("cpuutil", 1)))
+	if status := tracker.Observe(restart); !status.Restarted {
+		t.Errorf("Observe() of sequence 1 = %+v, want a restart", status)
+	}
+}
+
+// mustBuild builds a message with options or fails the test.
+func mustBuild(t *testing.T, tag string, opts ...MessageOption) []byte {
+	t.Helper()
+	frame, err := BuildMessage(tag, "", false, opts...)
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	return frame
+}
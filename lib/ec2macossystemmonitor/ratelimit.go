@@ -0,0 +1,47 @@
+package ec2macossystemmonitor
+
+import (
+	"math"
+	"time"
+)
+
+// tokenBucket allows an average of rate tokens per second with bursts of up to burst tokens. Requests larger than the
+// burst are allowed once the bucket is full and put it into debt, so they are still limited to the average rate. It is
+// not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full tokenBucket.
+func newTokenBucket(rate float64, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// take removes n tokens at now, returning false without removing any if there aren't enough.
+func (b *tokenBucket) take(n float64, now time.Time) bool {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens < min(n, b.burst) {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// wait returns how long until n tokens can be taken at now, 0 if they can be taken already.
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	tokens := b.tokens
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		tokens = min(b.burst, tokens+elapsed.Seconds()*b.rate)
+	}
+	need := min(n, b.burst) - tokens
+	if need <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(need / b.rate * float64(time.Second)))
+}
@@ -2,24 +2,27 @@ package ec2macossystemmonitor
 
 import (
 	"bytes"
-	"compress/zlib"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"hash/adler32"
+	"io"
 	"net"
-	"os"
-	"sync/atomic"
 	"time"
 )
 
 const SocketTimeout = 5 * time.Second
 
-// DefaultRelaydSocketPath is the default socket for relayd listener.
-const DefaultRelaydSocketPath = "/tmp/.ec2monitoring.sock"
+// maxConnectionFrames is the number of frames of the maximum length the relay reads from one connection, a connection
+// sending more is dropped.
+const maxConnectionFrames = 64
+
+// DefaultRelaydSocketPath is the default socket for relayd listener. Releases before the socket directory was
+// checked used LegacyRelaydSocketPath, which the relay links to this path for a deprecation period.
+const DefaultRelaydSocketPath = "/var/run/ec2monitoring/relayd.sock"
 
 // CheckSocketExists is a helper function to quickly check if the service UDS
-// exists.
+// at socketPath exists.
 func CheckSocketExists(socketPath string) (exists bool) {
 	return fileExists(socketPath)
 }
@@ -29,33 +32,61 @@ func CheckSocketExists(socketPath string) (exists bool) {
 // The tag is used as a way to namespace various payloads that are supported. Data is the payload and its format is
 // specific to each tag. Each payload has the option to be compressed and this flag is part of the envelope created for
 // sending data. The slice of bytes is passed back to the caller to allow flexibility to log the bytes if desired before
-// passing to the relay via PassToRelayd
-func BuildMessage(tag string, data string, compress bool) ([]byte, error) {
+// passing to the relay via PassToRelayd. Options select the protocol version and version 2 features, without options
+// a version 1 message is built.
+func BuildMessage(tag string, data string, compress bool, opts ...MessageOption) ([]byte, error) {
+	var options messageOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	payload, version, err := buildPayload(tag, data, compress, &options)
+	if err != nil {
+		return nil, err
+	}
+
+	messageBytes, err := buildFrame(payload, version, &options)
+	if err != nil {
+		return nil, err
+	}
+	if options.maxFrameSize > 0 && len(messageBytes) > options.maxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit is %d, use BuildMessages to split it", ErrFrameTooLarge, len(messageBytes), options.maxFrameSize)
+	}
+	return messageBytes, nil
+}
+
+// buildPayload builds the payload for tag and data with options, compressing the data if requested, and returns it
+// with the protocol version to write it with.
+func buildPayload(tag string, data string, compress bool, options *messageOptions) (SerialPayload, int, error) {
+	version, err := options.resolveVersion()
+	if err != nil {
+		return SerialPayload{}, 0, err
+	}
+
 	payload := SerialPayload{
-		Tag: tag,
-		Compress: compress,
+		Tag:  tag,
 		Data: data,
 	}
+	options.apply(&payload)
 
-	// This determines if the data will be passed in as provided or zlib compressed and then base64 encoded
+	// This determines if the data will be passed in as provided or compressed and then base64 encoded
 	// Some payload will exceed the limit of what can be sent on the serial device, so compression allows more data
 	// to be sent. base64 encoding allows safe characters only to be passed on the device
-	if compress {
-		var b bytes.Buffer
-		w, err := zlib.NewWriterLevel(&b, 9)
-		if err != nil {
-			return nil, fmt.Errorf("ec2macossystemmonitor: couldn't get compression writer: %w", err)
-		}
-		_, err = w.Write([]byte(data))
-		if err != nil {
-			return nil, fmt.Errorf("ec2macossystemmonitor: couldn't copy compressed data: %w", err)
-		}
-		err = w.Close()
-		if err != nil {
-			return nil, fmt.Errorf("ec2macossystemmonitor: couldn't close compressor: %w", err)
-		}
+	codec, err := options.encodeData(&payload, compress)
+	if err != nil {
+		return SerialPayload{}, 0, err
+	}
+	payload.Compress = codec != CodecNone
+	// zlib is implied by the compress flag so messages stay readable by version 1 readers
+	if codec != CodecNone && codec != CodecZlib {
+		payload.Codec = codec
+	}
+	return payload, version, nil
+}
 
-		payload.Data = base64.StdEncoding.EncodeToString(b.Bytes())
+// buildFrame wraps an already encoded payload in the envelope for version.
+func buildFrame(payload SerialPayload, version int, options *messageOptions) ([]byte, error) {
+	if options.encoding == EncodingCBOR {
+		return buildBinaryFrame(payload, version, options)
 	}
 
 	// Marshal the payload to wrap in the relay output message.
@@ -64,10 +95,11 @@ func BuildMessage(tag string, data string, compress bool) ([]byte, error) {
 		return nil, fmt.Errorf("ec2macossystemmonitor: %w", err)
 	}
 
-	messageBytes, err := json.Marshal(SerialMessage{
-		Checksum: adler32.Checksum(payloadBytes),
-		Payload:  string(payloadBytes),
-	})
+	message, err := options.seal(payloadBytes, version)
+	if err != nil {
+		return nil, err
+	}
+	messageBytes, err := json.Marshal(message)
 	if err != nil {
 		return nil, fmt.Errorf("ec2macossystemmonitor: marshal: %w", err)
 	}
@@ -79,48 +111,52 @@ func BuildMessage(tag string, data string, compress bool) ([]byte, error) {
 	return messageBytes, nil
 }
 
-// PassToRelayd takes a byte slice and writes it to a UNIX socket to send for relaying.
+// PassToRelayd takes a byte slice and writes it to a UNIX socket to send for relaying. It writes with a default Client,
+// use a Client to set the socket path, timeouts or retries.
 func PassToRelayd(messageBytes []byte) (n int, err error) {
-	// Make sure we have socket to connect to.
-	if !fileExists(DefaultRelaydSocketPath) {
-		return 0, fmt.Errorf("ec2macossystemmonitor: %s does not exist, cannot send message: %s", DefaultRelaydSocketPath, string(messageBytes))
-	}
-
-	// Connect and relay!
-	sock, err := net.Dial("unix", DefaultRelaydSocketPath)
-	if err != nil {
-		return 0, fmt.Errorf("cec2macossystemmonitor: could not connect to %s: %s", DefaultRelaydSocketPath, err)
-	}
-	defer sock.Close()
-
-	n, err = sock.Write(messageBytes)
-	if err != nil {
-		return n, fmt.Errorf("ec2macossystemmonitor: error while writing to socket: %s", err)
-	}
-
-	return n, nil
+	return defaultClient.Write(context.Background(), messageBytes)
 }
 
 // SendMessage takes a tag along with data for the tag and writes to a UNIX socket to send for relaying. This is provided
-// for convenience to allow quick sending of data to the relay. It calls BuildMessage and then PassToRelayd in order.
-func SendMessage(tag string, data string, compress bool) (n int, err error) {
-	msgBytes, err := BuildMessage(tag, data, compress)
-	if err != nil {
-		return 0, fmt.Errorf("ec2macossystemmonitor: error while building message bytes: %w", err)
-	}
-
-	return PassToRelayd(msgBytes)
+// for convenience to allow quick sending of data to the relay. It calls BuildMessages and then PassToRelayd in order,
+// data is only split into fragments if a frame size is given with WithMaxFrameSize.
+func SendMessage(tag string, data string, compress bool, opts ...MessageOption) (n int, err error) {
+	return defaultClient.SendMessage(context.Background(), tag, data, compress, opts...)
 }
 
 // SerialRelay manages client & listener to relay recieved messages to a serial
-// connection.
+// connection and any additional sinks.
 type SerialRelay struct {
-	// serialConnection is the managed serial device connection for writing
-	// (ie: relayed output).
-	serialConnection *SerialConnection
+	// sinks are the destinations for relayed frames, the serial device
+	// connection is first when the relay has one.
+	sinks []sinkRoute
+	// serial is true if the first sink is the serial device.
+	serial bool
+	// port is the serial device connection, nil without a serial device.
+	port *SerialConnection
+	// scheduler shares the serial device between tags, nil unless Schedule
+	// was called.
+	scheduler *SchedulingSink
+	// queued are the sinks added with AddSink, written in the background.
+	queued []*QueueingSink
 	// listener handles connections to relay received messages to the configured
-	// serialConnection.
+	// sinks.
 	listener net.Listener
+	// socketPath is the UNIX socket the listener is bound to, removed by
+	// CleanUp.
+	socketPath string
+	// legacyPath is the link to socketPath for clients of earlier releases,
+	// removed by CleanUp, empty if there is none.
+	legacyPath string
+	// peers decides which peers may send which tags, all peers may send any
+	// tag if nil.
+	peers *PeerPolicy
+	// validator drops invalid frames before they are written to the sinks,
+	// frames aren't checked if nil.
+	validator *FrameValidator
+	// readTimeout bounds reading a connection so a peer that doesn't close
+	// it can't hold up the relay, SocketTimeout if zero.
+	readTimeout time.Duration
 	// ReadyToClose is the channel for communicating the need to close
 	// connections.
 	//
@@ -128,52 +164,143 @@ type SerialRelay struct {
 	ReadyToClose chan bool
 }
 
-// NewRelay creates an instance of the relay server and returns a SerialRelay for manual closing.
+// NewRelay creates an instance of the relay server listening on socketPath, or DefaultRelaydSocketPath if empty, and
+// returns a SerialRelay for manual closing. Without a serial device frames are only written to sinks added with
+// AddSink, this is intended for tests and debugging.
+//
+// The socket is created with perms in a directory only the relay's user can write to, see SocketPermissions. A stale
+// socket left by a previous relay is replaced, but NewRelay fails rather than remove anything else at socketPath or
+// take over from a relay that is still listening, returning ErrRelayRunning.
 //
 // The SerialRelay returned from NewRelay is designed to be used in a go routine by using StartRelay. This allows the
 // caller to handle OS Signals and other events for clean shutdown rather than relying upon defer calls.
-func NewRelay(serialDevice string) (relay SerialRelay, err error) {
-	const socketPath = DefaultRelaydSocketPath
+func NewRelay(serialDevice string, socketPath string, perms SocketPermissions) (relay SerialRelay, err error) {
+	if socketPath == "" {
+		socketPath = DefaultRelaydSocketPath
+	}
 
 	// Create a serial connection
-	serCon, err := NewSerialConnection(serialDevice)
-	if err != nil {
-		return SerialRelay{}, fmt.Errorf("relayd: failed to build a connection to serial interface: %w", err)
+	var sinks []sinkRoute
+	var port *SerialConnection
+	if serialDevice != "" {
+		serCon, err := NewSerialConnection(serialDevice)
+		if err != nil {
+			return SerialRelay{}, fmt.Errorf("relayd: failed to build a connection to serial interface: %w", err)
+		}
+		sinks = append(sinks, newSinkRoute(serCon, nil))
+		port = serCon
 	}
 
-	// Remove
-	if err = os.RemoveAll(socketPath); err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			// Help guide that the SocketPath is invalid
-			return SerialRelay{}, fmt.Errorf("relayd: unable to clean %s: %w", socketPath, err)
-		} else {
-			// Unknown issue, return the error directly
-			return SerialRelay{}, err
+	listener, err := listenSocket(socketPath, perms)
+	if err != nil {
+		for _, route := range sinks {
+			_ = route.sink.Close()
 		}
+		return SerialRelay{}, fmt.Errorf("relayd: %w", err)
+	}
+
+	return SerialRelay{
+		listener:     listener,
+		socketPath:   socketPath,
+		sinks:        sinks,
+		serial:       len(sinks) > 0,
+		port:         port,
+		ReadyToClose: make(chan bool),
+	}, nil
+}
 
+// SocketPath returns the UNIX socket the relay listens on.
+func (relay *SerialRelay) SocketPath() string {
+	return relay.socketPath
+}
+
+// LinkLegacySocket links path, normally LegacyRelaydSocketPath, to the relay's socket so clients built before the
+// socket moved can still connect, with the permissions of the relay's socket. The link is removed by CleanUp. Anything
+// at path other than a link or a stale socket owned by the relay's user is left alone and an error returned. The link
+// is only kept for a deprecation period, clients should connect to DefaultRelaydSocketPath.
+func (relay *SerialRelay) LinkLegacySocket(path string) error {
+	if err := linkLegacySocket(path, relay.socketPath); err != nil {
+		return fmt.Errorf("relayd: %w", err)
 	}
+	relay.legacyPath = path
+	return nil
+}
 
-	// Create the UDS listener.
-	addr, err := net.ResolveUnixAddr("unix", DefaultRelaydSocketPath)
-	if err != nil {
-		return SerialRelay{}, fmt.Errorf("relayd: unable to resolve address: %w", err)
+// Serial returns the serial device connection for its stats and budget, nil
+// for a relay without a serial device.
+func (relay *SerialRelay) Serial() *SerialConnection {
+	return relay.port
+}
+
+// ServeCommands reads commands from the host on the serial device with server
+// until the device is closed or ctx is done, writing the acks to the serial
+// device like relayed frames. It returns an error for a relay without a serial
+// device.
+func (relay *SerialRelay) ServeCommands(ctx context.Context, server *CommandServer) error {
+	if !relay.serial {
+		return errors.New("relayd: commands require a serial device")
 	}
-	listener, err := net.ListenUnix("unix", addr)
-	if err != nil {
-		return SerialRelay{}, fmt.Errorf("relayd: unable to listen on socket: %w", err)
+	return server.Serve(ctx, relay.port, relay.sinks[0].sink)
+}
+
+// AddSink adds a destination for relayed frames in addition to the serial
+// device. Only frames with one of the given tags are written to the sink, or
+// all frames if no tags are given. Frames are written to the sink in the
+// background through a QueueingSink, so a slow sink drops its own frames
+// rather than hold up the serial device and the other sinks. Sinks must be
+// added before StartRelay.
+func (relay *SerialRelay) AddSink(sink Sink, tags ...string) {
+	queued := NewQueueingSink(sink, DefaultSinkQueueSize)
+	relay.queued = append(relay.queued, queued)
+	relay.sinks = append(relay.sinks, newSinkRoute(queued, tags))
+}
+
+// Coalesce packs frames arriving within window into batches of at most
+// maxFrameSize bytes before writing them to the serial device, see
+// CoalescingSink. It must be called before StartRelay and does nothing for a
+// relay without a serial device.
+func (relay *SerialRelay) Coalesce(window time.Duration, maxFrameSize int) {
+	if !relay.serial {
+		return
 	}
+	serial := &relay.sinks[0]
+	serial.sink = NewCoalescingSink(serial.sink, window, maxFrameSize)
+}
 
-	return SerialRelay{
-		listener:         listener,
-		serialConnection: serCon,
-		ReadyToClose:     make(chan bool),
-	}, nil
+// Schedule shares the serial device between tags by priority and rate, see
+// SchedulingSink, and returns the sink for its per-tag counters. It must be
+// called before StartRelay, after Coalesce so frames are scheduled by their
+// own tags rather than as batches, and returns nil for a relay without a
+// serial device.
+func (relay *SerialRelay) Schedule(limits map[string]TagLimit, queueSize int) *SchedulingSink {
+	if !relay.serial {
+		return nil
+	}
+	serial := &relay.sinks[0]
+	scheduler := NewSchedulingSink(serial.sink, limits, queueSize)
+	serial.sink = scheduler
+	relay.scheduler = scheduler
+	return scheduler
+}
+
+// SetPeerPolicy checks the credentials of every connection with policy,
+// dropping connections and frames it rejects. It must be called before
+// StartRelay.
+func (relay *SerialRelay) SetPeerPolicy(policy *PeerPolicy) {
+	relay.peers = policy
+}
+
+// SetValidator checks every frame with validator, dropping invalid frames
+// rather than writing them to the serial device or any other sink. It must be
+// called before StartRelay.
+func (relay *SerialRelay) SetValidator(validator *FrameValidator) {
+	relay.validator = validator
 }
 
 // setListenerDeadline will set a deadline on the underlying net.Listener if
 // supported, no-op otherwise.
 func (relay *SerialRelay) setListenerDeadline(t time.Time) error {
-	deadliner, ok := relay.listener.(interface{
+	deadliner, ok := relay.listener.(interface {
 		SetDeadline(time.Time) error
 	})
 	if ok {
@@ -188,10 +315,22 @@ func (relay *SerialRelay) setListenerDeadline(t time.Time) error {
 // This is a server implementation of the SerialRelay so it logs to a provided
 // logger, and empty logger can be provided to stop logging if desired. This
 // function is designed to be used in a go routine so logging may be the only
-// way to get data about behavior while it is running. The resources can be shut
-// down by sending true to the ReadyToClose channel. This invokes CleanUp()
-// which is exported in case the caller desires to call it instead.
-func (relay *SerialRelay) StartRelay(logger *Logger, relayStatus *StatusLogBuffer) {
+// way to get data about behavior while it is running. Bytes relayed and send
+// failures are reported through status so they are summarized rather than
+// logged for every connection, and the serial link's rate and utilization are
+// summarized with them. The resources can be shut down by sending true
+// to the ReadyToClose channel. This invokes CleanUp() which is exported in case
+// the caller desires to call it instead.
+func (relay *SerialRelay) StartRelay(logger *Logger, status *LogAggregator) {
+	if relay.port != nil {
+		status.Summarize("relayd-serial-link", relay.port.Summary)
+	}
+	if relay.scheduler != nil {
+		status.Summarize("relayd-dropped", relay.scheduler.Summary)
+	}
+	for _, queued := range relay.queued {
+		status.Summarize("relayd-dropped-"+queued.Name(), queued.Summary)
+	}
 	// Accept new connections, dispatching them to relayServer in a goroutine.
 	for {
 		err := relay.setListenerDeadline(time.Now().Add(SocketTimeout))
@@ -222,22 +361,120 @@ func (relay *SerialRelay) StartRelay(logger *Logger, relayStatus *StatusLogBuffe
 
 		}
 
-		// Write the date to the relay
-		written, err := relay.serialConnection.RelayData(socCon)
+		// Write the data to the sinks
+		relay.relayConnection(socCon, status)
+	}
+}
+
+// relayConnection reads all data from the connection and writes each frame to
+// the sinks accepting its tag. Failures are reported per sink so a failing sink
+// doesn't affect the others.
+func (relay *SerialRelay) relayConnection(conn net.Conn, status *LogAggregator) {
+	defer conn.Close()
+	var peer PeerCredentials
+	if relay.peers != nil {
+		var err error
+		if peer, err = PeerCredentialsOf(conn); err == nil {
+			err = relay.peers.Admit(peer)
+		}
 		if err != nil {
-			logger.Errorf("Failed to send data: %s\n", err)
+			status.Recordf(LevelWarn, "relayd-peer-connection", "Rejected connection: %s", err)
+			status.Count("relayd-peer-rejected", "[relayd] Rejected connections and frames from peers", 1)
+			return
+		}
+	}
+	// Bound the data read from a connection and how long it may take
+	limit := int64(relay.maxFrameLength()) * maxConnectionFrames
+	timeout := relay.readTimeout
+	if timeout <= 0 {
+		timeout = SocketTimeout
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		status.Recordf(LevelError, "relayd-read", "Failed to set socket read deadline: %s", err)
+		return
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(conn, limit+1)); err != nil {
+		status.Recordf(LevelError, "relayd-read", "Failed to read socket to buffer: %s", err)
+		return
+	}
+	if int64(buf.Len()) > limit {
+		status.Recordf(LevelWarn, "relayd-read-limit", "Dropped connection sending more than %d bytes", limit)
+		status.Count("relayd-invalid", "[relayd] Dropped invalid frames", 1)
+		return
+	}
+
+	for _, frame := range splitFrames(buf.Bytes()) {
+		if relay.peers != nil {
+			if err := relay.peers.Allow(peer, frame); err != nil {
+				status.Recordf(LevelWarn, fmt.Sprintf("relayd-peer-%d", peer.UID), "Dropped frame: %s", err)
+				status.Count("relayd-peer-rejected", "[relayd] Rejected connections and frames from peers", 1)
+				continue
+			}
+		}
+		if relay.validator != nil {
+			if err := relay.validator.Validate(frame.Bytes); err != nil {
+				reason := ReasonMalformed
+				var validationErr *ValidationError
+				if errors.As(err, &validationErr) {
+					reason = validationErr.Reason
+				}
+				status.Recordf(LevelWarn, "relayd-invalid-"+reason, "Dropped invalid frame: %s", err)
+				status.Count("relayd-invalid", "[relayd] Dropped invalid frames", 1)
+				continue
+			}
+		}
+		for _, route := range relay.sinks {
+			if !route.accepts(frame.Tag) {
+				continue
+			}
+			name := route.sink.Name()
+			written, err := route.sink.WriteFrame(frame)
+			// Dropped frames are expected under load, they are counted by the
+			// sink dropping them rather than logged as failures
+			if err != nil && !errors.Is(err, ErrFrameDropped) {
+				status.Recordf(LevelError, "relayd-send-"+name, "Failed to send data to %s: %s", name, err)
+			}
+			// Add to the running total for the next summary
+			status.Count("relayd-written-"+name, "[relayd] Received data and sent bytes to "+name, int64(written))
 		}
+	}
+}
 
-		// Increment the counter
-		atomic.AddInt64(&relayStatus.Written, int64(written))
+// maxFrameLength returns the largest frame the relay accepts, the validator's
+// limit or DefaultMaxFrameLength.
+func (relay *SerialRelay) maxFrameLength() int {
+	if relay.validator != nil {
+		return relay.validator.maxFrameSize
 	}
+	return DefaultMaxFrameLength
+}
+
+// splitFrames splits newline terminated frames, a final frame without a
+// newline is kept as is.
+func splitFrames(data []byte) []Frame {
+	var frames []Frame
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end <= 0 {
+			end = len(data)
+		}
+		frames = append(frames, Frame{Tag: frameTag(data[:end]), Bytes: data[:end]})
+		data = data[end:]
+	}
+	return frames
 }
 
 // CleanUp manually closes the connections for a Serial Relay. This is called from StartRelay when true is sent on
 // ReadyToClose so it should only be called separately if closing outside of that mechanism.
 func (relay *SerialRelay) CleanUp() {
 	_ = relay.listener.Close()
-	_ = relay.serialConnection.Close()
+	for _, route := range relay.sinks {
+		_ = route.sink.Close()
+	}
 
-	_ = os.RemoveAll(DefaultRelaydSocketPath)
+	removeSocket(relay.socketPath)
+	if relay.legacyPath != "" {
+		removeLegacySocketLink(relay.legacyPath, relay.socketPath)
+	}
 }
@@ -1,16 +1,22 @@
 package ec2macossystemmonitor
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
-// TestBuildMessage creates some basic tests to ensure the options result in the correct bytes
+// TestBuildMessage creates some basic tests to ensure the options result in the correct bytes. Compressed messages
+// depend on the toolchain's zlib output so they are covered by TestProtocolGolden, which compares them once decoded.
 func TestBuildMessage(t *testing.T) {
 	// emptyTestBytes is the byte slice of a payload tag "test" and empty payload
 	emptyTestBytes := []byte{123, 34, 99, 115, 117, 109, 34, 58, 53, 48, 55, 53, 55, 57, 55, 52, 52, 44, 34, 112, 97, 121, 108, 111, 97, 100, 34, 58, 34, 123, 92, 34, 116, 97, 103, 92, 34, 58, 92, 34, 116, 101, 115, 116, 92, 34, 44, 92, 34, 99, 111, 109, 112, 114, 101, 115, 115, 92, 34, 58, 102, 97, 108, 115, 101, 44, 92, 34, 100, 97, 116, 97, 92, 34, 58, 92, 34, 92, 34, 125, 34, 125, 10}
-	// emptyTestBytes is the byte slice of a payload tag "test" and empty payload while compressing ""
-	emptyCompressedTestBytes := []byte{123, 34, 99, 115, 117, 109, 34, 58, 49, 54, 57, 53, 52, 54, 49, 51, 56, 44, 34, 112, 97, 121, 108, 111, 97, 100, 34, 58, 34, 123, 92, 34, 116, 97, 103, 92, 34, 58, 92, 34, 116, 101, 115, 116, 92, 34, 44, 92, 34, 99, 111, 109, 112, 114, 101, 115, 115, 92, 34, 58, 116, 114, 117, 101, 44, 92, 34, 100, 97, 116, 97, 92, 34, 58, 92, 34, 101, 78, 111, 66, 65, 65, 68, 47, 47, 119, 65, 65, 65, 65, 69, 61, 92, 34, 125, 34, 125, 10}
 	basicCPUTestBytes := []byte{123, 34, 99, 115, 117, 109, 34, 58, 50, 49, 49, 56, 49, 57, 50, 57, 53, 48, 44, 34, 112, 97, 121, 108, 111, 97, 100, 34, 58, 34, 123, 92, 34, 116, 97, 103, 92, 34, 58, 92, 34, 99, 112, 117, 117, 116, 105, 108, 92, 34, 44, 92, 34, 99, 111, 109, 112, 114, 101, 115, 115, 92, 34, 58, 102, 97, 108, 115, 101, 44, 92, 34, 100, 97, 116, 97, 92, 34, 58, 92, 34, 50, 46, 48, 92, 34, 125, 34, 125, 10}
 
 	type args struct {
@@ -25,7 +31,6 @@ func TestBuildMessage(t *testing.T) {
 		wantErr bool
 	}{
 		{"Empty Message", args{"test", "", false}, emptyTestBytes, false},
-		{"Empty Message Compressed", args{"test", "", true}, emptyCompressedTestBytes, false},
 		{"Basic CPU Test", args{"cpuutil", "2.0", false}, basicCPUTestBytes, false},
 	}
 	for _, tt := range tests {
@@ -41,3 +46,156 @@ func TestBuildMessage(t *testing.T) {
 		})
 	}
 }
+
+// startRelay starts a relay without a serial device on socketPath writing to sink, configured by configure if not nil.
+// The relay is stopped when the test ends.
+func startRelay(t *testing.T, socketPath string, sink Sink, configure func(*SerialRelay)) *SerialRelay {
+	t.Helper()
+	relay, err := NewRelay("", socketPath, SocketPermissions{})
+	if err != nil {
+		t.Fatalf("NewRelay() error = %v", err)
+	}
+	relay.AddSink(sink)
+	if configure != nil {
+		configure(&relay)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		relay.StartRelay(&Logger{}, NewLogAggregator(&Logger{}, time.Minute))
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		go func() { relay.ReadyToClose <- true }()
+		// Wake the relay from Accept so it sees the request without waiting for the accept deadline
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-time.After(10 * time.Millisecond):
+				if conn, err := net.Dial("unix", socketPath); err == nil {
+					conn.Close()
+				}
+			}
+		}
+	})
+	return &relay
+}
+
+// waitFrames waits for sink to hold n frames.
+func waitFrames(t *testing.T, sink *memorySink, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.tags()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return sink.tags()
+}
+
+// TestRelaysInParallel runs several relays side by side on their own sockets, each must only receive the messages
+// sent to its socket and remove only its socket when closed
+func TestRelaysInParallel(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		tag := fmt.Sprintf("relay%d", i)
+		t.Run(tag, func(t *testing.T) {
+			t.Parallel()
+			path := tempSocketPath(t)
+			sink := &memorySink{name: tag}
+			// Cleanups run in reverse, so this runs once the relay has stopped
+			t.Cleanup(func() {
+				if CheckSocketExists(path) {
+					t.Errorf("%s still exists after the relay stopped", path)
+				}
+			})
+			relay := startRelay(t, path, sink, nil)
+			if relay.SocketPath() != path {
+				t.Errorf("SocketPath() = %s, want %s", relay.SocketPath(), path)
+			}
+			if !CheckSocketExists(path) {
+				t.Fatalf("CheckSocketExists(%s) = false", path)
+			}
+
+			client := NewClient(WithSocketPath(path))
+			for j := 0; j < 5; j++ {
+				if _, err := client.Send(context.Background(), tag, fmt.Sprint(j)); err != nil {
+					t.Fatalf("Send() error = %v", err)
+				}
+			}
+			want := []string{tag, tag, tag, tag, tag}
+			if got := waitFrames(t, sink, len(want)); !reflect.DeepEqual(got, want) {
+				t.Errorf("relay received %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestRelayReadLimits checks a connection sending too much or never closing is dropped without holding up others
+func TestRelayReadLimits(t *testing.T) {
+	path := tempSocketPath(t)
+	sink := &memorySink{name: "serial"}
+	startRelay(t, path, sink, func(relay *SerialRelay) {
+		relay.SetValidator(NewFrameValidator(1024, nil))
+		relay.readTimeout = 50 * time.Millisecond
+	})
+
+	idle, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer idle.Close()
+
+	frame, err := BuildMessage("emf", "{}", false)
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	flood, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	go func() {
+		defer flood.Close()
+		// The relay stops reading at the limit, so the write fails once it drops the connection
+		_, _ = flood.Write(bytes.Repeat(frame, 1024*maxConnectionFrames/len(frame)+1))
+	}()
+
+	if _, err := NewClient(WithSocketPath(path)).Send(context.Background(), "cpuutil", "2.0"); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	want := []string{"cpuutil"}
+	if got := waitFrames(t, sink, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("relayed tags = %q, want %q", got, want)
+	}
+}
+
+// TestRelayLegacySocket checks clients of earlier releases reach the relay through the legacy link, which is removed
+// with the socket, and that the relay doesn't replace a file it doesn't own at the legacy path
+func TestRelayLegacySocket(t *testing.T) {
+	path := tempSocketPath(t)
+	legacy := filepath.Join(filepath.Dir(path), ".ec2monitoring.sock")
+	t.Cleanup(func() {
+		if _, err := os.Lstat(legacy); !os.IsNotExist(err) {
+			t.Errorf("Lstat(%s) error = %v after the relay stopped, want it removed", legacy, err)
+		}
+	})
+	sink := &memorySink{name: "serial"}
+	startRelay(t, path, sink, func(relay *SerialRelay) {
+		if err := relay.LinkLegacySocket(legacy); err != nil {
+			t.Fatalf("LinkLegacySocket() error = %v", err)
+		}
+	})
+
+	if _, err := NewClient(WithSocketPath(legacy)).Send(context.Background(), "cpuutil", "2.0"); err != nil {
+		t.Fatalf("Send() to the legacy socket error = %v", err)
+	}
+	if got, want := waitFrames(t, sink, 1), []string{"cpuutil"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("relayed tags = %q, want %q", got, want)
+	}
+
+	other := filepath.Join(filepath.Dir(path), "other.sock")
+	if err := os.WriteFile(other, nil, 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	relay := SerialRelay{socketPath: path}
+	if err := relay.LinkLegacySocket(other); err == nil {
+		t.Error("LinkLegacySocket() replaced a regular file")
+	}
+}
@@ -2,16 +2,43 @@ package ec2macossystemmonitor
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"go.bug.st/serial"
 )
 
-// SerialConnection is the container for passing the ReadWriteCloser for serial connections.
+// SerialConnection is the container for passing the ReadWriteCloser for serial connections. It accounts for the
+// bytes written, see Stats, can shed load to keep within a budget, see SetBudget, and bounds writes to a device that
+// stops accepting them, see SetWatchdog.
 type SerialConnection struct {
-	port serial.Port
+	clock Clock
+	// open reopens the device, nil if it can't be reopened.
+	open func() (serial.Port, error)
+
+	// writeMu serializes writes so frames written from several goroutines, such as relayed frames and acks, aren't
+	// interleaved on the device and the watchdog tracks one write at a time.
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	port     serial.Port
+	meter    *linkMeter
+	watchdog SerialWatchdog
+	// pending is the write still blocked after timing out, nil if there is none.
+	pending *pendingWrite
+	// timeouts counts the consecutive timed out writes, reopens the reopens since the last successful write.
+	timeouts int
+	reopens  int
+	// reopening is closed once the port being reopened has been replaced, nil if it isn't being reopened.
+	reopening chan struct{}
+	// budget is the most bytes written in any minute before frames with tags other than critical are shed, no limit
+	// if zero.
+	budget   int64
+	critical map[string]bool
 }
 
 // SerialPayload is the container for a payload that is written to serial device.
@@ -22,22 +49,62 @@ type SerialPayload struct {
 	Compress bool `json:"compress"`
 	// Data is the actual data payload to be consumed
 	Data string `json:"data"`
+	// Meta is additional metadata about the payload, it requires protocol version 2 and is omitted otherwise
+	Meta map[string]string `json:"meta,omitempty"`
+	// Time is when the data was collected in milliseconds since the Unix epoch, it requires protocol version 2
+	Time int64 `json:"ts,omitempty"`
+	// Producer identifies the host or process that built the message, it requires protocol version 2
+	Producer string `json:"producer,omitempty"`
+	// Source names the sequence Seq belongs to, it requires protocol version 2
+	Source string `json:"src,omitempty"`
+	// Seq is the sequence number of the message within Source starting at 1, it requires protocol version 2
+	Seq uint64 `json:"seq,omitempty"`
+	// Codec is the codec of compressed data, it is omitted for zlib which is implied by Compress for compatibility
+	// with version 1. Other codecs require protocol version 2.
+	Codec Codec `json:"codec,omitempty"`
+	// MessageID identifies the message a fragment belongs to, it requires protocol version 2
+	MessageID string `json:"mid,omitempty"`
+	// Part is the position of a fragment in its message starting at 1, it requires protocol version 2
+	Part int `json:"part,omitempty"`
+	// Parts is the number of fragments in the message, it requires protocol version 2
+	Parts int `json:"parts,omitempty"`
+}
+
+// Fragment returns true if the payload is one part of a message split by BuildMessages.
+func (p SerialPayload) Fragment() bool {
+	return p.Parts > 1
+}
+
+// Timestamp returns Time as a time.Time, or the zero time if the payload has no timestamp.
+func (p SerialPayload) Timestamp() time.Time {
+	if p.Time == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(p.Time)
 }
 
 // SerialMessage is the container to actually send on the serial connection, contains checksum of SerialPayload to
 // provide additional assurance the entire payload has been written.
 type SerialMessage struct {
+	// Version is the protocol version, it is omitted for version 1 to keep those messages unchanged
+	Version int `json:"v,omitempty"`
 	// Checksum is the checksum used to ensure all data was received
 	Checksum uint32 `json:"csum"`
 	// Payload is the SerialPayload in json format
 	Payload string `json:"payload"`
+	// Algorithm is the checksum algorithm, it is omitted for Adler-32. Other algorithms require protocol version 2
+	Algorithm ChecksumAlgorithm `json:"alg,omitempty"`
+	// KeyID names the key the payload is signed with, it requires protocol version 2
+	KeyID string `json:"kid,omitempty"`
+	// MAC is the base64 encoded HMAC-SHA256 of the payload, it requires protocol version 2
+	MAC string `json:"mac,omitempty"`
 }
 
 // NewSerialConnection creates a serial device connection and returns a reference to the connection.
 func NewSerialConnection(device string) (conn *SerialConnection, err error) {
 	// Set up options for serial device, take defaults for now on everything else
 	mode := &serial.Mode{
-		BaudRate: 115200,
+		BaudRate: DefaultBaudRate,
 	}
 
 	// Attempt to avoid opening a non-existent serial connection
@@ -50,33 +117,144 @@ func NewSerialConnection(device string) (conn *SerialConnection, err error) {
 		return nil, fmt.Errorf("ec2macossystemmonitor: unable to get serial connection: %s", err)
 	}
 	// Put the port in a SerialConnection for handing it off
-	s := SerialConnection{port}
-	return &s, nil
+	conn = newSerialConnection(port, mode.BaudRate, systemClock{})
+	conn.open = func() (serial.Port, error) {
+		return serial.Open(device, mode)
+	}
+	conn.watchdog = DefaultSerialWatchdog
+	return conn, nil
+}
+
+// newSerialConnection creates a SerialConnection for port opened at baud.
+func newSerialConnection(port serial.Port, baud int, clock Clock) *SerialConnection {
+	return &SerialConnection{port: port, clock: clock, meter: newLinkMeter(baud, clock.Now())}
+}
+
+// SetBudget limits the bytes written in any minute to budget, or removes the limit if zero. Frames with tags other
+// than critical are shed, returning an error wrapping ErrFrameDropped, while writing them would exceed the budget.
+// Frames with a critical tag, and batches with an entry with a critical tag, are always written but count against the
+// budget.
+func (s *SerialConnection) SetBudget(budget int, critical ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.budget = int64(budget)
+	s.critical = make(map[string]bool, len(critical))
+	for _, tag := range critical {
+		s.critical[tag] = true
+	}
+}
+
+// Stats returns the bytes written, rate, utilization and write latency of the device.
+func (s *SerialConnection) Stats() LinkStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meter.snapshot(s.clock.Now())
+}
+
+// Summary is a SummaryFunc logging the stats with a LogAggregator.
+func (s *SerialConnection) Summary() (string, []any) {
+	stats := s.Stats()
+	return "[relayd] Serial link " + stats.String(), []any{
+		"bytes_per_second", int64(stats.BytesPerSecond),
+		"utilization", fmt.Sprintf("%.1f", stats.Utilization),
+		"minute_bytes", stats.MinuteBytes,
+		"shed_frames", stats.ShedFrames,
+	}
+}
+
+// admit checks a frame fits in the budget, counting it as shed if not. A batch is critical if any of its entries has
+// a critical tag.
+func (s *SerialConnection) admit(frame Frame) error {
+	s.mu.Lock()
+	budget, critical := s.budget, s.critical
+	s.mu.Unlock()
+	if budget == 0 || critical[frame.Tag] || (frame.Tag == BatchTag && criticalBatch(frame.Bytes, critical)) {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(frame.Bytes)
+	if spent := s.meter.minute(s.clock.Now()); spent+int64(n) > budget {
+		s.meter.shed(n)
+		return fmt.Errorf("%w: tag %q: %d of the budget of %d bytes per minute used", ErrFrameDropped, frame.Tag, spent, budget)
+	}
+	return nil
+}
+
+// criticalBatch returns true if an entry of the batch frame has one of the critical tags.
+func criticalBatch(frame []byte, critical map[string]bool) bool {
+	tags, err := batchTags(frame)
+	if err != nil {
+		return false
+	}
+	for _, tag := range tags {
+		if critical[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// Read reads from the device, such as commands from the host. A read interrupted by reopening a stuck device
+// continues on the reopened device.
+func (s *SerialConnection) Read(p []byte) (n int, err error) {
+	for {
+		s.mu.Lock()
+		port := s.port
+		s.mu.Unlock()
+		n, err = port.Read(p)
+		s.mu.Lock()
+		reopening := s.reopening
+		s.mu.Unlock()
+		if err != nil && n == 0 && reopening != nil {
+			// The port was closed to reopen it, wait for it to be replaced
+			<-reopening
+		}
+		s.mu.Lock()
+		reopened := s.port != port
+		s.mu.Unlock()
+		if err == nil || n > 0 || !reopened {
+			return n, err
+		}
+	}
 }
 
 // Close is simply a pass through to close the device so it remains open in the scope needed.
 func (s *SerialConnection) Close() (err error) {
-	err = s.port.Close()
+	s.mu.Lock()
+	port := s.port
+	s.mu.Unlock()
+	err = port.Close()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// RelayData is the primary function for reading data from the socket provided and writing to the serial connection.
+// RelayData reads frames from the socket provided and writes each with WriteFrame, so they are subject to the budget,
+// the watchdog and the link stats like frames written by the relay. Reading stops after maxConnectionFrames frames of
+// DefaultMaxFrameLength. Frames dropped to keep within the budget are skipped and reported once the rest are written.
 func (s *SerialConnection) RelayData(sock net.Conn) (n int, err error) {
 	defer sock.Close()
-	// Create a buffer for reading in from the socket, probably want to bound this
 	var buf bytes.Buffer
 	// Read in the socket data into the buffer
-	_, err = io.Copy(&buf, sock)
+	_, err = io.Copy(&buf, io.LimitReader(sock, int64(DefaultMaxFrameLength)*maxConnectionFrames))
 	if err != nil {
 		return 0, fmt.Errorf("ec2macossystemmonitor: failed to read socket to buffer: %s", err)
 	}
-	// Write out the buffer to the serial device
-	written, err := s.port.Write(buf.Bytes())
-	if err != nil {
-		return 0, fmt.Errorf("ec2macossystemmonitor: failed to write buffer to serial: %s", err)
+	// Write out the frames to the serial device
+	var dropped error
+	for _, frame := range splitFrames(buf.Bytes()) {
+		written, err := s.WriteFrame(frame)
+		n += written
+		if errors.Is(err, ErrFrameDropped) {
+			dropped = errors.Join(dropped, err)
+			continue
+		}
+		if err != nil {
+			return n, fmt.Errorf("ec2macossystemmonitor: failed to write buffer to serial: %w", err)
+		}
 	}
-	return written, nil
+	return n, dropped
 }
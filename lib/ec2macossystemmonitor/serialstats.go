@@ -0,0 +1,164 @@
+package ec2macossystemmonitor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultBaudRate is the baud rate the serial device is opened with.
+const DefaultBaudRate = 115200
+
+// serialBitsPerByte is the bits on the wire for each byte with 8N1 framing: a start bit, 8 data bits and a stop bit.
+const serialBitsPerByte = 10
+
+// linkWindow is the sliding window rates and the budget are measured over, in seconds.
+const linkWindow = 60
+
+// LatencyBuckets are the upper bounds of the serial write latency histogram. Writes slower than the last bound are
+// counted in an extra bucket.
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// LinkStats describes the writes to a serial device.
+type LinkStats struct {
+	BaudRate int
+	// Writes, Bytes and Errors count the writes since the device was opened.
+	Writes int64
+	Bytes  int64
+	Errors int64
+	// Timeouts counts the writes that timed out and Reopens the times the device was reopened because it was stuck.
+	Timeouts int64
+	Reopens  int64
+	// ShedFrames and ShedBytes count the frames dropped to keep within the budget.
+	ShedFrames int64
+	ShedBytes  int64
+	// MinuteBytes are the bytes written in the last minute, which count against the budget.
+	MinuteBytes int64
+	// BytesPerSecond is the average over the last minute, or since the device was opened if that is more recent.
+	BytesPerSecond float64
+	// Utilization is BytesPerSecond as a percentage of the bytes per second the baud rate can carry.
+	Utilization float64
+	// Latency counts writes by how long they took, Latency[i] counts the writes that took no longer than
+	// LatencyBuckets[i] and the last entry counts the slower ones.
+	Latency []int64
+}
+
+// String summarizes the stats on one line.
+func (s LinkStats) String() string {
+	return fmt.Sprintf("%.0f bytes/s, %.1f%% of %d baud, %d writes, %d errors, %d timeouts, %d reopens, %d frames shed, latency %s",
+		s.BytesPerSecond, s.Utilization, s.BaudRate, s.Writes, s.Errors, s.Timeouts, s.Reopens, s.ShedFrames, s.latency())
+}
+
+// latency formats the non-empty latency buckets as "<=1ms:10 <=5ms:2 >5s:1".
+func (s LinkStats) latency() string {
+	var buckets []string
+	for i, n := range s.Latency {
+		if n == 0 {
+			continue
+		}
+		if i < len(LatencyBuckets) {
+			buckets = append(buckets, fmt.Sprintf("<=%s:%d", LatencyBuckets[i], n))
+		} else {
+			buckets = append(buckets, fmt.Sprintf(">%s:%d", LatencyBuckets[len(LatencyBuckets)-1], n))
+		}
+	}
+	if len(buckets) == 0 {
+		return "none"
+	}
+	return strings.Join(buckets, " ")
+}
+
+// linkMeter accounts for the writes to a serial device, keeping the bytes written in each second of the last minute
+// for the rate and budget. It is not safe for concurrent use.
+type linkMeter struct {
+	start time.Time
+	// seconds holds the bytes written in each second of the window, indexed by the Unix time modulo the window, and
+	// stamps the Unix time each slot was last used in.
+	seconds [linkWindow]int64
+	stamps  [linkWindow]int64
+	stats   LinkStats
+}
+
+// newLinkMeter creates a linkMeter for a device opened at now with baud.
+func newLinkMeter(baud int, now time.Time) *linkMeter {
+	return &linkMeter{
+		start: now,
+		stats: LinkStats{BaudRate: baud, Latency: make([]int64, len(LatencyBuckets)+1)},
+	}
+}
+
+// record accounts for a write of n bytes at now that took d.
+func (m *linkMeter) record(n int, d time.Duration, err error, now time.Time) {
+	m.stats.Writes++
+	m.stats.Bytes += int64(n)
+	if err != nil {
+		m.stats.Errors++
+	}
+	bucket := len(LatencyBuckets)
+	for i, bound := range LatencyBuckets {
+		if d <= bound {
+			bucket = i
+			break
+		}
+	}
+	m.stats.Latency[bucket]++
+
+	sec := now.Unix()
+	slot := sec % linkWindow
+	if m.stamps[slot] != sec {
+		m.stamps[slot] = sec
+		m.seconds[slot] = 0
+	}
+	m.seconds[slot] += int64(n)
+}
+
+// timeout accounts for a write that timed out.
+func (m *linkMeter) timeout() {
+	m.stats.Timeouts++
+}
+
+// reopened accounts for reopening a stuck device.
+func (m *linkMeter) reopened() {
+	m.stats.Reopens++
+}
+
+// shed accounts for a frame of n bytes dropped to keep within the budget.
+func (m *linkMeter) shed(n int) {
+	m.stats.ShedFrames++
+	m.stats.ShedBytes += int64(n)
+}
+
+// minute returns the bytes written in the minute up to now.
+func (m *linkMeter) minute(now time.Time) int64 {
+	sec := now.Unix()
+	var total int64
+	for i, stamp := range m.stamps {
+		if stamp > sec-linkWindow && stamp <= sec {
+			total += m.seconds[i]
+		}
+	}
+	return total
+}
+
+// snapshot returns the stats at now.
+func (m *linkMeter) snapshot(now time.Time) LinkStats {
+	stats := m.stats
+	stats.Latency = append([]int64{}, m.stats.Latency...)
+	stats.MinuteBytes = m.minute(now)
+	// Measure at least a second so the first writes don't read as a burst
+	elapsed := max(1, min(now.Sub(m.start).Seconds(), linkWindow))
+	stats.BytesPerSecond = float64(stats.MinuteBytes) / elapsed
+	if stats.BaudRate > 0 {
+		stats.Utilization = stats.BytesPerSecond * serialBitsPerByte / float64(stats.BaudRate) * 100
+	}
+	return stats
+}
@@ -0,0 +1,209 @@
+package ec2macossystemmonitor
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// fakePort is a serial.Port that keeps written bytes in memory, taking delay per write on clock. Writes wait for block
+// to be closed if it is set, like a device with flow control asserted. Methods other than Write and Close panic
+// through the nil embedded Port.
+type fakePort struct {
+	serial.Port
+	clock *fakeClock
+	delay time.Duration
+	block chan struct{}
+
+	mu      sync.Mutex
+	written []byte
+	closed  bool
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	if p.block != nil {
+		<-p.block
+	}
+	p.clock.Advance(p.delay)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.written = append(p.written, b...)
+	return len(b), nil
+}
+
+func (p *fakePort) bytes() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]byte{}, p.written...)
+}
+
+func (p *fakePort) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func (p *fakePort) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+// TestSerialLinkStats checks the rate and utilization are measured over the last minute and writes are bucketed by
+// latency
+func TestSerialLinkStats(t *testing.T) {
+	clock := newFakeClock()
+	port := &fakePort{clock: clock, delay: 2 * time.Millisecond}
+	conn := newSerialConnection(port, DefaultBaudRate, clock)
+
+	frame := Frame{Tag: "cpuutil", Bytes: []byte(strings.Repeat("x", 1152))}
+	for i := 0; i < 10; i++ {
+		if _, err := conn.WriteFrame(frame); err != nil {
+			t.Fatalf("WriteFrame() error = %v", err)
+		}
+		clock.Advance(time.Second - port.delay)
+	}
+	stats := conn.Stats()
+	if stats.Writes != 10 || stats.Bytes != 11520 || stats.MinuteBytes != 11520 {
+		t.Errorf("Stats() = %+v, want 10 writes of 11520 bytes", stats)
+	}
+	// 1152 bytes a second is a tenth of what 115200 baud carries with 10 bits per byte
+	if stats.BytesPerSecond != 1152 || stats.Utilization != 10 {
+		t.Errorf("Stats() rate = %v bytes/s, %v%%, want 1152 bytes/s, 10%%", stats.BytesPerSecond, stats.Utilization)
+	}
+	wantLatency := make([]int64, len(LatencyBuckets)+1)
+	wantLatency[1] = 10
+	if !reflect.DeepEqual(stats.Latency, wantLatency) {
+		t.Errorf("Stats() latency = %v, want %v", stats.Latency, wantLatency)
+	}
+
+	port.delay = 10 * time.Second
+	if _, err := conn.WriteFrame(frame); err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+	if got := conn.Stats().Latency[len(LatencyBuckets)]; got != 1 {
+		t.Errorf("writes slower than the last bucket = %d, want 1", got)
+	}
+
+	// Writes older than a minute no longer count
+	clock.Advance(55 * time.Second)
+	stats = conn.Stats()
+	if stats.MinuteBytes != 1152 || stats.BytesPerSecond != 1152.0/60 {
+		t.Errorf("Stats() after a minute = %d bytes, %v bytes/s, want 1152 bytes, %v bytes/s", stats.MinuteBytes, stats.BytesPerSecond, 1152.0/60)
+	}
+	msg, _ := conn.Summary()
+	if want := "[relayd] Serial link 19 bytes/s, 0.2% of 115200 baud, 11 writes, 0 errors, 0 timeouts, 0 reopens, 0 frames shed, latency <=5ms:10 >5s:1"; msg != want {
+		t.Errorf("Summary() = %q, want %q", msg, want)
+	}
+}
+
+// TestSerialBudget checks frames are shed once the budget for the last minute is used, except critical ones
+func TestSerialBudget(t *testing.T) {
+	clock := newFakeClock()
+	port := &fakePort{clock: clock}
+	conn := newSerialConnection(port, DefaultBaudRate, clock)
+	conn.SetBudget(1000, "cpuutil")
+
+	steps := []struct {
+		tag     string
+		size    int
+		advance time.Duration
+		shed    bool
+	}{
+		{"emf", 600, 0, false},
+		{"emf", 300, 10 * time.Second, false},
+		{"emf", 200, 10 * time.Second, true},
+		{"cpuutil", 200, 0, false},
+		{"emf", 10, 0, true},
+		// The first frame leaves the window
+		{"emf", 500, 41 * time.Second, false},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		_, err := conn.WriteFrame(Frame{Tag: step.tag, Bytes: make([]byte, step.size)})
+		if step.shed != errors.Is(err, ErrFrameDropped) || (!step.shed && err != nil) {
+			t.Errorf("step %d: WriteFrame(%s, %d bytes) error = %v, want shed %v", i, step.tag, step.size, err, step.shed)
+		}
+	}
+	stats := conn.Stats()
+	if stats.ShedFrames != 2 || stats.ShedBytes != 210 || stats.Bytes != 1600 || len(port.written) != 1600 {
+		t.Errorf("Stats() = %+v, want 2 frames of 210 bytes shed and 1600 bytes written", stats)
+	}
+
+	conn.SetBudget(0)
+	if _, err := conn.WriteFrame(Frame{Tag: "emf", Bytes: make([]byte, 5000)}); err != nil {
+		t.Errorf("WriteFrame() without a budget error = %v", err)
+	}
+}
+
+// TestSerialRelayDataBudget checks frames relayed with RelayData are subject to the budget and counted in the stats
+func TestSerialRelayDataBudget(t *testing.T) {
+	clock := newFakeClock()
+	port := &fakePort{clock: clock}
+	conn := newSerialConnection(port, DefaultBaudRate, clock)
+	cpu := mustBuildMessage(t, "cpuutil", "2.0")
+	emf := mustBuildMessage(t, "emf", "data")
+	conn.SetBudget(len(cpu), "cpuutil")
+
+	client, server := net.Pipe()
+	go func() {
+		_, _ = client.Write(append(append([]byte{}, cpu...), emf...))
+		_ = client.Close()
+	}()
+	n, err := conn.RelayData(server)
+	if !errors.Is(err, ErrFrameDropped) || n != len(cpu) {
+		t.Errorf("RelayData() = %d, %v, want %d bytes and the emf frame dropped", n, err, len(cpu))
+	}
+	if stats := conn.Stats(); stats.Writes != 1 || stats.ShedFrames != 1 || string(port.bytes()) != string(cpu) {
+		t.Errorf("Stats() = %+v and written %q, want the cpuutil frame written and the emf frame shed", stats, port.bytes())
+	}
+}
+
+// TestSerialBudgetBatches checks coalesced batches are critical when one of their entries is
+func TestSerialBudgetBatches(t *testing.T) {
+	clock := newFakeClock()
+	port := &fakePort{clock: clock}
+	conn := newSerialConnection(port, DefaultBaudRate, clock)
+	conn.SetBudget(100, "cpuutil")
+	if _, err := conn.WriteFrame(Frame{Tag: "emf", Bytes: make([]byte, 100)}); err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		tags []string
+		shed bool
+	}{
+		{"critical entry", []string{"emf", "cpuutil"}, false},
+		{"no critical entry", []string{"emf", "emf"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			written := conn.Stats().Writes
+			sink := NewCoalescingSink(conn, time.Hour, DefaultMaxFrameSize)
+			for _, tag := range tt.tags {
+				frame, err := BuildMessage(tag, "1.0", false)
+				if err != nil {
+					t.Fatalf("BuildMessage() error = %v", err)
+				}
+				if _, err := sink.WriteFrame(Frame{Tag: tag, Bytes: frame}); err != nil {
+					t.Fatalf("WriteFrame() error = %v", err)
+				}
+			}
+			err := sink.Close()
+			if tt.shed != errors.Is(err, ErrFrameDropped) || (!tt.shed && err != nil) {
+				t.Errorf("Close() error = %v, want shed %v", err, tt.shed)
+			}
+			if got := conn.Stats().Writes - written; (got == 1) == tt.shed {
+				t.Errorf("wrote %d batches, want shed %v", got, tt.shed)
+			}
+		})
+	}
+}
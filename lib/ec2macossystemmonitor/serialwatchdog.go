@@ -0,0 +1,219 @@
+package ec2macossystemmonitor
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+var (
+	// ErrSerialWriteTimeout is returned when a write to the serial device doesn't complete within the timeout.
+	ErrSerialWriteTimeout = errors.New("ec2macossystemmonitor: serial write timed out")
+	// ErrSerialStuck is returned once the serial device is considered stuck and couldn't be recovered by reopening it.
+	ErrSerialStuck = errors.New("ec2macossystemmonitor: serial device is stuck")
+)
+
+// SerialWatchdog configures how a SerialConnection handles a device that stops accepting writes, such as when flow
+// control is asserted or the driver hangs. Writes that time out return ErrSerialWriteTimeout. After StuckAfter
+// consecutive timeouts the device is considered stuck and reopened, and if it is still stuck after MaxReopens reopens
+// OnStuck is called and writes return ErrSerialStuck. A successful write resets both counts.
+//
+// The port doesn't support write deadlines, so a timed out write keeps blocking in the background. Later writes first
+// wait up to WriteTimeout for it to return, and time out if it doesn't, until the device is reopened. The bytes of a
+// timed out write that returns later are still counted in the link stats.
+//
+// The port is opened for exclusive access, so the stuck port is closed before the device is opened again. If closing
+// doesn't return within WriteTimeout, opening is tried anyway, which only succeeds when running as root.
+type SerialWatchdog struct {
+	// WriteTimeout bounds each write in addition to the time its bytes take at the baud rate, writes aren't bounded
+	// if zero.
+	WriteTimeout time.Duration
+	// StuckAfter is the number of consecutive timed out writes after which the device is considered stuck.
+	StuckAfter int
+	// MaxReopens is the number of times a stuck device is reopened before giving up.
+	MaxReopens int
+	// OnStuck is called with an error wrapping ErrSerialStuck when the device can't be recovered, for example to exit
+	// so the service manager restarts the relay. It is called for every write that fails once the device is stuck.
+	OnStuck func(err error)
+}
+
+// DefaultSerialWatchdog is the watchdog of a SerialConnection opened with NewSerialConnection.
+var DefaultSerialWatchdog = SerialWatchdog{
+	WriteTimeout: 5 * time.Second,
+	StuckAfter:   3,
+	MaxReopens:   1,
+}
+
+// pendingWrite is a write running in the background.
+type pendingWrite struct {
+	n    int
+	err  error
+	done chan struct{}
+	// finished and timedOut are guarded by the connection's mu, whichever is set second decides who records the write.
+	finished bool
+	timedOut bool
+}
+
+// SetWatchdog bounds writes and recovers a stuck device as configured by watchdog.
+func (s *SerialConnection) SetWatchdog(watchdog SerialWatchdog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchdog = watchdog
+}
+
+// write writes b to the port, accounting for it, within the watchdog's timeout.
+func (s *SerialConnection) write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	port, watchdog, pending := s.port, s.watchdog, s.pending
+	s.mu.Unlock()
+	if pending != nil {
+		timer := time.NewTimer(watchdog.WriteTimeout)
+		select {
+		case <-pending.done:
+			timer.Stop()
+			s.mu.Lock()
+			if s.pending == pending {
+				s.pending = nil
+			}
+			s.mu.Unlock()
+		case <-timer.C:
+			return 0, s.timedOut(fmt.Errorf("%w: an earlier write is still blocked after %s", ErrSerialWriteTimeout, watchdog.WriteTimeout))
+		}
+	}
+
+	start := s.clock.Now()
+	if watchdog.WriteTimeout <= 0 {
+		n, err := port.Write(b)
+		s.record(n, start, err)
+		return n, err
+	}
+
+	// The write may outlive this call, so it gets its own copy of b
+	write := &pendingWrite{done: make(chan struct{})}
+	data := append([]byte{}, b...)
+	go func() {
+		n, err := port.Write(data)
+		s.mu.Lock()
+		write.n, write.err, write.finished = n, err, true
+		if write.timedOut {
+			// The caller has already returned, account for the bytes the write did send
+			end := s.clock.Now()
+			s.meter.record(n, end.Sub(start), err, end)
+		}
+		s.mu.Unlock()
+		close(write.done)
+	}()
+	timeout := watchdog.WriteTimeout + s.transmitTime(len(b))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-write.done:
+		s.record(write.n, start, write.err)
+		return write.n, write.err
+	case <-timer.C:
+		s.mu.Lock()
+		if write.finished {
+			// The write returned just as the timer fired
+			s.mu.Unlock()
+			s.record(write.n, start, write.err)
+			return write.n, write.err
+		}
+		write.timedOut = true
+		if s.port == port {
+			s.pending = write
+		}
+		s.mu.Unlock()
+		return 0, s.timedOut(fmt.Errorf("%w after %s", ErrSerialWriteTimeout, timeout))
+	}
+}
+
+// transmitTime returns how long n bytes take to send at the baud rate.
+func (s *SerialConnection) transmitTime(n int) time.Duration {
+	s.mu.Lock()
+	baud := s.meter.stats.BaudRate
+	s.mu.Unlock()
+	if baud <= 0 {
+		return 0
+	}
+	return time.Duration(int64(n) * serialBitsPerByte * int64(time.Second) / int64(baud))
+}
+
+// record accounts for a completed write that started at start, resetting the watchdog if it succeeded.
+func (s *SerialConnection) record(n int, start time.Time, err error) {
+	end := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meter.record(n, end.Sub(start), err, end)
+	if err == nil {
+		s.timeouts, s.reopens = 0, 0
+	}
+}
+
+// timedOut accounts for a timed out write, reopening the device once it is stuck or giving up if reopening didn't
+// help. It returns the error for the write.
+func (s *SerialConnection) timedOut(err error) error {
+	s.mu.Lock()
+	s.meter.timeout()
+	s.timeouts++
+	watchdog := s.watchdog
+	if watchdog.StuckAfter <= 0 || s.timeouts < watchdog.StuckAfter {
+		s.mu.Unlock()
+		return err
+	}
+
+	var stuckErr error
+	if s.reopens >= watchdog.MaxReopens || s.open == nil {
+		stuckErr = fmt.Errorf("%w: %d writes timed out after %d reopens", ErrSerialStuck, s.timeouts, s.reopens)
+		s.mu.Unlock()
+	} else {
+		// Reopening waits for the stuck port to close, so it mustn't hold up Stats and the budget meanwhile. Only
+		// writes, serialized by writeMu, reopen the port.
+		old, timeouts := s.port, s.timeouts
+		reopening := make(chan struct{})
+		s.reopening = reopening
+		s.mu.Unlock()
+		port, reopenErr := s.reopen(old, watchdog.WriteTimeout)
+		s.mu.Lock()
+		s.reopening = nil
+		close(reopening)
+		if reopenErr != nil {
+			stuckErr = fmt.Errorf("%w: %d writes timed out and reopening failed: %w", ErrSerialStuck, timeouts, reopenErr)
+		} else {
+			s.port = port
+			s.pending = nil
+			s.timeouts = 0
+			s.reopens++
+			s.meter.reopened()
+		}
+		s.mu.Unlock()
+	}
+
+	if stuckErr == nil {
+		return fmt.Errorf("%w, reopened the device", err)
+	}
+	if watchdog.OnStuck != nil {
+		watchdog.OnStuck(stuckErr)
+	}
+	return stuckErr
+}
+
+// reopen closes old and opens the device again, waiting up to timeout for the close as it may block on the stuck
+// write. The caller must not hold mu.
+func (s *SerialConnection) reopen(old serial.Port, timeout time.Duration) (serial.Port, error) {
+	closed := make(chan struct{})
+	go func() {
+		_ = old.Close()
+		close(closed)
+	}()
+	timer := time.NewTimer(timeout)
+	select {
+	case <-closed:
+		timer.Stop()
+	case <-timer.C:
+	}
+	return s.open()
+}
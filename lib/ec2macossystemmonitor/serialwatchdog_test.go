@@ -0,0 +1,155 @@
+package ec2macossystemmonitor
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// TestSerialWatchdog checks writes to a blocked port time out, a stuck port is reopened once and then given up on,
+// and the connection recovers when the port unblocks, counting the bytes of the write that timed out
+func TestSerialWatchdog(t *testing.T) {
+	clock := newFakeClock()
+	first := &fakePort{clock: clock, block: make(chan struct{})}
+	second := &fakePort{clock: clock, block: make(chan struct{})}
+	t.Cleanup(func() { close(first.block) })
+	conn := newSerialConnection(first, DefaultBaudRate, clock)
+	opened := 0
+	conn.open = func() (serial.Port, error) {
+		// The device is held exclusively, it can't be opened again until the stuck port is closed
+		if !first.isClosed() {
+			return nil, errors.New("device busy")
+		}
+		opened++
+		return second, nil
+	}
+	var mu sync.Mutex
+	var stuck []error
+	conn.SetWatchdog(SerialWatchdog{
+		WriteTimeout: 10 * time.Millisecond,
+		StuckAfter:   2,
+		MaxReopens:   1,
+		OnStuck: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			stuck = append(stuck, err)
+		},
+	})
+
+	steps := []struct {
+		name    string
+		wantErr error
+		reopens int
+		stuck   int
+	}{
+		{"blocked", ErrSerialWriteTimeout, 0, 0},
+		{"still blocked and reopened", ErrSerialWriteTimeout, 1, 0},
+		{"reopened port blocked", ErrSerialWriteTimeout, 1, 0},
+		{"stuck", ErrSerialStuck, 1, 1},
+	}
+	for _, step := range steps {
+		start := time.Now()
+		n, err := conn.WriteFrame(Frame{Tag: "cpuutil", Bytes: []byte("frame\n")})
+		if !errors.Is(err, step.wantErr) || n != 0 {
+			t.Fatalf("%s: WriteFrame() = %d, %v, want %v", step.name, n, err, step.wantErr)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: WriteFrame() took %s", step.name, elapsed)
+		}
+		mu.Lock()
+		gotStuck := len(stuck)
+		mu.Unlock()
+		if opened != step.reopens || gotStuck != step.stuck {
+			t.Errorf("%s: reopened %d times and stuck %d times, want %d and %d", step.name, opened, gotStuck, step.reopens, step.stuck)
+		}
+	}
+	if stats := conn.Stats(); stats.Timeouts != 4 || stats.Reopens != 1 || stats.Writes != 0 {
+		t.Errorf("Stats() = %+v, want 4 timeouts, 1 reopen and no writes", stats)
+	}
+
+	// Once the port drains, the blocked write completes and writes succeed again
+	close(second.block)
+	if _, err := conn.WriteFrame(Frame{Tag: "cpuutil", Bytes: []byte("recovered\n")}); err != nil {
+		t.Fatalf("WriteFrame() after unblocking error = %v", err)
+	}
+	if got, want := string(second.bytes()), "frame\nrecovered\n"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+	if _, err := conn.WriteFrame(Frame{Tag: "cpuutil", Bytes: []byte("again\n")}); err != nil {
+		t.Errorf("WriteFrame() after recovering error = %v", err)
+	}
+	if conn.timeouts != 0 || conn.reopens != 0 {
+		t.Errorf("watchdog counts after recovering = %d timeouts, %d reopens, want 0", conn.timeouts, conn.reopens)
+	}
+	if stats := conn.Stats(); stats.Writes != 3 || stats.Bytes != int64(len("frame\nrecovered\nagain\n")) {
+		t.Errorf("Stats() = %+v, want 3 writes including the one that timed out", stats)
+	}
+}
+
+// closeBlockingPort is a fakePort whose Close blocks, like closing a port with a write stuck in the driver.
+type closeBlockingPort struct {
+	*fakePort
+	closing chan struct{}
+	release chan struct{}
+}
+
+func (p *closeBlockingPort) Close() error {
+	close(p.closing)
+	<-p.release
+	return p.fakePort.Close()
+}
+
+// TestSerialWatchdogReopenUnlocked checks the stats and budget can be read while reopening waits for the stuck port to
+// close
+func TestSerialWatchdogReopenUnlocked(t *testing.T) {
+	clock := newFakeClock()
+	first := &closeBlockingPort{
+		fakePort: &fakePort{clock: clock, block: make(chan struct{})},
+		closing:  make(chan struct{}),
+		release:  make(chan struct{}),
+	}
+	t.Cleanup(func() { close(first.block) })
+	conn := newSerialConnection(first, DefaultBaudRate, clock)
+	second := &fakePort{clock: clock}
+	conn.open = func() (serial.Port, error) { return second, nil }
+	conn.SetWatchdog(SerialWatchdog{WriteTimeout: time.Second, StuckAfter: 1, MaxReopens: 1})
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.WriteFrame(Frame{Tag: "cpuutil", Bytes: []byte("frame\n")})
+		written <- err
+	}()
+	<-first.closing
+	statsDone := make(chan LinkStats, 1)
+	go func() { statsDone <- conn.Stats() }()
+	select {
+	case stats := <-statsDone:
+		if stats.Timeouts != 1 || stats.Reopens != 0 {
+			t.Errorf("Stats() while reopening = %+v, want 1 timeout and no reopens yet", stats)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Stats() blocked while the stuck port was closing")
+	}
+	close(first.release)
+
+	if err := <-written; !errors.Is(err, ErrSerialWriteTimeout) {
+		t.Fatalf("WriteFrame() error = %v, want %v", err, ErrSerialWriteTimeout)
+	}
+	if stats := conn.Stats(); stats.Reopens != 1 {
+		t.Errorf("Stats() = %+v, want 1 reopen", stats)
+	}
+	if _, err := conn.WriteFrame(Frame{Tag: "cpuutil", Bytes: []byte("reopened\n")}); err != nil {
+		t.Errorf("WriteFrame() after reopening error = %v", err)
+	}
+}
+
+// TestSerialWatchdogTransmitTime checks the timeout allows for the time the bytes take at the baud rate
+func TestSerialWatchdogTransmitTime(t *testing.T) {
+	conn := newSerialConnection(&fakePort{clock: newFakeClock()}, 9600, newFakeClock())
+	if got, want := conn.transmitTime(960), time.Second; got != want {
+		t.Errorf("transmitTime(960) = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,242 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ForwardTimeout bounds dialing and writing for a ForwardSink so an unreachable destination can't stall the relay.
+const ForwardTimeout = 2 * time.Second
+
+// ForwardBackoff is how long a ForwardSink waits before redialing after a failure, doubling with each failure in a row
+// up to ForwardMaxBackoff.
+const (
+	ForwardBackoff    = time.Second
+	ForwardMaxBackoff = time.Minute
+)
+
+// Frame is a single message received by the relay.
+type Frame struct {
+	// Tag is the payload tag, empty if the frame couldn't be parsed.
+	Tag string
+	// Bytes is the frame exactly as received, including the trailing newline.
+	Bytes []byte
+}
+
+// Sink is a destination the relay writes frames to. Each sink fails independently, an error from one sink doesn't
+// prevent the frame being written to the others.
+type Sink interface {
+	// Name identifies the sink in logs.
+	Name() string
+	// WriteFrame writes a single frame, returning the number of bytes written.
+	WriteFrame(frame Frame) (n int, err error)
+	// Close releases the sink's resources.
+	Close() error
+}
+
+// sinkRoute is a Sink with the tags it accepts.
+type sinkRoute struct {
+	sink Sink
+	// tags are the accepted tags, all tags are accepted if empty.
+	tags map[string]bool
+}
+
+// accepts returns true if the route should receive frames with tag.
+func (r sinkRoute) accepts(tag string) bool {
+	return len(r.tags) == 0 || r.tags[tag]
+}
+
+// newSinkRoute creates a route to sink for tags.
+func newSinkRoute(sink Sink, tags []string) sinkRoute {
+	route := sinkRoute{sink: sink}
+	if len(tags) > 0 {
+		route.tags = make(map[string]bool, len(tags))
+		for _, tag := range tags {
+			route.tags[tag] = true
+		}
+	}
+	return route
+}
+
+// frameTag returns the tag of a frame built by BuildMessage, or an empty string if it can't be parsed.
+func frameTag(frame []byte) string {
+	if bytes.HasPrefix(frame, binaryMagic) {
+		return binaryFrameTag(frame)
+	}
+	var msg SerialMessage
+	if err := json.Unmarshal(frame, &msg); err != nil {
+		return ""
+	}
+	var payload SerialPayload
+	if err := json.Unmarshal([]byte(msg.Payload), &payload); err != nil {
+		return ""
+	}
+	return payload.Tag
+}
+
+// Name returns "serial" for the serial device sink.
+func (s *SerialConnection) Name() string {
+	return "serial"
+}
+
+// WriteFrame writes the frame to the serial device, unless it is shed to keep within the budget.
+func (s *SerialConnection) WriteFrame(frame Frame) (n int, err error) {
+	if err := s.admit(frame); err != nil {
+		return 0, err
+	}
+	n, err = s.write(frame.Bytes)
+	if err != nil {
+		return n, fmt.Errorf("ec2macossystemmonitor: failed to write frame to serial: %w", err)
+	}
+	return n, nil
+}
+
+// WriterSink is a Sink that writes frames to an io.Writer, such as stdout for debugging or a LogFile for archiving.
+type WriterSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterSink creates a WriterSink named name writing to w. If w is also an io.Closer it's closed with the sink.
+func NewWriterSink(name string, w io.Writer) *WriterSink {
+	return &WriterSink{name: name, w: w}
+}
+
+// NewArchiveSink creates a WriterSink that archives frames to a rotating file at path.
+func NewArchiveSink(path string, rotation LogRotation) (*WriterSink, error) {
+	f, err := OpenLogFile(path, rotation)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterSink("archive", f), nil
+}
+
+// Name returns the name of the sink.
+func (s *WriterSink) Name() string {
+	return s.name
+}
+
+// WriteFrame writes the frame to the writer.
+func (s *WriterSink) WriteFrame(frame Frame) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.w.Write(frame.Bytes)
+}
+
+// Close closes the writer if it's an io.Closer.
+func (s *WriterSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ForwardSink is a Sink that forwards frames over TCP or UDP. The connection is dialed on first use and redialed after
+// a failure once the backoff has passed, frames written in the meantime are dropped.
+type ForwardSink struct {
+	network string
+	address string
+	timeout time.Duration
+	clock   Clock
+	dial    func(network, address string, timeout time.Duration) (net.Conn, error)
+
+	mu   sync.Mutex
+	conn net.Conn
+	// failures counts the failures in a row, retryAt is when the sink may dial again after the last of them.
+	failures int
+	retryAt  time.Time
+}
+
+// NewForwardSink creates a ForwardSink for network ("tcp" or "udp") and address.
+func NewForwardSink(network, address string) (*ForwardSink, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("ec2macossystemmonitor: unsupported forward network %q", network)
+	}
+	return &ForwardSink{
+		network: network,
+		address: address,
+		timeout: ForwardTimeout,
+		clock:   systemClock{},
+		dial:    net.DialTimeout,
+	}, nil
+}
+
+// ParseForwardSink creates a ForwardSink from a URL such as tcp://127.0.0.1:9000 or udp://127.0.0.1:9000.
+func ParseForwardSink(rawURL string) (*ForwardSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: invalid forward URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("ec2macossystemmonitor: forward URL %q has no address", rawURL)
+	}
+	return NewForwardSink(u.Scheme, u.Host)
+}
+
+// Name returns the forwarding destination.
+func (s *ForwardSink) Name() string {
+	return "forward-" + s.network + "://" + s.address
+}
+
+// WriteFrame sends the frame, dialing first if not connected. It returns an error wrapping ErrFrameDropped without
+// dialing while backing off after a failure.
+func (s *ForwardSink) WriteFrame(frame Frame) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if wait := s.retryAt.Sub(s.clock.Now()); wait > 0 {
+			return 0, fmt.Errorf("%w: %s is unreachable, retrying in %s", ErrFrameDropped, s.address, wait.Round(time.Millisecond))
+		}
+		conn, err := s.dial(s.network, s.address, s.timeout)
+		if err != nil {
+			s.backoff()
+			return 0, fmt.Errorf("ec2macossystemmonitor: unable to connect to %s: %w", s.address, err)
+		}
+		s.conn = conn
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	n, err = s.conn.Write(frame.Bytes)
+	if err != nil {
+		// Drop the connection so it is redialed after the backoff.
+		_ = s.conn.Close()
+		s.conn = nil
+		s.backoff()
+		return n, fmt.Errorf("ec2macossystemmonitor: unable to forward to %s: %w", s.address, err)
+	}
+	s.failures = 0
+	return n, nil
+}
+
+// backoff delays the next dial after a failure, doubling the delay for each failure in a row.
+func (s *ForwardSink) backoff() {
+	wait := ForwardMaxBackoff
+	if s.failures < 16 {
+		wait = min(ForwardBackoff<<s.failures, ForwardMaxBackoff)
+	}
+	s.failures++
+	s.retryAt = s.clock.Now().Add(wait)
+}
+
+// Close closes the connection, if any.
+func (s *ForwardSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,279 @@
+package ec2macossystemmonitor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink is a Sink that keeps frames in memory, failing every write when err is set.
+type memorySink struct {
+	name   string
+	err    error
+	mu     sync.Mutex
+	frames []Frame
+}
+
+func (s *memorySink) Name() string { return s.name }
+
+func (s *memorySink) WriteFrame(frame Frame) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.frames = append(s.frames, Frame{Tag: frame.Tag, Bytes: append([]byte{}, frame.Bytes...)})
+	return len(frame.Bytes), nil
+}
+
+func (s *memorySink) Close() error { return nil }
+
+func (s *memorySink) tags() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tags []string
+	for _, f := range s.frames {
+		tags = append(tags, f.Tag)
+	}
+	return tags
+}
+
+// relayFrames writes frames over a pipe to relay.relayConnection and waits for it to finish, closing the sinks so
+// frames queued for them are written.
+func relayFrames(t *testing.T, relay *SerialRelay, frames ...[]byte) {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		relay.relayConnection(server, NewLogAggregator(&Logger{}, time.Minute))
+		close(done)
+	}()
+	for _, f := range frames {
+		if _, err := client.Write(f); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	_ = client.Close()
+	<-done
+	for _, route := range relay.sinks {
+		_ = route.sink.Close()
+	}
+}
+
+// mustBuildMessage builds a message or fails the test.
+func mustBuildMessage(t testing.TB, tag string, data string) []byte {
+	t.Helper()
+	msg, err := BuildMessage(tag, data, false)
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	return msg
+}
+
+// TestRelayFanOut checks frames reach every sink accepting their tag and a failing sink doesn't affect the others
+func TestRelayFanOut(t *testing.T) {
+	all := &memorySink{name: "all"}
+	cpuOnly := &memorySink{name: "cpu"}
+	failing := &memorySink{name: "failing", err: errors.New("broken")}
+	relay := &SerialRelay{}
+	relay.AddSink(failing)
+	relay.AddSink(all)
+	relay.AddSink(cpuOnly, "cpuutil")
+
+	cpu := mustBuildMessage(t, "cpuutil", "2.0")
+	other := mustBuildMessage(t, "other", "data")
+	// Both frames arrive in one write to check they are split.
+	relayFrames(t, relay, append(append([]byte{}, cpu...), other...), []byte("not json"))
+
+	if got, want := all.tags(), []string{"cpuutil", "other", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("all sink got tags %q, want %q", got, want)
+	}
+	if got, want := cpuOnly.tags(), []string{"cpuutil"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("filtered sink got tags %q, want %q", got, want)
+	}
+	if !bytes.Equal(all.frames[0].Bytes, cpu) || !bytes.Equal(all.frames[2].Bytes, []byte("not json")) {
+		t.Error("frames were not relayed unchanged")
+	}
+}
+
+// TestForwardSink forwards frames over TCP and checks the sink redials after the connection is lost
+func TestForwardSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer listener.Close()
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	sink, err := ParseForwardSink("tcp://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("ParseForwardSink() error = %v", err)
+	}
+	defer sink.Close()
+
+	if _, err := sink.WriteFrame(Frame{Bytes: []byte("first\n")}); err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+	// Simulate a dropped connection, the next write should reconnect.
+	_ = sink.Close()
+	if _, err := sink.WriteFrame(Frame{Bytes: []byte("second\n")}); err != nil {
+		t.Fatalf("WriteFrame() after reconnect error = %v", err)
+	}
+
+	// Each frame arrives on its own connection so they may be read in either order.
+	var got []string
+	for len(got) < 2 {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for frames, received %q", got)
+		}
+	}
+	sort.Strings(got)
+	if want := []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
+
+// TestParseForwardSink checks forward URLs are validated
+func TestParseForwardSink(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"tcp://127.0.0.1:9000", false},
+		{"udp://127.0.0.1:9000", false},
+		{"http://127.0.0.1:9000", true},
+		{"tcp://", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if _, err := ParseForwardSink(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("ParseForwardSink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestForwardSinkBackoff checks a ForwardSink drops frames rather than redial while backing off, doubling the backoff
+// for each failure in a row and resetting it once a frame is forwarded
+func TestForwardSinkBackoff(t *testing.T) {
+	clock := newFakeClock()
+	sink, err := NewForwardSink("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatalf("NewForwardSink() error = %v", err)
+	}
+	sink.clock = clock
+	dials := 0
+	reachable := false
+	sink.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dials++
+		if !reachable {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		go func() { _, _ = io.Copy(io.Discard, server) }()
+		return client, nil
+	}
+	defer sink.Close()
+
+	steps := []struct {
+		name      string
+		advance   time.Duration
+		reachable bool
+		dials     int
+		dropped   bool
+	}{
+		{"first failure", 0, false, 1, false},
+		{"backing off", 0, false, 1, true},
+		{"redial after a second", time.Second, false, 2, false},
+		{"backoff doubled", time.Second, false, 2, true},
+		{"redial after two seconds", time.Second, true, 3, false},
+		{"connected", 0, true, 3, false},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		reachable = step.reachable
+		_, err := sink.WriteFrame(Frame{Bytes: []byte("frame\n")})
+		if dropped := errors.Is(err, ErrFrameDropped); dropped != step.dropped || dials != step.dials {
+			t.Errorf("%s: WriteFrame() error = %v after %d dials, want dropped %t after %d dials", step.name, err, dials, step.dropped, step.dials)
+		}
+		if step.reachable && err != nil {
+			t.Errorf("%s: WriteFrame() error = %v", step.name, err)
+		}
+	}
+	if sink.failures != 0 {
+		t.Errorf("failures after forwarding = %d, want 0", sink.failures)
+	}
+}
+
+// TestRelayBlackholedForwarder checks a forwarder that can't connect doesn't hold up frames for the serial device
+func TestRelayBlackholedForwarder(t *testing.T) {
+	path := tempSocketPath(t)
+	forward, err := NewForwardSink("tcp", "192.0.2.1:9000")
+	if err != nil {
+		t.Fatalf("NewForwardSink() error = %v", err)
+	}
+	// The destination never answers, dialing blocks until the test ends
+	release := make(chan struct{})
+	dialing := make(chan struct{}, 1)
+	forward.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		select {
+		case dialing <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil, errors.New("i/o timeout")
+	}
+	serial := &memorySink{name: "serial"}
+	startRelay(t, path, forward, func(relay *SerialRelay) {
+		relay.sinks = append([]sinkRoute{newSinkRoute(serial, nil)}, relay.sinks...)
+		relay.serial = true
+	})
+	// Cleanups run in reverse, so the dial is released before the relay is stopped
+	t.Cleanup(func() { close(release) })
+
+	client := NewClient(WithSocketPath(path))
+	start := time.Now()
+	const frames = 5
+	for i := 0; i < frames; i++ {
+		if _, err := client.Send(context.Background(), "cpuutil", "2.0"); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	if got := waitFrames(t, serial, frames); len(got) != frames {
+		t.Fatalf("serial sink got %d frames, want %d", len(got), frames)
+	}
+	if elapsed := time.Since(start); elapsed >= ForwardTimeout {
+		t.Errorf("serial sink took %s to receive the frames", elapsed)
+	}
+	select {
+	case <-dialing:
+	case <-time.After(5 * time.Second):
+		t.Error("forwarder never dialed")
+	}
+}
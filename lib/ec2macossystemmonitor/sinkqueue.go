@@ -0,0 +1,252 @@
+package ec2macossystemmonitor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultSinkQueueSize is the default number of bytes a QueueingSink queues.
+const DefaultSinkQueueSize = 256 * 1024
+
+// frameQueue holds the frames a backgroundWriter writes, its methods are called with the writer's lock held.
+type frameQueue interface {
+	// push queues frame at now, returning an error wrapping ErrFrameDropped if it is dropped instead.
+	push(frame Frame, now time.Time) error
+	// next removes and returns the next frame to write at now. If no frame may be written yet it returns false and how
+	// long until one may be, or 0 if nothing is queued. With flush set, queued frames are returned without waiting.
+	next(now time.Time, flush bool) (Frame, time.Duration, bool)
+	// sent counts a frame written by the sink.
+	sent(frame Frame)
+	// dropped counts a frame the sink dropped.
+	dropped(frame Frame)
+}
+
+// backgroundWriter queues frames and writes them to a sink from its own goroutine, so the caller isn't held up by a
+// slow sink. It is shared by the sinks that queue frames, which decide the order frames are written in with their
+// frameQueue.
+type backgroundWriter struct {
+	sink  Sink
+	clock Clock
+	// wake is signaled when a frame is queued.
+	wake chan struct{}
+	// done is closed by close to stop writing, stopped is closed once the writer has returned.
+	done    chan struct{}
+	stopped chan struct{}
+	// closed makes close idempotent, closeErr is the result of the first call.
+	closed   sync.Once
+	closeErr error
+
+	mu    sync.Mutex
+	queue frameQueue
+	err   error
+}
+
+// newBackgroundWriter creates a backgroundWriter writing frames from queue to sink.
+func newBackgroundWriter(sink Sink, queue frameQueue, clock Clock) *backgroundWriter {
+	w := &backgroundWriter{
+		sink:    sink,
+		clock:   clock,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		queue:   queue,
+	}
+	go w.run()
+	return w
+}
+
+// writeFrame queues a copy of the frame, returning its length or an error wrapping ErrFrameDropped if it was dropped.
+// The first error writing frames in the background since the last call is returned instead.
+func (w *backgroundWriter) writeFrame(frame Frame) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	frame.Bytes = append([]byte{}, frame.Bytes...)
+	pushErr := w.queue.push(frame, w.clock.Now())
+	if pushErr == nil {
+		n = len(frame.Bytes)
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+	// A failed write of an earlier frame takes precedence over this frame being dropped
+	if err = w.result(); err == nil {
+		err = pushErr
+	}
+	return n, err
+}
+
+// close writes the queued frames without waiting and closes the sink, returning the result of the first call.
+func (w *backgroundWriter) close() error {
+	w.closed.Do(func() {
+		close(w.done)
+		<-w.stopped
+		for {
+			w.mu.Lock()
+			frame, _, ok := w.queue.next(w.clock.Now(), true)
+			w.mu.Unlock()
+			if !ok {
+				break
+			}
+			w.write(frame)
+		}
+		w.mu.Lock()
+		err := w.result()
+		w.mu.Unlock()
+		w.closeErr = errors.Join(err, w.sink.Close())
+	})
+	return w.closeErr
+}
+
+// run writes queued frames as the queue releases them until close is called.
+func (w *backgroundWriter) run() {
+	defer close(w.stopped)
+	for {
+		w.mu.Lock()
+		frame, wait, ok := w.queue.next(w.clock.Now(), false)
+		w.mu.Unlock()
+		if ok {
+			w.write(frame)
+			continue
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-w.done:
+			return
+		case <-w.wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// write writes frame to the sink, keeping the first error until it is reported.
+func (w *backgroundWriter) write(frame Frame) {
+	_, err := w.sink.WriteFrame(frame)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if errors.Is(err, ErrFrameDropped) {
+		// The frame was shed by the sink, such as the serial device over its budget, counting it here keeps it with
+		// its own tag rather than reporting it with a later frame
+		w.queue.dropped(frame)
+		return
+	}
+	if err != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return
+	}
+	w.queue.sent(frame)
+}
+
+// result returns and resets the error since the last call.
+func (w *backgroundWriter) result() error {
+	err := w.err
+	w.err = nil
+	return err
+}
+
+// fifoQueue is a frameQueue writing frames in the order they arrive, dropping frames once it holds size bytes.
+type fifoQueue struct {
+	name   string
+	size   int
+	frames []Frame
+	bytes  int
+	// drops counts the frames dropped, reported is drops at the last summary.
+	drops    int64
+	reported int64
+}
+
+func (q *fifoQueue) push(frame Frame, now time.Time) error {
+	if q.bytes > 0 && q.bytes+len(frame.Bytes) > q.size {
+		q.drops++
+		return fmt.Errorf("%w: %s: queue is full", ErrFrameDropped, q.name)
+	}
+	q.frames = append(q.frames, frame)
+	q.bytes += len(frame.Bytes)
+	return nil
+}
+
+func (q *fifoQueue) next(now time.Time, flush bool) (Frame, time.Duration, bool) {
+	if len(q.frames) == 0 {
+		return Frame{}, 0, false
+	}
+	frame := q.frames[0]
+	q.frames[0] = Frame{}
+	q.frames = q.frames[1:]
+	q.bytes -= len(frame.Bytes)
+	return frame, 0, true
+}
+
+func (q *fifoQueue) sent(frame Frame) {}
+
+func (q *fifoQueue) dropped(frame Frame) {
+	q.drops++
+}
+
+// QueueingSink is a Sink that writes frames to another sink in the background, so a slow or unreachable sink, such as
+// a ForwardSink to a destination that is down, can't hold up the relay writing to the others. Frames are written in
+// the order they arrive and dropped once the queue is full.
+//
+// WriteFrame returns the length of a queued frame, or an error wrapping ErrFrameDropped for a dropped frame. Frames
+// written in the background report their errors from the next call to WriteFrame or Close, except frames the
+// underlying sink drops, which are only counted in Dropped and Summary.
+type QueueingSink struct {
+	writer *backgroundWriter
+	queue  *fifoQueue
+}
+
+// NewQueueingSink creates a QueueingSink writing to sink and queueing up to queueSize bytes, or DefaultSinkQueueSize
+// if zero.
+func NewQueueingSink(sink Sink, queueSize int) *QueueingSink {
+	if queueSize <= 0 {
+		queueSize = DefaultSinkQueueSize
+	}
+	queue := &fifoQueue{name: sink.Name(), size: queueSize}
+	return &QueueingSink{writer: newBackgroundWriter(sink, queue, systemClock{}), queue: queue}
+}
+
+// Name returns the name of the underlying sink.
+func (q *QueueingSink) Name() string {
+	return q.writer.sink.Name()
+}
+
+// WriteFrame queues the frame to be written in the background.
+func (q *QueueingSink) WriteFrame(frame Frame) (n int, err error) {
+	return q.writer.writeFrame(frame)
+}
+
+// Close writes the queued frames and closes the underlying sink. Later calls return the result of the first.
+func (q *QueueingSink) Close() error {
+	return q.writer.close()
+}
+
+// Dropped returns the number of frames dropped so far, by the queue being full or by the underlying sink.
+func (q *QueueingSink) Dropped() int64 {
+	q.writer.mu.Lock()
+	defer q.writer.mu.Unlock()
+	return q.queue.drops
+}
+
+// Summary is a SummaryFunc logging the frames dropped since the previous summary, it is skipped if none were dropped.
+func (q *QueueingSink) Summary() (string, []any) {
+	q.writer.mu.Lock()
+	defer q.writer.mu.Unlock()
+	n := q.queue.drops - q.queue.reported
+	q.queue.reported = q.queue.drops
+	if n == 0 {
+		return "", nil
+	}
+	return "[relayd] Dropped frames for " + q.Name(), []any{"dropped_frames", n}
+}
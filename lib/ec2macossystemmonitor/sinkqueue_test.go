@@ -0,0 +1,57 @@
+package ec2macossystemmonitor
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestQueueingSink checks frames are written in the background in order, frames are dropped once the queue is full,
+// the drops are summarized and the sink can be closed twice
+func TestQueueingSink(t *testing.T) {
+	out := &blockingSink{memorySink: memorySink{name: "out"}, unblock: make(chan struct{})}
+	q := NewQueueingSink(out, 10)
+
+	// The first frame is taken by the writer, which blocks, and the next two fill the queue
+	for i, tag := range []string{"first", "second", "third"} {
+		if n, err := q.WriteFrame(Frame{Tag: tag, Bytes: []byte("12345")}); n != 5 || err != nil {
+			t.Fatalf("WriteFrame(%s) = %d, %v, want the frame's 5 bytes", tag, n, err)
+		}
+		if i == 0 {
+			// Wait for the writer to take the first frame off the queue
+			for {
+				q.writer.mu.Lock()
+				queued := len(q.queue.frames)
+				q.writer.mu.Unlock()
+				if queued == 0 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if _, err := q.WriteFrame(Frame{Tag: "fourth", Bytes: []byte("12345")}); !errors.Is(err, ErrFrameDropped) {
+		t.Errorf("WriteFrame() on a full queue error = %v, want %v", err, ErrFrameDropped)
+	}
+	if got := q.Dropped(); got != 1 {
+		t.Errorf("Dropped() = %d, want 1", got)
+	}
+	if msg, kv := q.Summary(); msg != "[relayd] Dropped frames for out" || !reflect.DeepEqual(kv, []any{"dropped_frames", int64(1)}) {
+		t.Errorf("Summary() = %q, %v", msg, kv)
+	}
+	if msg, _ := q.Summary(); msg != "" {
+		t.Errorf("Summary() with no new drops = %q, want it skipped", msg)
+	}
+
+	close(out.unblock)
+	if err := q.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if err := q.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+	if got, want := out.tags(), []string{"first", "second", "third"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written tags = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,307 @@
+package ec2macossystemmonitor
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSchedulerQueueSize is the default number of bytes a SchedulingSink queues for each tag.
+const DefaultSchedulerQueueSize = 256 * 1024
+
+// OtherTags is the tag a SchedulingSink queues and counts the frames of all tags without a TagLimit under, so a client
+// sending many distinct tags can't make it track each of them. A TagLimit for OtherTags applies to those frames.
+const OtherTags = "*"
+
+// ErrFrameDropped is returned when a sink drops a frame rather than write it, such as a SchedulingSink with a full
+// queue or a SerialConnection over its budget.
+var ErrFrameDropped = errors.New("ec2macossystemmonitor: frame dropped")
+
+// Priority orders tags on the serial link, queued frames with a higher priority are always written first.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// priorities is the number of Priority values.
+const priorities = int(PriorityHigh-PriorityLow) + 1
+
+// ParsePriority parses a priority name: low, normal or high.
+func ParsePriority(name string) (Priority, error) {
+	switch name {
+	case "low":
+		return PriorityLow, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return 0, fmt.Errorf("ec2macossystemmonitor: unknown priority %q", name)
+}
+
+// TagLimit configures how a SchedulingSink writes frames with a tag.
+type TagLimit struct {
+	Priority Priority
+	// Rate limits the average bytes per second written for the tag, unlimited if zero. Bursts of up to Burst bytes, or
+	// a second of data if zero, are allowed.
+	Rate  int
+	Burst int
+	// Drop drops frames over the rate, otherwise they are queued until the rate allows them to be written.
+	Drop bool
+}
+
+// ParseTagLimits parses comma separated tag limits of the form tag:priority[:rate[:drop]], such as
+// "cpuutil:high,emf:low:2048,debug:low:512:drop". The tag OtherTags limits all tags without their own limit.
+func ParseTagLimits(spec string) (map[string]TagLimit, error) {
+	limits := make(map[string]TagLimit)
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		parts := strings.Split(field, ":")
+		if len(parts) < 2 || len(parts) > 4 || parts[0] == "" {
+			return nil, fmt.Errorf("ec2macossystemmonitor: tag limit %q isn't tag:priority[:rate[:drop]]", field)
+		}
+		var limit TagLimit
+		var err error
+		if limit.Priority, err = ParsePriority(parts[1]); err != nil {
+			return nil, err
+		}
+		if len(parts) > 2 {
+			if limit.Rate, err = strconv.Atoi(parts[2]); err != nil || limit.Rate < 0 {
+				return nil, fmt.Errorf("ec2macossystemmonitor: invalid rate %q for tag %s", parts[2], parts[0])
+			}
+		}
+		if len(parts) > 3 {
+			if parts[3] != "drop" {
+				return nil, fmt.Errorf("ec2macossystemmonitor: tag limit %q isn't tag:priority[:rate[:drop]]", field)
+			}
+			limit.Drop = true
+		}
+		limits[parts[0]] = limit
+	}
+	return limits, nil
+}
+
+// TagStats counts the frames with a tag written and dropped by a SchedulingSink.
+type TagStats struct {
+	SentFrames    int64
+	SentBytes     int64
+	DroppedFrames int64
+	DroppedBytes  int64
+}
+
+// tagQueue holds the queued frames of a tag, or of all tags without a limit.
+type tagQueue struct {
+	tag    string
+	limit  TagLimit
+	bucket *tokenBucket
+	frames []Frame
+	bytes  int
+}
+
+// frameScheduler queues frames by tag and picks the next frame to write: the highest priority wins, tags with the
+// same priority take turns frame by frame, and tags over their rate are skipped until they may send again. It is not
+// safe for concurrent use.
+type frameScheduler struct {
+	limits    map[string]TagLimit
+	queueSize int
+	queues    map[string]*tagQueue
+	// active holds the queues with frames for each priority, from high to low, in the order they take turns.
+	active [priorities][]*tagQueue
+	stats  map[string]*TagStats
+}
+
+// newFrameScheduler creates a frameScheduler queueing up to queueSize bytes per tag with a limit, and up to queueSize
+// bytes for the other tags together.
+func newFrameScheduler(limits map[string]TagLimit, queueSize int) *frameScheduler {
+	return &frameScheduler{
+		limits:    limits,
+		queueSize: queueSize,
+		queues:    make(map[string]*tagQueue),
+		stats:     make(map[string]*TagStats),
+	}
+}
+
+// key returns the tag a frame with tag is queued and counted under, OtherTags if tag has no limit.
+func (s *frameScheduler) key(tag string) string {
+	if _, ok := s.limits[tag]; ok {
+		return tag
+	}
+	return OtherTags
+}
+
+// queue returns the queue for the frames with tag, creating it at now.
+func (s *frameScheduler) queue(tag string, now time.Time) *tagQueue {
+	tag = s.key(tag)
+	q, ok := s.queues[tag]
+	if !ok {
+		q = &tagQueue{tag: tag, limit: s.limits[tag]}
+		q.limit.Priority = max(PriorityLow, min(PriorityHigh, q.limit.Priority))
+		if q.limit.Rate > 0 {
+			burst := q.limit.Burst
+			if burst <= 0 {
+				burst = q.limit.Rate
+			}
+			q.bucket = newTokenBucket(float64(q.limit.Rate), float64(burst), now)
+		}
+		s.queues[tag] = q
+		s.stats[tag] = &TagStats{}
+	}
+	return q
+}
+
+// push queues frame at now, returning an error wrapping ErrFrameDropped if the tag's queue is full or, for tags that
+// drop rather than queue, the frame is over the rate.
+func (s *frameScheduler) push(frame Frame, now time.Time) error {
+	q := s.queue(frame.Tag, now)
+	var reason string
+	switch {
+	case q.bytes > 0 && q.bytes+len(frame.Bytes) > s.queueSize:
+		reason = "queue is full"
+	case q.limit.Drop && q.bucket != nil && !q.bucket.take(float64(len(frame.Bytes)), now):
+		reason = fmt.Sprintf("rate of %d bytes per second exceeded", q.limit.Rate)
+	}
+	if reason != "" {
+		s.dropped(frame)
+		return fmt.Errorf("%w: tag %q: %s", ErrFrameDropped, frame.Tag, reason)
+	}
+
+	if len(q.frames) == 0 {
+		i := PriorityHigh - q.limit.Priority
+		s.active[i] = append(s.active[i], q)
+	}
+	q.frames = append(q.frames, frame)
+	q.bytes += len(frame.Bytes)
+	return nil
+}
+
+// next removes and returns the next frame to write at now. If no frame may be written yet it returns false and how
+// long until one may be, or 0 if nothing is queued. With ignoreRates set, queued frames are returned regardless of
+// their tag's rate.
+func (s *frameScheduler) next(now time.Time, ignoreRates bool) (Frame, time.Duration, bool) {
+	var wait time.Duration
+	for i := range s.active {
+		for j, q := range s.active[i] {
+			frame := q.frames[0]
+			if q.bucket != nil && !q.limit.Drop && !ignoreRates && !q.bucket.take(float64(len(frame.Bytes)), now) {
+				if w := q.bucket.wait(float64(len(frame.Bytes)), now); wait == 0 || w < wait {
+					wait = w
+				}
+				continue
+			}
+			q.frames[0] = Frame{}
+			q.frames = q.frames[1:]
+			q.bytes -= len(frame.Bytes)
+			// Move the tag to the back so the others with the same priority go first
+			s.active[i] = append(s.active[i][:j], s.active[i][j+1:]...)
+			if len(q.frames) > 0 {
+				s.active[i] = append(s.active[i], q)
+			}
+			return frame, 0, true
+		}
+	}
+	return Frame{}, wait, false
+}
+
+// sent counts a written frame.
+func (s *frameScheduler) sent(frame Frame) {
+	stats := s.stats[s.key(frame.Tag)]
+	stats.SentFrames++
+	stats.SentBytes += int64(len(frame.Bytes))
+}
+
+// dropped counts a dropped frame.
+func (s *frameScheduler) dropped(frame Frame) {
+	stats := s.stats[s.key(frame.Tag)]
+	stats.DroppedFrames++
+	stats.DroppedBytes += int64(len(frame.Bytes))
+}
+
+// SchedulingSink is a Sink that shares the bandwidth of another sink, the serial device, between tags. Frames are
+// queued by tag and written in the background: queued frames of higher priority tags are always written first, tags
+// with the same priority take turns, and tags with a rate are shaped to it, or have frames over the rate dropped.
+// Frames are also dropped once their tag has a full queue. Tags without a TagLimit share the queue, limit and stats of
+// OtherTags, which has normal priority and no rate unless it has a TagLimit itself.
+//
+// WriteFrame returns the length of a queued frame, or an error wrapping ErrFrameDropped for a dropped frame. Frames
+// written in the background report their errors from the next call to WriteFrame or Close, except frames the
+// underlying sink drops, which are only counted for their tag in Stats and Summary.
+type SchedulingSink struct {
+	writer    *backgroundWriter
+	scheduler *frameScheduler
+	// reported holds the dropped frames of each tag at the last Summary, guarded by the writer's lock.
+	reported map[string]int64
+}
+
+// NewSchedulingSink creates a SchedulingSink writing to sink, limiting tags by limits and queueing up to queueSize
+// bytes per tag with a limit and for OtherTags, or DefaultSchedulerQueueSize if zero.
+func NewSchedulingSink(sink Sink, limits map[string]TagLimit, queueSize int) *SchedulingSink {
+	return newSchedulingSink(sink, limits, queueSize, systemClock{})
+}
+
+// newSchedulingSink creates a SchedulingSink using clock for the rates.
+func newSchedulingSink(sink Sink, limits map[string]TagLimit, queueSize int, clock Clock) *SchedulingSink {
+	if queueSize <= 0 {
+		queueSize = DefaultSchedulerQueueSize
+	}
+	scheduler := newFrameScheduler(limits, queueSize)
+	return &SchedulingSink{
+		writer:    newBackgroundWriter(sink, scheduler, clock),
+		scheduler: scheduler,
+		reported:  make(map[string]int64),
+	}
+}
+
+// Name returns the name of the underlying sink.
+func (s *SchedulingSink) Name() string {
+	return s.writer.sink.Name()
+}
+
+// WriteFrame queues the frame to be written in the background.
+func (s *SchedulingSink) WriteFrame(frame Frame) (n int, err error) {
+	return s.writer.writeFrame(frame)
+}
+
+// Close writes the queued frames, regardless of their tag's rate, and closes the underlying sink. Later calls return
+// the result of the first.
+func (s *SchedulingSink) Close() error {
+	return s.writer.close()
+}
+
+// Stats returns the frames written and dropped so far by tag, with tags without a TagLimit counted under OtherTags.
+func (s *SchedulingSink) Stats() map[string]TagStats {
+	s.writer.mu.Lock()
+	defer s.writer.mu.Unlock()
+	stats := make(map[string]TagStats, len(s.scheduler.stats))
+	for tag, tagStats := range s.scheduler.stats {
+		stats[tag] = *tagStats
+	}
+	return stats
+}
+
+// Summary is a SummaryFunc logging the frames dropped for each tag since the previous summary, it is skipped if none
+// were dropped.
+func (s *SchedulingSink) Summary() (string, []any) {
+	s.writer.mu.Lock()
+	defer s.writer.mu.Unlock()
+	var tags []string
+	var total int64
+	for _, tag := range sortedKeys(s.scheduler.stats) {
+		dropped := s.scheduler.stats[tag].DroppedFrames
+		if n := dropped - s.reported[tag]; n > 0 {
+			tags = append(tags, fmt.Sprintf("%s %d", tag, n))
+			total += n
+		}
+		s.reported[tag] = dropped
+	}
+	if total == 0 {
+		return "", nil
+	}
+	return "[relayd] Dropped frames by tag: " + strings.Join(tags, ", "), []any{"dropped_frames", total}
+}
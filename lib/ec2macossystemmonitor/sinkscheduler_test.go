@@ -0,0 +1,227 @@
+package ec2macossystemmonitor
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFrameScheduler checks the order frames are released in, and that rates shape or drop frames
+func TestFrameScheduler(t *testing.T) {
+	frame := func(tag string, size int) Frame {
+		return Frame{Tag: tag, Bytes: []byte(strings.Repeat("x", size))}
+	}
+	limits := map[string]TagLimit{
+		"cpuutil": {Priority: PriorityHigh},
+		"shaped":  {Priority: PriorityHigh, Rate: 100},
+		"emf":     {Priority: PriorityLow},
+		"debug":   {Priority: PriorityLow, Rate: 100, Drop: true},
+		"a":       {},
+		"b":       {},
+	}
+
+	tests := []struct {
+		name    string
+		push    []Frame
+		advance time.Duration
+		want    []string
+		wait    time.Duration
+		dropped []string
+	}{
+		{"empty", nil, 0, nil, 0, nil},
+		{"priority", []Frame{frame("emf", 10), frame("other", 10), frame("cpuutil", 10)}, 0, []string{"cpuutil", "other", "emf"}, 0, nil},
+		{"round robin", []Frame{frame("a", 10), frame("a", 10), frame("a", 10), frame("b", 10), frame("b", 10)}, 0, []string{"a", "b", "a", "b", "a"}, 0, nil},
+		{"shaped", []Frame{frame("shaped", 60), frame("shaped", 60)}, 0, []string{"shaped"}, 200 * time.Millisecond, nil},
+		{"shaped after wait", nil, 200 * time.Millisecond, []string{"shaped"}, 0, nil},
+		{"shaped doesn't block lower priorities", []Frame{frame("shaped", 60), frame("shaped", 60), frame("emf", 10)}, 0, []string{"emf"}, 600 * time.Millisecond, nil},
+		{"refilled to the burst", nil, time.Second, []string{"shaped"}, 200 * time.Millisecond, nil},
+		{"drained", nil, 200 * time.Millisecond, []string{"shaped"}, 0, nil},
+		{"drop over rate", []Frame{frame("debug", 60), frame("debug", 60), frame("emf", 10)}, 0, []string{"debug", "emf"}, 0, []string{"debug"}},
+		{"queue full", []Frame{frame("a", 600), frame("a", 600), frame("b", 2000)}, 0, []string{"a", "b"}, 0, []string{"a"}},
+	}
+	clock := newFakeClock()
+	scheduler := newFrameScheduler(limits, 1000)
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		var dropped []string
+		for _, f := range tt.push {
+			if err := scheduler.push(f, clock.Now()); err != nil {
+				if !errors.Is(err, ErrFrameDropped) {
+					t.Fatalf("%s: push() error = %v, want %v", tt.name, err, ErrFrameDropped)
+				}
+				dropped = append(dropped, f.Tag)
+			}
+		}
+		var got []string
+		var wait time.Duration
+		for {
+			f, w, ok := scheduler.next(clock.Now(), false)
+			if !ok {
+				wait = w
+				break
+			}
+			scheduler.sent(f)
+			got = append(got, f.Tag)
+		}
+		if !reflect.DeepEqual(got, tt.want) || wait != tt.wait || !reflect.DeepEqual(dropped, tt.dropped) {
+			t.Errorf("%s: released %q, wait %v, dropped %q, want %q, wait %v, dropped %q", tt.name, got, wait, dropped, tt.want, tt.wait, tt.dropped)
+		}
+	}
+
+	want := TagStats{SentFrames: 1, SentBytes: 60, DroppedFrames: 1, DroppedBytes: 60}
+	if got := *scheduler.stats["debug"]; got != want {
+		t.Errorf("debug stats = %+v, want %+v", got, want)
+	}
+}
+
+// TestFrameSchedulerOtherTags checks tags without a limit share one queue and one set of stats, however many there are
+func TestFrameSchedulerOtherTags(t *testing.T) {
+	scheduler := newFrameScheduler(map[string]TagLimit{"cpuutil": {Priority: PriorityHigh}}, 1000)
+	now := newFakeClock().Now()
+	var dropped int
+	for i := 0; i < 1000; i++ {
+		if err := scheduler.push(Frame{Tag: fmt.Sprintf("tag-%d", i), Bytes: make([]byte, 10)}, now); err != nil {
+			dropped++
+		}
+	}
+	if err := scheduler.push(Frame{Tag: "cpuutil", Bytes: make([]byte, 10)}, now); err != nil {
+		t.Fatalf("push(cpuutil) error = %v", err)
+	}
+	if len(scheduler.queues) != 2 || len(scheduler.stats) != 2 {
+		t.Errorf("tracking %d queues and %d stats, want 2 of each", len(scheduler.queues), len(scheduler.stats))
+	}
+	want := TagStats{DroppedFrames: 900, DroppedBytes: 9000}
+	if dropped != 900 || *scheduler.stats[OtherTags] != want {
+		t.Errorf("dropped %d frames, %s stats = %+v, want %+v", dropped, OtherTags, *scheduler.stats[OtherTags], want)
+	}
+	if frame, _, ok := scheduler.next(now, false); !ok || frame.Tag != "cpuutil" {
+		t.Errorf("next() = %q, want cpuutil first", frame.Tag)
+	}
+}
+
+// TestParseTagLimits checks tag limit flags are parsed and invalid ones rejected
+func TestParseTagLimits(t *testing.T) {
+	got, err := ParseTagLimits("cpuutil:high, emf:low:2048,debug:low:512:drop,,other:normal")
+	if err != nil {
+		t.Fatalf("ParseTagLimits() error = %v", err)
+	}
+	want := map[string]TagLimit{
+		"cpuutil": {Priority: PriorityHigh},
+		"emf":     {Priority: PriorityLow, Rate: 2048},
+		"debug":   {Priority: PriorityLow, Rate: 512, Drop: true},
+		"other":   {Priority: PriorityNormal},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseTagLimits() = %+v, want %+v", got, want)
+	}
+	for _, spec := range []string{"cpuutil", ":high", "cpuutil:urgent", "emf:low:-1", "emf:low:x", "emf:low:1:keep", "emf:low:1:drop:x"} {
+		if _, err := ParseTagLimits(spec); err == nil {
+			t.Errorf("ParseTagLimits(%q) succeeded", spec)
+		}
+	}
+}
+
+// blockingSink is a memorySink whose writes wait until unblocked.
+type blockingSink struct {
+	memorySink
+	unblock chan struct{}
+}
+
+func (s *blockingSink) WriteFrame(frame Frame) (int, error) {
+	<-s.unblock
+	return s.memorySink.WriteFrame(frame)
+}
+
+// TestSchedulingSink checks frames queued behind a busy serial device are written by priority and pending frames are
+// written on Close
+func TestSchedulingSink(t *testing.T) {
+	out := &blockingSink{memorySink: memorySink{name: "serial"}, unblock: make(chan struct{})}
+	limits := map[string]TagLimit{
+		"cpuutil": {Priority: PriorityHigh},
+		"emf":     {Priority: PriorityLow, Rate: 1},
+		"first":   {},
+	}
+	sink := newSchedulingSink(out, limits, 0, newFakeClock())
+	if sink.Name() != "serial" {
+		t.Errorf("Name() = %q, want serial", sink.Name())
+	}
+
+	write := func(tag string) {
+		t.Helper()
+		if _, err := sink.WriteFrame(Frame{Tag: tag, Bytes: []byte(tag + "\n")}); err != nil {
+			t.Fatalf("WriteFrame() error = %v", err)
+		}
+	}
+	// The first frame is taken straight away and blocks the writer, the rest queue behind it
+	write("first")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sink.writer.mu.Lock()
+		queued := len(sink.scheduler.queues["first"].frames)
+		sink.writer.mu.Unlock()
+		if queued == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, tag := range []string{"emf", "emf", "other", "cpuutil"} {
+		write(tag)
+	}
+	for i := 0; i < 4; i++ {
+		out.unblock <- struct{}{}
+	}
+	// The second emf frame is over its rate, with a fake clock it is only written by Close
+	want := []string{"first", "cpuutil", "other", "emf"}
+	if got := waitFrames(t, &out.memorySink, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("written tags = %q, want %q", got, want)
+	}
+
+	close(out.unblock)
+	if err := sink.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if got := out.tags(); len(got) != 5 || got[4] != "emf" {
+		t.Errorf("written tags after Close() = %q, want the pending emf frame last", got)
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+	stats := sink.Stats()
+	if got := stats["emf"]; got.SentFrames != 2 || got.SentBytes != 8 || got.DroppedFrames != 0 {
+		t.Errorf("emf stats = %+v, want 2 frames and 8 bytes sent", got)
+	}
+}
+
+// TestSchedulingSinkDrops checks frames dropped by the underlying sink are counted for their own tag and not reported
+// as an error of a later frame
+func TestSchedulingSinkDrops(t *testing.T) {
+	clock := newFakeClock()
+	conn := newSerialConnection(&fakePort{clock: clock}, DefaultBaudRate, clock)
+	conn.SetBudget(10, "cpuutil")
+	sink := newSchedulingSink(conn, map[string]TagLimit{"cpuutil": {}, "emf": {}}, 0, clock)
+
+	if _, err := sink.WriteFrame(Frame{Tag: "emf", Bytes: make([]byte, 20)}); err != nil {
+		t.Fatalf("WriteFrame(emf) error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sink.Stats()["emf"].DroppedFrames == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := sink.WriteFrame(Frame{Tag: "cpuutil", Bytes: make([]byte, 20)}); err != nil {
+		t.Errorf("WriteFrame(cpuutil) error = %v, want the emf frame's drop not reported", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+
+	msg, keysAndValues := sink.Summary()
+	if want := "[relayd] Dropped frames by tag: emf 1"; msg != want || !reflect.DeepEqual(keysAndValues, []any{"dropped_frames", int64(1)}) {
+		t.Errorf("Summary() = %q %v, want %q", msg, keysAndValues, want)
+	}
+	if msg, _ := sink.Summary(); msg != "" {
+		t.Errorf("second Summary() = %q, want nothing new dropped", msg)
+	}
+}
@@ -0,0 +1,210 @@
+package ec2macossystemmonitor
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultSocketMode allows the relay's user and group to connect, connecting requires write permission.
+	DefaultSocketMode os.FileMode = 0o660
+	// DefaultSocketDirMode lets anyone reach the socket in the directory but only the relay's user change it.
+	DefaultSocketDirMode os.FileMode = 0o755
+)
+
+// LegacyRelaydSocketPath is the socket releases before the socket directory was checked listened on. The relay links
+// it to its socket for a deprecation period, see SerialRelay.LinkLegacySocket, so clients still dialing it keep working.
+const LegacyRelaydSocketPath = "/tmp/.ec2monitoring.sock"
+
+// ErrRelayRunning is returned by NewRelay when another relay is accepting connections on the socket.
+var ErrRelayRunning = errors.New("ec2macossystemmonitor: another relay is listening on the socket")
+
+// SocketPermissions control who may connect to the relay socket. The socket is created in a directory owned by the
+// relay's user, normally root, that no one else can write to, so other users can't replace the socket or create one
+// at its path before the relay starts. Who may connect is then decided by the mode and group of the socket itself.
+type SocketPermissions struct {
+	// Mode is the permission of the socket, DefaultSocketMode if zero. Clients need write permission to connect.
+	Mode os.FileMode
+	// DirMode is the permission of the socket directory when the relay creates it, DefaultSocketDirMode if zero. It
+	// must not be writable by group or others.
+	DirMode os.FileMode
+	// Group is the name of the group the socket belongs to, the relay's group if empty.
+	Group string
+}
+
+// withDefaults returns the permissions with zero values replaced by the defaults.
+func (p SocketPermissions) withDefaults() SocketPermissions {
+	if p.Mode == 0 {
+		p.Mode = DefaultSocketMode
+	}
+	if p.DirMode == 0 {
+		p.DirMode = DefaultSocketDirMode
+	}
+	return p
+}
+
+// gid returns the group id of the socket, or -1 to keep the relay's group.
+func (p SocketPermissions) gid() (int, error) {
+	if p.Group == "" {
+		return -1, nil
+	}
+	group, err := user.LookupGroup(p.Group)
+	if err != nil {
+		return 0, fmt.Errorf("ec2macossystemmonitor: socket group: %w", err)
+	}
+	gid, err := strconv.Atoi(group.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("ec2macossystemmonitor: socket group %s has invalid gid %q", p.Group, group.Gid)
+	}
+	return gid, nil
+}
+
+// listenSocket prepares the socket directory, removes a stale socket left by a previous relay and listens on path
+// with the given permissions.
+func listenSocket(path string, perms SocketPermissions) (*net.UnixListener, error) {
+	perms = perms.withDefaults()
+	if perms.DirMode&0o022 != 0 {
+		return nil, fmt.Errorf("ec2macossystemmonitor: socket directory mode %#o must not be writable by group or others", perms.DirMode)
+	}
+	gid, err := perms.gid()
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareSocketDir(filepath.Dir(path), perms.DirMode); err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	addr, err := net.ResolveUnixAddr("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: unable to resolve address: %w", err)
+	}
+	// Anyone can search the directory, so the socket is created with only the relay's user able to connect, whatever
+	// the umask, until it has its mode and group. The umask is per process, which is fine while the relay starts.
+	umask := syscall.Umask(0o177)
+	listener, err := net.ListenUnix("unix", addr)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macossystemmonitor: unable to listen on socket: %w", err)
+	}
+	if err := os.Chmod(path, perms.Mode.Perm()); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("ec2macossystemmonitor: unable to set socket mode: %w", err)
+	}
+	if err := os.Lchown(path, -1, gid); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("ec2macossystemmonitor: unable to set socket group: %w", err)
+	}
+	return listener, nil
+}
+
+// prepareSocketDir creates dir with mode if it doesn't exist and checks it is a directory owned by the relay's user
+// that no one else can write to.
+func prepareSocketDir(dir string, mode os.FileMode) error {
+	if err := os.Mkdir(dir, mode); err == nil {
+		// Mkdir applies the umask, set the mode requested
+		if err := os.Chmod(dir, mode); err != nil {
+			return fmt.Errorf("ec2macossystemmonitor: unable to set socket directory mode: %w", err)
+		}
+	} else if !os.IsExist(err) {
+		return fmt.Errorf("ec2macossystemmonitor: unable to create socket directory: %w", err)
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to stat socket directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("ec2macossystemmonitor: socket directory %s is not a directory", dir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("ec2macossystemmonitor: socket directory %s must be owned by uid %d", dir, os.Geteuid())
+	}
+	if perm := info.Mode().Perm(); perm&0o022 != 0 {
+		return fmt.Errorf("ec2macossystemmonitor: socket directory %s has mode %#o, it must not be writable by group or others", dir, perm)
+	}
+	return nil
+}
+
+// removeStaleSocket removes a socket left at path by a relay that has stopped. Anything else at path is refused: a
+// file that isn't a socket, a socket owned by another user or a socket another relay is listening on.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to stat socket: %w", err)
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("ec2macossystemmonitor: refusing to remove %s, it is not a socket (%s)", path, info.Mode().Type())
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("ec2macossystemmonitor: refusing to remove %s, it is owned by another user", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: %s", ErrRelayRunning, path)
+	}
+	// Only a refused connection shows nothing is listening, a timeout may be a busy relay
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("ec2macossystemmonitor: unable to check for a relay listening on %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to remove stale socket: %w", err)
+	}
+	return nil
+}
+
+// removeSocket removes the relay's socket at path if it is still a socket.
+func removeSocket(path string) {
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == os.ModeSocket {
+		_ = os.Remove(path)
+	}
+}
+
+// linkLegacySocket creates a symlink at legacy to the relay's socket at target. Since legacy may be in a directory
+// anyone can write to, only a symlink or stale socket owned by the relay's user is replaced, anything else is refused.
+func linkLegacySocket(legacy, target string) error {
+	info, err := os.Lstat(legacy)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("ec2macossystemmonitor: unable to stat legacy socket: %w", err)
+	case info.Mode().Type() == os.ModeSocket:
+		if err := removeStaleSocket(legacy); err != nil {
+			return err
+		}
+	case info.Mode().Type() == os.ModeSymlink:
+		if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Geteuid() {
+			return fmt.Errorf("ec2macossystemmonitor: refusing to replace %s, it is owned by another user", legacy)
+		}
+		if err := os.Remove(legacy); err != nil {
+			return fmt.Errorf("ec2macossystemmonitor: unable to remove legacy socket link: %w", err)
+		}
+	default:
+		return fmt.Errorf("ec2macossystemmonitor: refusing to replace %s, it is not a socket or link (%s)", legacy, info.Mode().Type())
+	}
+	// Symlink fails if someone else created legacy since it was removed
+	if err := os.Symlink(target, legacy); err != nil {
+		return fmt.Errorf("ec2macossystemmonitor: unable to link legacy socket: %w", err)
+	}
+	return nil
+}
+
+// removeLegacySocketLink removes the link at legacy if it still points to target.
+func removeLegacySocketLink(legacy, target string) {
+	if dest, err := os.Readlink(legacy); err == nil && dest == target {
+		_ = os.Remove(legacy)
+	}
+}
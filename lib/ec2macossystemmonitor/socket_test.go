@@ -0,0 +1,187 @@
+package ec2macossystemmonitor
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// otherGroup returns the name and id of a group other than the current one if there is one, the current group
+// otherwise.
+func otherGroup(t *testing.T) (string, int) {
+	t.Helper()
+	for _, name := range []string{"daemon", "nogroup", "staff", "bin"} {
+		if group, err := user.LookupGroup(name); err == nil {
+			if gid, _ := strconv.Atoi(group.Gid); gid != os.Getgid() {
+				return name, gid
+			}
+		}
+	}
+	group, err := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	if err != nil {
+		t.Skipf("no group name for gid %d: %v", os.Getgid(), err)
+	}
+	return group.Name, os.Getgid()
+}
+
+// TestSocketPermissions checks the socket directory and socket are created with the requested mode and group
+func TestSocketPermissions(t *testing.T) {
+	groupName, gid := otherGroup(t)
+	tests := []struct {
+		name     string
+		perms    SocketPermissions
+		wantDir  os.FileMode
+		wantMode os.FileMode
+		wantGID  int
+	}{
+		{"defaults", SocketPermissions{}, DefaultSocketDirMode, DefaultSocketMode, os.Getegid()},
+		{"owner only", SocketPermissions{Mode: 0o600, DirMode: 0o700}, 0o700, 0o600, os.Getegid()},
+		{"group", SocketPermissions{Mode: 0o660, DirMode: 0o750, Group: groupName}, 0o750, 0o660, gid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(filepath.Dir(tempSocketPath(t)), "run")
+			path := filepath.Join(dir, "relay.sock")
+			listener, err := listenSocket(path, tt.perms)
+			if err != nil {
+				t.Fatalf("listenSocket() error = %v", err)
+			}
+			defer listener.Close()
+
+			info, err := os.Lstat(dir)
+			if err != nil {
+				t.Fatalf("Lstat() error = %v", err)
+			}
+			if perm := info.Mode().Perm(); perm != tt.wantDir {
+				t.Errorf("directory mode = %#o, want %#o", perm, tt.wantDir)
+			}
+			info, err = os.Lstat(path)
+			if err != nil {
+				t.Fatalf("Lstat() error = %v", err)
+			}
+			if info.Mode().Type() != os.ModeSocket {
+				t.Errorf("%s is %s, want a socket", path, info.Mode().Type())
+			}
+			if perm := info.Mode().Perm(); perm != tt.wantMode {
+				t.Errorf("socket mode = %#o, want %#o", perm, tt.wantMode)
+			}
+			if stat := info.Sys().(*syscall.Stat_t); int(stat.Gid) != tt.wantGID {
+				t.Errorf("socket gid = %d, want %d", stat.Gid, tt.wantGID)
+			}
+		})
+	}
+
+	path := tempSocketPath(t)
+	if _, err := listenSocket(path, SocketPermissions{DirMode: 0o777}); err == nil {
+		t.Error("listenSocket() with a world writable directory mode succeeded")
+	}
+	if _, err := listenSocket(path, SocketPermissions{Group: "no-such-group-ec2sm"}); err == nil {
+		t.Error("listenSocket() with an unknown group succeeded")
+	}
+}
+
+// TestSocketDirectory checks the relay refuses a socket directory others can write to or that it doesn't own
+func TestSocketDirectory(t *testing.T) {
+	path := tempSocketPath(t)
+	dir := filepath.Dir(path)
+	if err := os.Chmod(dir, 0o777); err != nil {
+		t.Fatalf("Chmod() error = %v", err)
+	}
+	if _, err := listenSocket(path, SocketPermissions{}); err == nil {
+		t.Error("listenSocket() in a world writable directory succeeded")
+	}
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatalf("Chmod() error = %v", err)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("changing the directory owner requires root")
+	}
+	if err := os.Chown(dir, os.Geteuid()+1, -1); err != nil {
+		t.Fatalf("Chown() error = %v", err)
+	}
+	if _, err := listenSocket(path, SocketPermissions{}); err == nil {
+		t.Error("listenSocket() in a directory owned by another user succeeded")
+	}
+}
+
+// TestSocketReplace checks only a stale socket is replaced, other files and live sockets are left alone
+func TestSocketReplace(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, path string)
+		wantErr error
+		replace bool
+	}{
+		{"nothing", func(t *testing.T, path string) {}, nil, true},
+		{"stale socket", func(t *testing.T, path string) {
+			listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+			if err != nil {
+				t.Fatalf("ListenUnix() error = %v", err)
+			}
+			listener.SetUnlinkOnClose(false)
+			listener.Close()
+		}, nil, true},
+		{"live socket", func(t *testing.T, path string) {
+			listener, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatalf("Listen() error = %v", err)
+			}
+			t.Cleanup(func() { listener.Close() })
+		}, ErrRelayRunning, false},
+		{"regular file", func(t *testing.T, path string) {
+			if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+		}, nil, false},
+		{"directory", func(t *testing.T, path string) {
+			if err := os.Mkdir(path, 0o700); err != nil {
+				t.Fatalf("Mkdir() error = %v", err)
+			}
+		}, nil, false},
+		{"symlink", func(t *testing.T, path string) {
+			target := filepath.Join(filepath.Dir(path), "target")
+			if err := os.WriteFile(target, []byte("data"), 0o600); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+			if err := os.Symlink(target, path); err != nil {
+				t.Fatalf("Symlink() error = %v", err)
+			}
+		}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tempSocketPath(t)
+			tt.setup(t, path)
+			before, _ := os.Lstat(path)
+
+			relay, err := NewRelay("", path, SocketPermissions{})
+			if tt.replace {
+				if err != nil {
+					t.Fatalf("NewRelay() error = %v", err)
+				}
+				relay.CleanUp()
+				if _, err := os.Lstat(path); !os.IsNotExist(err) {
+					t.Errorf("socket still exists after CleanUp(), Lstat() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				relay.CleanUp()
+				t.Fatal("NewRelay() succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("NewRelay() error = %v, want %v", err, tt.wantErr)
+			}
+			after, err := os.Lstat(path)
+			if err != nil || !os.SameFile(before, after) || before.Mode() != after.Mode() {
+				t.Errorf("%s was changed by NewRelay()", path)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrInvalidFrame is returned for a frame rejected by a FrameValidator.
+var ErrInvalidFrame = errors.New("ec2macossystemmonitor: invalid frame")
+
+// Reasons a FrameValidator rejects a frame, used in ValidationError and as keys of the rejection log.
+const (
+	ReasonMalformed      = "malformed"
+	ReasonChecksum       = "checksum"
+	ReasonAuthentication = "authentication"
+	ReasonTag            = "tag"
+	ReasonSize           = "size"
+)
+
+// ValidationError is returned by FrameValidator.Validate for a rejected frame.
+type ValidationError struct {
+	// Reason is one of the Reason constants.
+	Reason string
+	// Tag is the tag of the frame, if it could be decoded.
+	Tag string
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Tag == "" {
+		return fmt.Sprintf("%s: %s: %s", ErrInvalidFrame, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: tag %q: %s", ErrInvalidFrame, e.Reason, e.Tag, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Is allows matching with errors.Is(err, ErrInvalidFrame).
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidFrame
+}
+
+// ValidatorStats counts the frames checked by a FrameValidator.
+type ValidatorStats struct {
+	Valid int64
+	// Invalid counts the rejected frames by reason.
+	Invalid map[string]int64
+}
+
+// FrameValidator checks frames before the relay writes them to the serial device: each frame must be no larger than
+// the maximum size, decode as a JSON or binary frame with a valid checksum, and have an allowed tag. A batch must have
+// entries with allowed tags, the batch tag itself needn't be allowed, and a fragment of a batch is rejected when tags
+// are restricted since its entries can't be read. Data is only decompressed to read the entries of a batch, so
+// checking other frames is cheap. It is safe for concurrent use.
+type FrameValidator struct {
+	maxFrameSize int
+	tags         map[string]bool
+	options      decodeOptions
+
+	mu    sync.Mutex
+	stats ValidatorStats
+}
+
+// NewFrameValidator creates a FrameValidator for frames of at most maxFrameSize bytes, or DefaultMaxFrameLength if
+// zero, with one of tags, or any tag if none are given. VerifyWith additionally requires frames to be signed.
+func NewFrameValidator(maxFrameSize int, tags []string, opts ...DecodeOption) *FrameValidator {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameLength
+	}
+	v := &FrameValidator{
+		maxFrameSize: maxFrameSize,
+		stats:        ValidatorStats{Invalid: make(map[string]int64)},
+	}
+	if len(tags) > 0 {
+		v.tags = make(map[string]bool, len(tags))
+		for _, tag := range tags {
+			v.tags[tag] = true
+		}
+	}
+	for _, opt := range opts {
+		opt(&v.options)
+	}
+	return v
+}
+
+// Validate checks frame, returning a *ValidationError if it is rejected.
+func (v *FrameValidator) Validate(frame []byte) error {
+	err := v.validate(frame)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		v.stats.Invalid[validationErr.Reason]++
+		return err
+	}
+	v.stats.Valid++
+	return nil
+}
+
+// validate checks frame without counting the result.
+func (v *FrameValidator) validate(frame []byte) error {
+	if len(frame) > v.maxFrameSize {
+		return &ValidationError{Reason: ReasonSize, Err: fmt.Errorf("frame is %d bytes, limit is %d", len(frame), v.maxFrameSize)}
+	}
+
+	var msg *Message
+	var err error
+	if bytes.HasPrefix(frame, binaryMagic) {
+		msg, err = decodeBinaryFrame(frame, &v.options)
+	} else {
+		msg, err = decodeJSONFrame(frame, &v.options)
+	}
+	var checksumErr *ChecksumError
+	switch {
+	case errors.As(err, &checksumErr):
+		return &ValidationError{Reason: ReasonChecksum, Err: err}
+	case errors.Is(err, ErrAuthentication):
+		return &ValidationError{Reason: ReasonAuthentication, Err: err}
+	case err != nil:
+		return &ValidationError{Reason: ReasonMalformed, Err: err}
+	}
+
+	switch {
+	case v.tags == nil:
+		return nil
+	case msg.Tag != BatchTag:
+		if !v.tags[msg.Tag] {
+			return &ValidationError{Reason: ReasonTag, Tag: msg.Tag, Err: errors.New("tag isn't allowed")}
+		}
+		return nil
+	}
+	tags, err := batchTags(frame)
+	if err != nil {
+		return &ValidationError{Reason: ReasonMalformed, Tag: msg.Tag, Err: err}
+	}
+	for _, tag := range tags {
+		if !v.tags[tag] {
+			return &ValidationError{Reason: ReasonTag, Tag: tag, Err: errors.New("batch entry tag isn't allowed")}
+		}
+	}
+	return nil
+}
+
+// Stats returns the number of valid and rejected frames so far.
+func (v *FrameValidator) Stats() ValidatorStats {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	stats := ValidatorStats{Valid: v.stats.Valid, Invalid: make(map[string]int64, len(v.stats.Invalid))}
+	for reason, n := range v.stats.Invalid {
+		stats.Invalid[reason] = n
+	}
+	return stats
+}
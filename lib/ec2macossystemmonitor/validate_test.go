@@ -0,0 +1,187 @@
+package ec2macossystemmonitor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestFrameValidator checks valid frames are accepted and each kind of invalid frame is rejected with its reason
+func TestFrameValidator(t *testing.T) {
+	keys := mustKeyring(t, testKey("current"))
+	build := func(tag, data string, opts ...MessageOption) []byte {
+		t.Helper()
+		frame, err := BuildMessage(tag, data, false, opts...)
+		if err != nil {
+			t.Fatalf("BuildMessage() error = %v", err)
+		}
+		return frame
+	}
+	corruptJSON := bytes.Replace(build("cpuutil", "2.0"), []byte("2.0"), []byte("3.0"), 1)
+	corruptBinary := corruptBinaryFrame(build("cpuutil", "2.0", WithVersion(ProtocolVersion2), WithEncoding(EncodingCBOR)))
+	compressed, err := BuildMessage("cpuutil", strings.Repeat("2.0 ", 100), true)
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	batch := func(tags ...string) []byte {
+		t.Helper()
+		var entries []BatchEntry
+		for _, tag := range tags {
+			entries = append(entries, BatchEntry{Tag: tag, Data: strings.Repeat("2.0 ", 20)})
+		}
+		frame, err := BuildBatch(entries, WithAutoCompression(1))
+		if err != nil {
+			t.Fatalf("BuildBatch() error = %v", err)
+		}
+		return frame
+	}
+	entries := strings.Repeat(`{"tag":"cpuutil","data":"2.0"},`, 20) + `{"tag":"other","data":"2.0"}`
+	fragments, err := BuildMessages(BatchTag, "["+entries+"]", false, WithMaxFrameSize(300))
+	if err != nil || len(fragments) < 2 {
+		t.Fatalf("BuildMessages() = %d fragments, error = %v", len(fragments), err)
+	}
+
+	tests := []struct {
+		name   string
+		frame  []byte
+		signed bool
+		reason string
+	}{
+		{"json", build("cpuutil", "2.0"), false, ""},
+		{"json without newline", bytes.TrimSuffix(build("cpuutil", "2.0"), []byte("\n")), false, ""},
+		{"binary", build("cpuutil", "2.0", WithVersion(ProtocolVersion2), WithEncoding(EncodingCBOR)), false, ""},
+		{"crc32c", build("cpuutil", "2.0", WithChecksum(ChecksumCRC32C)), false, ""},
+		{"compressed", compressed, false, ""},
+		{"signed", build("cpuutil", "2.0", SignWith(keys)), true, ""},
+		{"empty", nil, false, ReasonMalformed},
+		{"garbage", []byte("not a frame\n"), false, ReasonMalformed},
+		{"truncated", build("cpuutil", "2.0")[:20], false, ReasonMalformed},
+		{"json checksum", corruptJSON, false, ReasonChecksum},
+		{"binary checksum", corruptBinary, false, ReasonChecksum},
+		{"unsigned", build("cpuutil", "2.0"), true, ReasonAuthentication},
+		{"tag", build("other", "2.0"), false, ReasonTag},
+		{"batch", batch("cpuutil", "cpuutil"), false, ""},
+		{"batch entry tag", batch("cpuutil", "other"), false, ReasonTag},
+		{"batch fragment", fragments[0], false, ReasonMalformed},
+		{"size", build("cpuutil", strings.Repeat("x", 1024)), false, ReasonSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []DecodeOption
+			if tt.signed {
+				opts = append(opts, VerifyWith(keys))
+			}
+			v := NewFrameValidator(1024, []string{"cpuutil"}, opts...)
+			err := v.Validate(tt.frame)
+			want := ValidatorStats{Invalid: map[string]int64{}}
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("Validate() error = %v", err)
+				}
+				want.Valid = 1
+			} else {
+				var validationErr *ValidationError
+				if !errors.As(err, &validationErr) || !errors.Is(err, ErrInvalidFrame) {
+					t.Fatalf("Validate() error = %v, want a *ValidationError", err)
+				}
+				if validationErr.Reason != tt.reason {
+					t.Errorf("Validate() reason = %q, want %q", validationErr.Reason, tt.reason)
+				}
+				want.Invalid[tt.reason] = 1
+			}
+			if got := v.Stats(); !reflect.DeepEqual(got, want) {
+				t.Errorf("Stats() = %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	if err := NewFrameValidator(0, nil).Validate(build("anything", strings.Repeat("x", 1024))); err != nil {
+		t.Errorf("Validate() without limits error = %v", err)
+	}
+}
+
+// TestRelayValidator checks the relay only writes valid frames to its sinks
+func TestRelayValidator(t *testing.T) {
+	path := tempSocketPath(t)
+	sink := &memorySink{name: "serial"}
+	validator := NewFrameValidator(0, []string{"cpuutil", "emf"})
+	startRelay(t, path, sink, func(relay *SerialRelay) { relay.SetValidator(validator) })
+
+	client := NewClient(WithSocketPath(path))
+	valid, err := BuildMessage("emf", "{}", false)
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	frames := [][]byte{
+		[]byte("garbage\n"),
+		bytes.Replace(valid, []byte("{}"), []byte("[]"), 1),
+		valid,
+	}
+	for _, frame := range frames {
+		if _, err := client.Write(context.Background(), frame); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if _, err := client.Send(context.Background(), "other", "2.0"); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if _, err := client.Send(context.Background(), "cpuutil", "2.0"); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	want := []string{"emf", "cpuutil"}
+	if got := waitFrames(t, sink, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("relayed tags = %q, want %q", got, want)
+	}
+	stats := validator.Stats()
+	wantInvalid := map[string]int64{ReasonMalformed: 1, ReasonChecksum: 1, ReasonTag: 1}
+	if stats.Valid != 2 || !reflect.DeepEqual(stats.Invalid, wantInvalid) {
+		t.Errorf("Stats() = %+v, want 2 valid and %v", stats, wantInvalid)
+	}
+}
+
+// FuzzFrameValidator checks arbitrary input never panics, is rejected with a reason, and that accepted frames respect
+// the limits and decode
+func FuzzFrameValidator(f *testing.F) {
+	goldens, _ := filepath.Glob(filepath.Join("testdata", "protocol", "*.golden"))
+	for _, golden := range goldens {
+		if b, err := os.ReadFile(golden); err == nil {
+			f.Add(b)
+		}
+	}
+	f.Add([]byte(`{"csum":0,"payload":""}`))
+	f.Add(append([]byte{}, binaryMagic...))
+	const maxFrameSize = 512
+	reasons := map[string]bool{ReasonMalformed: true, ReasonChecksum: true, ReasonTag: true, ReasonSize: true}
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		v := NewFrameValidator(maxFrameSize, []string{"cpuutil", "test"})
+		err := v.Validate(frame)
+		if err != nil {
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) || !reasons[validationErr.Reason] {
+				t.Fatalf("Validate() error = %v, want a *ValidationError with a known reason", err)
+			}
+			return
+		}
+		if len(frame) > maxFrameSize {
+			t.Errorf("Validate() accepted a frame of %d bytes", len(frame))
+		}
+		msg, err := DecodeMessage(frame)
+		var dataErr *DataError
+		if errors.As(err, &dataErr) {
+			// The validator doesn't decompress, so data may still be invalid.
+			return
+		}
+		if err != nil {
+			t.Fatalf("DecodeMessage() of an accepted frame error = %v", err)
+		}
+		if msg.Tag != "cpuutil" && msg.Tag != "test" {
+			t.Errorf("Validate() accepted tag %q", msg.Tag)
+		}
+	})
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io/fs"
 	"log"
 	"os"
 	"os/signal"
 	"strconv"
-	"sync/atomic"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,6 +19,19 @@ import (
 // pollInterval is the duration in between gathering of CPU metrics.
 const pollInterval = 60 * time.Second
 
+// collectorJitter is the maximum random delay added to collector intervals.
+const collectorJitter = 2 * time.Second
+
+// minCommandInterval and maxCommandInterval bound the poll interval the host may set with the set-interval command.
+const (
+	minCommandInterval = 5 * time.Second
+	maxCommandInterval = time.Hour
+)
+
+// exitSerialStuck is the exit code when the serial device is stuck even after reopening it, EX_TEMPFAIL so launchd's
+// restart can be told apart from other failures.
+const exitSerialStuck = 75
+
 // defaultSerialDevices lists the preferred order and supported set of serial
 // devices attached to the instance for monitor communication. The serial device
 // is able to receive monitor payloads encapsulated in json.
@@ -27,12 +42,80 @@ var defaultSerialDevices = []string{
 
 func main() {
 	disableSyslog := flag.Bool("disable-syslog", false, "Prevent log output to syslog")
+	logLevel := flag.String("log-level", "info", "Minimum level to log: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Format for log output: text or json")
+	logFile := flag.String("log-file", "", "Write logs directly to this file instead of stdout, rotating it as configured")
+	logMaxSize := flag.Int64("log-max-size", 10, "Size in MiB at which the log file and frame archive are rotated, 0 to disable")
+	logMaxAge := flag.Duration("log-max-age", 7*24*time.Hour, "Age at which the log file and frame archive are rotated, 0 to disable")
+	logMaxBackups := flag.Int("log-max-backups", 5, "Number of rotated log and archive files to keep, 0 to keep all")
+	logCompress := flag.Bool("log-compress", true, "Compress rotated log and archive files with gzip")
+	archiveFile := flag.String("archive-file", "", "Also archive relayed frames to this file, rotated like the log file")
+	archiveTags := flag.String("archive-tags", "", "Comma separated tags to archive, all tags if empty")
+	forwardURL := flag.String("forward", "", "Also forward relayed frames to tcp://host:port or udp://host:port")
+	forwardTags := flag.String("forward-tags", "", "Comma separated tags to forward, all tags if empty")
+	coalesceWindow := flag.Duration("coalesce-window", 0, "Batch frames arriving within this window before writing them to the serial device, 0 to disable")
+	socketPath := flag.String("socket-path", ec2sm.DefaultRelaydSocketPath, "UNIX socket the relay listens on and collectors send to")
+	socketMode := flag.String("socket-mode", fmt.Sprintf("%#o", ec2sm.DefaultSocketMode), "Octal permissions of the relay socket, clients need write permission to connect")
+	legacySocket := flag.Bool("legacy-socket", false, "Also link "+ec2sm.LegacyRelaydSocketPath+" to the relay socket for clients of earlier releases, this is deprecated")
+	socketGroup := flag.String("socket-group", "", "Group allowed to connect to the relay socket, the relay's group if empty")
+	peerPolicy := flag.String("peer-policy", "", "Only relay frames from the users and groups, tags and rates in this root-owned file")
+	validateFrames := flag.Bool("validate-frames", false, "Drop frames that aren't valid messages with a correct checksum before writing them to the serial device")
+	allowedTags := flag.String("allowed-tags", "", "Comma separated tags relayed when validating frames, all tags if empty")
+	maxFrameLength := flag.Int("max-frame-length", ec2sm.DefaultMaxFrameLength, "Largest frame in bytes relayed when validating frames")
+	tagLimits := flag.String("tag-limits", "", "Comma separated tag:priority[:rate[:drop]] limits sharing the serial device, such as cpuutil:high,emf:low:2048")
+	tagQueueSize := flag.Int("tag-queue-size", ec2sm.DefaultSchedulerQueueSize, "Bytes queued per tag for the serial device when -tag-limits is set")
+	serialWriteTimeout := flag.Duration("serial-write-timeout", ec2sm.DefaultSerialWatchdog.WriteTimeout, "Time a write to the serial device may take beyond the time its bytes take at the baud rate, 0 to never time out")
+	serialStuckAfter := flag.Int("serial-stuck-after", ec2sm.DefaultSerialWatchdog.StuckAfter, "Consecutive timed out writes after which the serial device is reopened, then the relay exits")
+	serialBudget := flag.Int("serial-budget", 0, "Bytes per minute written to the serial device before frames without a critical tag are shed, 0 for no budget")
+	criticalTags := flag.String("critical-tags", "cpuutil,"+ec2sm.AckTag, "Comma separated tags never shed to keep within -serial-budget")
+	commands := flag.Bool("commands", false, "Read signed commands from the host on the serial device and acknowledge them")
+	commandKeyFile := flag.String("command-key-file", "", "Root-only key file authenticating host commands and signing their acks, required with -commands")
+	allowedCommands := flag.String("allowed-commands", "ping", "Comma separated commands the host may run: ping, snapshot and set-interval")
+	stdoutFrames := flag.Bool("stdout-frames", false, "Also write relayed frames to stdout for debugging")
+	stampMessages := flag.Bool("stamp-messages", false, "Send version 2 messages with a timestamp, producer and sequence number")
+	producer := flag.String("producer", "", "Producer identifier for stamped messages, defaults to the hostname")
+	checksum := flag.String("checksum", "adler32", "Checksum algorithm for sent messages: adler32 or crc32c, crc32c sends version 2 messages")
+	encoding := flag.String("encoding", "json", "Frame encoding for sent messages: json or cbor, cbor sends base64 encoded binary version 2 frames")
+	keyFile := flag.String("key-file", "", "Sign sent messages with HMAC-SHA256 using the last key in this root-only file, this sends version 2 messages")
 	flag.Parse()
 
-	logger, err := ec2sm.NewLogger("ec2monitoring-cpuutilization", !*disableSyslog, true)
+	level, err := ec2sm.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	format, err := ec2sm.ParseFormat(*logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Rotation applies to both the log file and the frame archive
+	rotation := ec2sm.LogRotation{
+		MaxSize:    *logMaxSize * 1024 * 1024,
+		MaxAge:     *logMaxAge,
+		MaxBackups: *logMaxBackups,
+		Compress:   *logCompress,
+	}
+
+	// Log to stdout only when not managing a log file, launchd redirects stdout to the same log file by default.
+	logger, err := ec2sm.NewLogger("ec2monitoring-cpuutilization", !*disableSyslog, *logFile == "")
 	if err != nil {
 		log.Fatalf("Failed to create logger: %s", err)
 	}
+	logger.Format = format
+	logger.SetLevel(level)
+	if *logFile != "" {
+		logger.File, err = ec2sm.OpenLogFile(*logFile, rotation)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %s", err)
+		}
+		logger.File.OnError = func(err error) {
+			log.Printf("Failed to clean up rotated log files: %s", err)
+		}
+		// Allow external rotators to move the file away and signal for it to be reopened, this runs until exit.
+		logger.File.ReopenOnSignal(func(err error) {
+			log.Printf("Failed to reopen log file: %s", err)
+		}, syscall.SIGUSR1)
+	}
 
 	serialDevice := firstSerialDevice(defaultSerialDevices)
 	if serialDevice == "" {
@@ -40,73 +123,205 @@ func main() {
 	}
 	logger.Infof("Found serial device for relay %q\n", serialDevice)
 
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		log.Fatalf("Invalid socket mode %q", *socketMode)
+	}
+	perms := ec2sm.SocketPermissions{Mode: fs.FileMode(mode), Group: *socketGroup}
+
 	logger.Infof("Starting up relayd for monitoring\n")
-	relay, err := ec2sm.NewRelay(serialDevice)
+	relay, err := ec2sm.NewRelay(serialDevice, *socketPath, perms)
 	if err != nil {
 		log.Fatalf("Failed to create relay: %s", err)
 	}
-	intervalString := strconv.Itoa(ec2sm.DefaultLogInterval)
-	cpuStatus := ec2sm.StatusLogBuffer{Message: "Sent CPU Utilization (%d bytes) over " + intervalString + " minute(s)", Written: 0}
-	relayStatus := ec2sm.StatusLogBuffer{Message: "[relayd] Received data and sent %d bytes to serial device over " + intervalString + " minutes", Written: 0}
+	if *legacySocket {
+		// Failing to link is fatal, something else at the path, such as a socket another user created first, would
+		// receive the data of clients of earlier releases
+		if err := relay.LinkLegacySocket(ec2sm.LegacyRelaydSocketPath); err != nil {
+			relay.CleanUp()
+			log.Fatalf("Failed to link the legacy socket: %s", err)
+		}
+	}
+	var policy *ec2sm.PeerPolicy
+	if *peerPolicy != "" {
+		var err error
+		if policy, err = ec2sm.LoadPeerPolicy(*peerPolicy); err != nil {
+			log.Fatalf("Failed to load peer policy: %s", err)
+		}
+		relay.SetPeerPolicy(policy)
+	}
+	if *validateFrames {
+		relay.SetValidator(ec2sm.NewFrameValidator(*maxFrameLength, splitTags(*allowedTags)))
+	}
+	if *serialBudget > 0 {
+		relay.Serial().SetBudget(*serialBudget, splitTags(*criticalTags)...)
+	}
+	if *coalesceWindow > 0 {
+		relay.Coalesce(*coalesceWindow, ec2sm.DefaultMaxFrameSize)
+	}
+	var serialScheduler *ec2sm.SchedulingSink
+	if *tagLimits != "" {
+		limits, err := ec2sm.ParseTagLimits(*tagLimits)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serialScheduler = relay.Schedule(limits, *tagQueueSize)
+	}
+	if *archiveFile != "" {
+		archive, err := ec2sm.NewArchiveSink(*archiveFile, rotation)
+		if err != nil {
+			log.Fatalf("Failed to open archive: %s", err)
+		}
+		relay.AddSink(archive, splitTags(*archiveTags)...)
+	}
+	if *forwardURL != "" {
+		forward, err := ec2sm.ParseForwardSink(*forwardURL)
+		if err != nil {
+			log.Fatalf("Failed to create forwarder: %s", err)
+		}
+		relay.AddSink(forward, splitTags(*forwardTags)...)
+	}
+	if *stdoutFrames {
+		relay.AddSink(ec2sm.NewWriterSink("stdout", os.Stdout))
+	}
+	// Summarize bytes sent and repeated errors rather than logging every write
+	status := ec2sm.NewLogAggregator(logger, ec2sm.DefaultLogInterval*time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	go status.Run(ctx)
+	if policy != nil {
+		status.Summarize("relayd-peer-policy", policy.Summary)
+	}
+
+	// Reopen a stuck serial device once, then exit so launchd restarts the relay
+	relay.Serial().SetWatchdog(ec2sm.SerialWatchdog{
+		WriteTimeout: *serialWriteTimeout,
+		StuckAfter:   *serialStuckAfter,
+		MaxReopens:   ec2sm.DefaultSerialWatchdog.MaxReopens,
+		OnStuck: func(err error) {
+			status.Flush()
+			logger.Errorf("Exiting, %s\n", err)
+			os.Exit(exitSerialStuck)
+		},
+	})
 
 	// Kick off Relay in a go routine
-	go relay.StartRelay(logger, &relayStatus)
+	go relay.StartRelay(logger, status)
 
 	// Setup signal handling into a channel, catch SIGINT and SIGTERM for now which should suffice for launchd
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	// Setup the polling channel for kicking off CPU metrics gathering
-	pollingCh := time.Tick(pollInterval)
-
-	// Setup logging interval timer for flushing logs
-	LoggingTimer := time.Tick(ec2sm.DefaultLogInterval * time.Minute)
-
 	// Check if the socket is there, if not, warn that this might fail
-	if !ec2sm.CheckSocketExists(ec2sm.DefaultRelaydSocketPath) {
+	if !ec2sm.CheckSocketExists(*socketPath) {
 		logger.Fatal("Socket does not exist, relayd may not be running")
 	}
-	// Main for loop that polls for signals and CPU ticks
-	for {
-		select {
-		case sig := <-signals:
-			if cpuStatus.Written > 0 {
-				logger.Infof(cpuStatus.Message, cpuStatus.Written)
+
+	// Select the encoding and integrity protection of sent messages
+	checksumAlgorithm, err := ec2sm.ParseChecksumAlgorithm(*checksum)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	frameEncoding, err := ec2sm.ParseEncoding(*encoding)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	var opts []ec2sm.MessageOption
+	if frameEncoding != ec2sm.EncodingJSON {
+		opts = append(opts, ec2sm.WithEncoding(frameEncoding))
+	}
+	if checksumAlgorithm != ec2sm.ChecksumAdler32 {
+		opts = append(opts, ec2sm.WithChecksum(checksumAlgorithm))
+	}
+	if *keyFile != "" {
+		keys, err := ec2sm.LoadKeyring(*keyFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		opts = append(opts, ec2sm.SignWith(keys))
+	}
+
+	// Register the collectors, each runs on its own interval and sends its samples to the relay
+	clientOpts := []ec2sm.ClientOption{ec2sm.WithSocketPath(*socketPath), ec2sm.WithMessageOptions(opts...)}
+	if *stampMessages {
+		if *producer == "" {
+			*producer, _ = os.Hostname()
+		}
+		clientOpts = append(clientOpts, ec2sm.WithStamper(ec2sm.NewStamper(*producer)))
+	}
+	client := ec2sm.NewClient(clientOpts...)
+	scheduler := ec2sm.NewScheduler(client.SendSample)
+	scheduler.Jitter = collectorJitter
+	scheduler.OnError = func(c ec2sm.Collector, err error) {
+		// Exit so launchd restarts the monitor, collection or relay failures are not expected to recover on their own
+		logger.Fatal(err)
+	}
+	scheduler.OnSent = func(c ec2sm.Collector, n int) {
+		// Add current written values to the running total which is logged once the interval has elapsed
+		status.Count(c.Name()+"-written", "Sent "+c.Name()+" bytes", int64(n))
+	}
+	cpuCollector := ec2sm.NewCPUCollector(pollInterval)
+	if err := scheduler.Register(cpuCollector); err != nil {
+		logger.Fatal(err)
+	}
+	go scheduler.Run(ctx)
+
+	// Serve commands from the host once the collectors they act on are running
+	if *commands {
+		if *commandKeyFile == "" {
+			logger.Fatal("-commands requires -command-key-file")
+		}
+		keys, err := ec2sm.LoadKeyring(*commandKeyFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		server, err := ec2sm.NewCommandServer(keys, splitTags(*allowedCommands)...)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		server.OnError = func(err error) {
+			status.Recordf(ec2sm.LevelWarn, "relayd-command-error", "Rejected command frame: %s", err)
+		}
+		server.Handle("ping", func(context.Context, ec2sm.Command) (string, error) {
+			return "pong", nil
+		})
+		server.Handle("snapshot", func(ctx context.Context, cmd ec2sm.Command) (string, error) {
+			return "", scheduler.CollectNow(ctx, cmd.Args["collector"])
+		})
+		server.Handle("set-interval", func(_ context.Context, cmd ec2sm.Command) (string, error) {
+			interval, err := time.ParseDuration(cmd.Args["interval"])
+			if err != nil {
+				return "", err
 			}
-			if relayStatus.Written > 0 {
-				logger.Infof(relayStatus.Message, relayStatus.Written)
+			if interval < minCommandInterval || interval > maxCommandInterval {
+				return "", fmt.Errorf("interval %s isn't between %s and %s", interval, minCommandInterval, maxCommandInterval)
 			}
-			log.Println("exiting due to signal:", sig)
-			// Send signal to relay server through channel to shutdown
-			relay.ReadyToClose <- true
-			// Exit cleanly
-			os.Exit(0)
-		case <-pollingCh:
-			// Fetch the current CPU Utilization
-			cpuUtilization, err := ec2sm.RunningCpuUsage()
-			if err != nil {
-				logger.Fatalf("Unable to get CPU Utilization: %s\n", err)
+			cpuCollector.SetInterval(interval)
+			logger.Infof("Poll interval set to %s by the host\n", interval)
+			return interval.String(), nil
+		})
+		go func() {
+			if err := relay.ServeCommands(ctx, server); err != nil && ctx.Err() == nil {
+				logger.Errorf("Stopped serving commands: %s\n", err)
 			}
+		}()
+	}
 
-			// Send the data to the relay
-			written, err := ec2sm.SendMessage("cpuutil", cpuUtilization, false)
-			if err != nil {
-				logger.Fatalf("Unable to write message to relay: %s", err)
-			}
-			// Add current written values to running total cpuStatus.Written
-			cpuStatus.Written += int64(written)
-		case <-LoggingTimer:
-			// flush the logs since the timer fired. The cpuStatus info is local to this routine but relayStatus is not,
-			// so use atomic for the non-local one to ensure its safe
-			logger.Infof(cpuStatus.Message, cpuStatus.Written)
-			// Since we logged the total, reset to zero for continued tracking
-			cpuStatus.Written = 0
-			logger.Infof(relayStatus.Message, relayStatus.Written)
-			// Since we logged the total, reset to zero, do this via atomic since its modified in another goroutine
-			atomic.StoreInt64(&relayStatus.Written, 0)
+	// Wait for a signal to exit
+	sig := <-signals
+	// Log what has been collected so far rather than waiting for the interval
+	status.Flush()
+	logger.Infof("[relayd] Serial link %s\n", relay.Serial().Stats())
+	if serialScheduler != nil {
+		for tag, stats := range serialScheduler.Stats() {
+			logger.Infof("[relayd] Tag %q sent %d frames (%d bytes), dropped %d frames (%d bytes)\n", tag, stats.SentFrames, stats.SentBytes, stats.DroppedFrames, stats.DroppedBytes)
 		}
-
 	}
+	log.Println("exiting due to signal:", sig)
+	// Stop collecting and send signal to relay server through channel to shutdown
+	cancel()
+	relay.ReadyToClose <- true
+	// Exit cleanly
+	os.Exit(0)
 }
 
 // firstSerialDevice returns the first path found in the list of serial device
@@ -128,3 +343,14 @@ func firstSerialDevice(devPaths []string) string {
 	// no suitable device found
 	return ""
 }
+
+// splitTags splits a comma separated list of tags, returning nil for an empty list.
+func splitTags(list string) []string {
+	var tags []string
+	for _, tag := range strings.Split(list, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}